@@ -0,0 +1,249 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"go-notifier/internal"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "configuration file helpers",
+	}
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "validate the configuration and print the effective config",
+		Long: `validate the config file, the selected profile, the NOTIFIER_* environment variables and the flags of the notifier
+and print the effective merged config with the secrets masked`,
+		Args: cobra.NoArgs,
+		RunE: runConfigValidateCmd,
+	}
+	configArgs struct {
+		path    string // config file, searched on the default path when empty
+		profile string // profile of the config file
+	}
+	// fileConfig is the config file merged with the selected profile, nil without config file
+	fileConfig *internal.Config
+)
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&configArgs.path, "config", "", "Config file, the first existing of notifier.yaml, ~/.config/notifier/config.yaml and /etc/notifier/config.yaml is used when empty")
+	flags.StringVar(&configArgs.profile, "profile", "", "Profile of the config file, e.g. staging or prod")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return applyConfig(cmd.Flags())
+	}
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// applyConfig sets the flags that are not given on the command line from the NOTIFIER_* environment variables,
+// then from the profile and the config file, settings of the other commands are ignored
+func applyConfig(flags *pflag.FlagSet) error {
+	for _, name := range []string{"config", "profile"} {
+		if err := setFromEnv(flags, flags.Lookup(name)); err != nil {
+			return err
+		}
+	}
+	path := configPath()
+	var err error
+	if fileConfig, err = loadConfig(path); err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	if fileConfig != nil {
+		settings = fileConfig.Settings
+	}
+
+	known := settingNames(rootCmd)
+	for name := range settings {
+		if !known[name] || name == "config" || name == "profile" {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+	}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		if err = setFromEnv(flags, f); err != nil || f.Changed {
+			return
+		}
+		value, ok := settings[f.Name]
+		if !ok {
+			return
+		}
+		var values []string
+		if values, err = internal.SettingValues(value); err != nil {
+			err = fmt.Errorf("config file %s: setting %s: %w", path, f.Name, err)
+			return
+		}
+		for _, v := range values {
+			if err = flags.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("config file %s: setting %s: %w", path, f.Name, err)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// configPath returns the config file given, or the first existing one of the default search path
+func configPath() string {
+	if configArgs.path != "" {
+		return configArgs.path
+	}
+	return internal.FindConfig()
+}
+
+// loadConfig loads the config file merged with the selected profile, nil when path is empty
+func loadConfig(path string) (*internal.Config, error) {
+	if path == "" {
+		if configArgs.profile != "" {
+			return nil, errors.New("profile given without config file")
+		}
+		return nil, nil
+	}
+	cfg, err := internal.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Profile(configArgs.profile)
+}
+
+// setFromEnv sets the flag from its NOTIFIER_* environment variable when set
+func setFromEnv(flags *pflag.FlagSet, f *pflag.Flag) error {
+	if f == nil || f.Changed {
+		return nil
+	}
+	env := internal.SettingEnv(f.Name)
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+	if err := flags.Set(f.Name, value); err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	return nil
+}
+
+// settingNames returns the flag names of the command and its sub commands
+func settingNames(cmd *cobra.Command) map[string]bool {
+	names := map[string]bool{}
+	cmd.LocalFlags().VisitAll(func(f *pflag.Flag) { names[f.Name] = true })
+	for _, sub := range cmd.Commands() {
+		for name := range settingNames(sub) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// configRoutes returns a copy of the routes of the config file, nil when there are none
+func configRoutes() *internal.RoutesConfig {
+	if fileConfig == nil || fileConfig.Routes == nil {
+		return nil
+	}
+	routes := *fileConfig.Routes
+	return &routes
+}
+
+func runConfigValidateCmd(cmd *cobra.Command, args []string) error {
+	// the settings are the flags of the notifier
+	flags := rootCmd.Flags()
+	rootCmd.LocalFlags() // merges the persistent flags
+	if err := applyConfig(flags); err != nil {
+		return err
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	return printConfig(cmd.OutOrStdout(), flags)
+}
+
+// validateConfig checks the effective settings and routes the way the notifier sets them up
+func validateConfig() error {
+	if err := logArgs.Validate(); err != nil {
+		return err
+	}
+	if rootArgs.workers < 1 {
+		return fmt.Errorf("invalid workers %d, should be at least 1", rootArgs.workers)
+	}
+	if rootArgs.ordered && rootArgs.priority {
+		return errors.New("ordered and priority modes can't be used together")
+	}
+	if _, err := internal.ParseStages(rootArgs.stages); err != nil {
+		return err
+	}
+	if _, err := internal.ParseSyslogSeverity(rootArgs.severity); err != nil {
+		return err
+	}
+	if rootArgs.rules == "" && configRoutes() == nil {
+		if !isValidURL(rootArgs.url) {
+			return fmt.Errorf("invalid url %q", rootArgs.url)
+		}
+		return nil
+	}
+	router, err := newRouter(zap.NewNop(), rootArgs.rules, configRoutes(), rootArgs.url, rootArgs.retry, nil)
+	if err != nil {
+		return err
+	}
+	// release the files and connections of the destinations, only the config is checked
+	if closer, ok := router.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
+}
+
+// printConfig prints the effective settings and routes with the secrets masked
+func printConfig(out io.Writer, flags *pflag.FlagSet) error {
+	effective := struct {
+		Settings map[string]interface{} `yaml:",inline"`
+		Routes   *internal.RoutesConfig `yaml:"routes,omitempty"`
+	}{Settings: map[string]interface{}{}}
+	flags.VisitAll(func(f *pflag.Flag) {
+		switch f.Name {
+		case "help", "config", "profile":
+			return
+		}
+		var value interface{} = f.Value.String()
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			value = slice.GetSlice()
+		} else if kind := f.Value.Type(); kind == "bool" || kind == "int" {
+			value = yamlScalar(f.Value.String())
+		}
+		switch {
+		case internal.IsSecretName(f.Name) && f.Value.Type() == "string":
+			value = internal.MaskSecret(f.Value.String())
+		case f.Name == "url":
+			value = internal.MaskURL(f.Value.String(), rootArgs.urlType)
+		}
+		effective.Settings[f.Name] = value
+	})
+	if rootArgs.rules == "" {
+		effective.Routes = configRoutes().Masked()
+	}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(effective); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// yamlScalar returns the flag value as yaml scalar so that numbers and booleans are not quoted
+func yamlScalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+package cmd
+
+import (
+	"go-notifier/internal"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// exit codes of the notifier, documented in the README
+const (
+	exitOK          = 0   // every message was delivered or skipped by the stages
+	exitPartial     = 1   // some messages failed, expired or were dropped
+	exitFailure     = 2   // no message was delivered
+	exitInput       = 3   // the input could not be read
+	exitConfig      = 4   // invalid flags or configuration
+	exitInterrupted = 130 // interrupted before the input was completed
+)
+
+// stopReason is a cause of shutdown other than an os signal, sent on the done channel
+type stopReason string
+
+func (r stopReason) String() string { return string(r) }
+
+func (r stopReason) Signal() {}
+
+const (
+	stopInputError stopReason = "input error"       // the input could not be read
+	stopFailFast   stopReason = "permanent failure" // a message failed in fail fast mode
+	stopCompleted  stopReason = "input completed"   // the input was read until EOF
+)
+
+// fatal logs the error and exits with the code
+func fatal(l *zap.Logger, code int, msg string, fields ...zap.Field) {
+	l.Error(msg, fields...)
+	l.Sync()
+	os.Exit(code)
+}
+
+// deliveryExitCode returns the exit code of the deliveries of the report
+func deliveryExitCode(report *internal.Report) int {
+	switch {
+	case report.AllDelivered():
+		return exitOK
+	case report.Sent == 0 && report.Partial == 0:
+		return exitFailure
+	default:
+		return exitPartial
+	}
+}
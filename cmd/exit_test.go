@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"go-notifier/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deliveryExitCode(t *testing.T) {
+	tests := map[string]struct {
+		report internal.Report
+		want   int
+	}{
+		"Should be ok when all are sent":                  {report: internal.Report{Lines: 2, Sent: 2}, want: exitOK},
+		"Should be ok when lines are skipped":             {report: internal.Report{Lines: 2, Sent: 1, Skipped: 1}, want: exitOK},
+		"Should be ok when there is no input":             {report: internal.Report{}, want: exitOK},
+		"Should be partial when some failed":              {report: internal.Report{Lines: 2, Sent: 1, Failed: 1}, want: exitPartial},
+		"Should be partial when some expired":             {report: internal.Report{Lines: 2, Sent: 1, Expired: 1}, want: exitPartial},
+		"Should be partial when some were dropped":        {report: internal.Report{Lines: 2, Sent: 1, Dropped: 1}, want: exitPartial},
+		"Should be partial when only partially delivered": {report: internal.Report{Lines: 1, Partial: 1}, want: exitPartial},
+		"Should be failure when nothing was sent":         {report: internal.Report{Lines: 2, Failed: 2}, want: exitFailure},
+		"Should be failure when everything was dropped":   {report: internal.Report{Lines: 2, Expired: 1, Dropped: 1}, want: exitFailure},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.want, deliveryExitCode(&testCase.report))
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+package cmd
+
+import (
+	"context"
+	"go-notifier/internal"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// newClient creates the router when a rules file or config routes are given, otherwise the client of the url
+func newClient(l *zap.Logger, routes *internal.RoutesConfig, clock internal.Clock, metrics *internal.Metrics) (internal.HttpClient, error) {
+	if rootArgs.rules != "" || routes != nil {
+		return newRouter(l, rootArgs.rules, routes, rootArgs.url, rootArgs.retry, metrics)
+	}
+	return internal.NewDestinationClient(l, internal.Destination{Name: internal.DefaultDestination, URL: rootArgs.url, Retry: &rootArgs.retry, Clock: clock, Metrics: metrics, Refresh: rootArgs.refresh, Type: rootArgs.urlType})
+}
+
+// reloader rebuilds the destinations, limiters and templates from the config and rules files
+// and swaps them into the running client, an invalid config is rejected and the running one is kept
+type reloader struct {
+	mu      sync.Mutex // serializes the reloads
+	logger  *zap.Logger
+	client  *internal.ReloadableClient
+	clock   internal.Clock
+	metrics *internal.Metrics
+}
+
+// run reloads on SIGHUP and, when interval is set, on changes of the config and rules files until the context is done
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var paths []string
+	for _, path := range []string{configPath(), rootArgs.rules} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if rootArgs.reload > 0 && len(paths) > 0 {
+		go internal.WatchFiles(ctx, r.clock, rootArgs.reload, paths, func() { r.reload("file change") })
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("SIGHUP")
+		}
+	}
+}
+
+// reload loads the config file with the selected profile and swaps the client when it is valid,
+// only the routes, destinations and rules are reloaded, the other settings need a restart
+func (r *reloader) reload(trigger string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := configPath()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		r.logger.Error("reload rejected, keeping the running config", zap.String("trigger", trigger), zap.Error(err))
+		return
+	}
+	var routes *internal.RoutesConfig
+	if cfg != nil && cfg.Routes != nil {
+		copied := *cfg.Routes
+		routes = &copied
+	}
+	client, err := newClient(r.logger, routes, r.clock, r.metrics)
+	if err != nil {
+		r.logger.Error("reload rejected, keeping the running config", zap.String("trigger", trigger), zap.Error(err))
+		return
+	}
+	if err := internal.StartClient(client); err != nil {
+		if closer, ok := client.(io.Closer); ok {
+			closer.Close()
+		}
+		r.logger.Error("reload rejected, keeping the running config", zap.String("trigger", trigger), zap.Error(err))
+		return
+	}
+	if cfg != nil && fileConfig != nil && !reflect.DeepEqual(cfg.Settings, fileConfig.Settings) {
+		r.logger.Warn("changed settings are applied on restart, only the routes are reloaded", zap.String("config", path))
+	}
+	r.client.Swap(client)
+	fileConfig = cfg
+	r.logger.Info("config reloaded", zap.String("trigger", trigger), zap.String("config", path), zap.String("rules", rootArgs.rules))
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"go-notifier/internal"
+	"io"
 	"log"
 	"net/url"
 	"os"
@@ -18,15 +19,13 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/mattn/go-colorable"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 const (
-	workerPoolSize = 5     // default worker pool size
-	env            = "dev" // development or production env
+	defaultWorkers = 5 // default worker pool size
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -38,9 +37,42 @@ var (
 		Run:   runRootCmd,
 	}
 	rootArgs struct {
-		url      string        // url where notification to be sent
-		interval time.Duration // interval in which notification to be sent
+		url      string                   // url where notification to be sent
+		interval time.Duration            // interval in which notification to be sent
+		workers  int                      // worker pool size
+		listen   []string                 // unix or tcp addresses to receive newline delimited messages
+		listener internal.ListenerConfig  // limits applied to listener connections
+		syslog   []string                 // udp or tcp addresses to receive syslog messages
+		severity string                   // least severe syslog severity to be notified
+		rules    string                   // rules file to route messages to different destinations
+		stages   []string                 // filter and transformation stages applied in order
+		dedup    bool                     // drop duplicate messages
+		dedupCfg internal.DedupConfig     // deduplication window
+		aggCfg   internal.AggregateConfig // aggregation of bursts into digests
+		retry    internal.RetryPolicy     // retry of the failed notifications
+		ordered  bool                     // deliver messages with the same partition key in order
+		key      string                   // JSON field used as partition key, whole line when empty
+		priority bool                     // serve high priority messages first
+		prioKey  string                   // JSON field carrying the message priority
+		starve   int                      // skips after which a waiting lower priority lane is served
+		ttl      time.Duration            // time to live of the messages, no expiry when zero
+		ttlKey   string                   // JSON field carrying the time to live of the message
+		deadLtr  string                   // file recording the expired and failed messages
+		schedule bool                     // hold the delayed messages until they are due
+		schedCfg internal.ScheduleConfig  // delayed delivery options
+		metrics  string                   // address to expose the prometheus metrics on
+		report   string                   // file to write the JSON end of run report to
+		failFast bool                     // abort the run on the first permanent failure
+		trace    string                   // span exporter, stdout or an OTLP endpoint
+		traceKey string                   // JSON field carrying the trace context to be continued
+		reload   time.Duration            // polling interval of the config and rules files, disabled when zero
+		refresh  time.Duration            // interval after which the secret references are resolved again
+		urlType  string                   // destination type of the url, e.g. slack
 	}
+	// exitCode is the process exit code set by the command run
+	exitCode int
+	// logArgs are the logger options shared by the commands
+	logArgs internal.LogConfig
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -48,20 +80,73 @@ var (
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(exitConfig)
 	}
+	os.Exit(exitCode)
 }
 
 func init() {
+	logFlags := rootCmd.PersistentFlags()
+	logFlags.StringVar(&logArgs.Level, "log-level", "info", "Log level (debug, info, warn, error)")
+	logFlags.StringVar(&logArgs.Format, "log-format", internal.LogFormatConsole, "Log format (console, json)")
+	logFlags.StringVar(&logArgs.Output, "log-output", internal.LogOutputStderr, "Log output, stderr, stdout or a file path")
+	logFlags.IntVar(&logArgs.MaxSize, "log-max-size", internal.DefaultLogMaxSize, "Size in MB after which the log file is rotated, never rotated when zero")
+	logFlags.IntVar(&logArgs.MaxBackups, "log-max-backups", internal.DefaultLogMaxBackups, "Number of rotated log files kept")
+	logFlags.IntVar(&logArgs.Sample, "log-sample", 0, "Identical log entries logged per second before sampling, no sampling when zero")
+	logFlags.IntVar(&logArgs.Thereafter, "log-sample-thereafter", 100, "Every nth identical log entry logged once sampling")
+	logFlags.StringVar(&logArgs.Redact, "log-redact", internal.RedactNone, "Redaction of the message contents in the logs (none, hash, truncate)")
+	logFlags.IntVar(&logArgs.Truncate, "log-redact-length", internal.DefaultRedactTruncate, "Characters of the message contents kept by the truncate redaction")
+
 	root := rootCmd.Flags()
-	root.StringVarP(&rootArgs.url, "url", "u", "", "URL to which notification to be sent")
+	root.StringVarP(&rootArgs.url, "url", "u", "", "URL to which notification to be sent: http(s)://, ws(s)://, sse://:port/path, file:///path.jsonl, stdout:// or exec:///command")
+	root.StringVar(&rootArgs.urlType, "url-type", internal.TypeWebhook, "Destination type of --url, webhook (raw message), slack, teams, discord or chat ({\"text\": message})")
 	root.DurationVarP(&rootArgs.interval, "interval", "i", 100*time.Millisecond, "Notification interval")
-	cobra.MarkFlagRequired(root, "url")
+	root.IntVar(&rootArgs.workers, "workers", defaultWorkers, "Number of workers sending the notifications")
+	root.StringArrayVar(&rootArgs.listen, "listen", nil, "Listen for newline delimited messages instead of stdin, unix:///path.sock or tcp://:port (repeatable)")
+	root.IntVar(&rootArgs.listener.MaxConns, "listen-max-conns", internal.DefaultListenMaxConns, "Max concurrent connections per listener")
+	root.IntVar(&rootArgs.listener.MaxLineSize, "listen-max-line", internal.DefaultListenMaxLineSize, "Max line size in bytes accepted by listeners")
+	root.IntVar(&rootArgs.listener.ConnBuffer, "listen-conn-buffer", internal.DefaultListenConnBuffer, "Lines buffered per connection before back pressure")
+	root.StringArrayVar(&rootArgs.syslog, "syslog", nil, "Receive RFC 3164/5424 syslog messages instead of stdin, udp://:port or tcp://:port (repeatable)")
+	root.StringVar(&rootArgs.severity, "syslog-severity", "debug", "Least severe syslog severity to be notified (emerg, alert, crit, err, warning, notice, info, debug)")
+	root.StringArrayVar(&rootArgs.stages, "stage", nil, "Filter or transformation stage applied before notifying, in order (repeatable): trim, drop-blank, skip-comments[:prefix], include:regex, exclude:regex, replace:regex=>text, redact:regex, project:field1,field2, max-length:n")
+	root.BoolVar(&rootArgs.dedup, "dedup", false, "Drop duplicate messages seen within the dedup window")
+	root.StringVar(&rootArgs.dedupCfg.Field, "dedup-field", "", "JSON field used as dedup key, content hash is used when empty")
+	root.DurationVar(&rootArgs.dedupCfg.Window, "dedup-window", 0, "How long a dedup key is remembered, unbounded when zero")
+	root.IntVar(&rootArgs.dedupCfg.Size, "dedup-size", 0, "Max number of dedup keys remembered (default 10000 when no dedup window)")
+	root.StringVar(&rootArgs.dedupCfg.Store, "dedup-store", "", "File to persist the dedup window across runs")
+	root.DurationVar(&rootArgs.aggCfg.Window, "aggregate-window", 0, "Group messages over the window and send one digest per group, disabled when zero")
+	root.StringVar(&rootArgs.aggCfg.Regex, "aggregate-regex", "", "Regex grouping the messages, first capture group or the whole match is the key")
+	root.StringVar(&rootArgs.aggCfg.Field, "aggregate-field", "", "JSON field grouping the messages")
+	root.IntVar(&rootArgs.aggCfg.Samples, "aggregate-samples", internal.DefaultAggregateSamples, "Number of sample messages kept per digest")
+	root.StringVar(&rootArgs.aggCfg.Template, "aggregate-template", "", "Template for the digest body (.Key, .Count, .First, .Last, .Samples), JSON digest when empty")
+	addRetryFlags(root, &rootArgs.retry)
+	root.BoolVar(&rootArgs.ordered, "ordered", false, "Deliver messages with the same partition key strictly in order on a dedicated worker lane")
+	root.StringVar(&rootArgs.key, "partition-key", "", "JSON field used as partition key in ordered mode, whole line when empty")
+	root.BoolVar(&rootArgs.priority, "priority", false, "Queue messages on high, normal and low priority lanes, high priority lanes are served first")
+	root.StringVar(&rootArgs.prioKey, "priority-field", "priority", "JSON field carrying the message priority (high, normal, low), rules priority is used when missing")
+	root.IntVar(&rootArgs.starve, "priority-starvation", internal.DefaultStarvationLimit, "Number of times a waiting lower priority lane is skipped before it is served")
+	root.DurationVar(&rootArgs.ttl, "ttl", 0, "Time to live of the messages, queued or retrying messages older than it are expired instead of sent, no expiry when zero")
+	root.StringVar(&rootArgs.ttlKey, "ttl-field", "", "JSON field carrying the time to live of the message in seconds or as duration, overrides --ttl")
+	root.StringVar(&rootArgs.deadLtr, "dead-letter", "", "File to which the expired and failed messages are appended as JSON lines")
+	root.BoolVar(&rootArgs.schedule, "schedule", false, "Hold the messages carrying a delivery time or delay until they are due, implied by --delay and --schedule-store")
+	root.DurationVar(&rootArgs.schedCfg.Delay, "delay", 0, "Delay of every message, the delivery time and delay fields take precedence")
+	root.StringVar(&rootArgs.schedCfg.DelayField, "delay-field", internal.DefaultDelayField, "JSON field carrying the delay of the message in seconds or as duration")
+	root.StringVar(&rootArgs.schedCfg.DeliverAtField, "deliver-at-field", internal.DefaultDeliverAtField, "JSON field carrying the delivery time of the message as RFC 3339 or unix seconds")
+	root.StringVar(&rootArgs.schedCfg.Store, "schedule-store", "", "File to persist the pending scheduled messages across runs")
+	root.StringVar(&rootArgs.metrics, "metrics-addr", "", "Address to expose the Prometheus metrics on /metrics, e.g. :9090, disabled when empty")
+	root.BoolVar(&rootArgs.failFast, "fail-fast", false, "Abort the run on the first message failed after all retries, the queued messages are dropped")
+	root.StringVar(&rootArgs.report, "report", "", "File to write the end of run report to as JSON, the summary is always printed")
+	root.StringVar(&rootArgs.trace, "trace", "", "Export the message and delivery attempt spans to stdout or to an OTLP/HTTP endpoint, e.g. http://localhost:4318, disabled when empty")
+	root.StringVar(&rootArgs.traceKey, "trace-field", internal.DefaultTraceField, "JSON field carrying the W3C traceparent or trace id continued by the message spans")
+	root.StringVar(&rootArgs.rules, "rules", "", "Rules file to route messages to different destinations, --url becomes the default route")
+	root.DurationVar(&rootArgs.refresh, "secret-refresh", 0, "Resolve the env:, file: and exec: secret references of the destinations again every interval, e.g. for rotating tokens, resolved once when zero")
+	root.DurationVar(&rootArgs.reload, "reload-interval", 0, "Poll the config and rules files every interval and reload the routes on change, SIGHUP always reloads, disabled when zero")
 }
 
 func runRootCmd(cmd *cobra.Command, args []string) {
 	// logger setup
-	l := loggerSetup()
+	l, closeLog := loggerSetup()
+	defer closeLog()
 
 	// init clock
 	clock := internal.NewClock()
@@ -69,113 +154,430 @@ func runRootCmd(cmd *cobra.Command, args []string) {
 		l.Info("Time taken to complete", zap.Duration("time_taken", <-clock.Since()))
 	}()
 
-	// validate url and fail early
-	if !isValidURL(rootArgs.url) {
+	// validate url and fail early, url is optional when rules file or config routes are provided
+	routed := rootArgs.rules != "" || configRoutes() != nil
+	if (!routed || rootArgs.url != "") && !isValidURL(rootArgs.url) {
 		cmd.Help()
-		os.Exit(1)
+		os.Exit(exitConfig)
+	}
+	if rootArgs.workers < 1 {
+		fatal(l, exitConfig, "invalid number of workers", zap.Int("workers", rootArgs.workers))
 	}
 
 	// producer channel
-	pChan := make(chan string, 1)
+	pChan := make(chan *internal.Message, 1)
 	// consumer channel
-	cChan := make(chan string, workerPoolSize)
+	cChan := make(chan *internal.Message, rootArgs.workers)
+
+	// metrics, also the source of the end of run report
+	metrics := internal.NewMetrics()
+	metrics.SetWorkers(rootArgs.workers)
+
+	// create http client, router sends to the destinations of the matching rules,
+	// the client is swapped on reload while the messages being sent finish on the previous one
+	client, err := newClient(l, configRoutes(), clock, metrics)
+	if err != nil {
+		fatal(l, exitConfig, "failed to setup http client", zap.Error(err))
+	}
+	if err := internal.StartClient(client); err != nil {
+		fatal(l, exitConfig, "failed to start http client", zap.Error(err))
+	}
+	httpClient := internal.NewReloadableClient(client)
+
+	// tracer, nil tracer records nothing
+	var tracer *internal.Tracer
+	if rootArgs.trace != "" {
+		exporter, err := internal.NewSpanExporter(l, rootArgs.trace, os.Stdout)
+		if err != nil {
+			fatal(l, exitConfig, "failed to setup tracing", zap.Error(err))
+		}
+		tracer = internal.NewTracer(exporter, clock)
+	}
 
-	// create http client
-	httpClient := internal.NewHttpClient(l, rootArgs.url)
+	// message envelope with the deadline, priority and span, expired and failed messages go to the dead-letter file
+	notifierCfg := internal.NotifierConfig{
+		Envelope: &internal.Envelope{TTL: rootArgs.ttl, TTLField: rootArgs.ttlKey, Clock: clock, Tracer: tracer, TraceField: rootArgs.traceKey},
+		Clock:    clock,
+		Metrics:  metrics,
+	}
+	// done channel receives the signals and the other causes of shutdown
+	doneCh := make(chan os.Signal, 1)
+	// the dedup window keeps the keys of the delivered messages and forgets the failed ones
+	var (
+		dedup    internal.DedupStage
+		notifier internal.Notifier
+	)
+	if rootArgs.dedup {
+		notifierCfg.OnSent = func(msg *internal.Message) { dedup.Delivered(msg.Body) }
+	}
+	if rootArgs.failFast || rootArgs.dedup {
+		notifierCfg.OnFailed = func(msg *internal.Message, err error) {
+			if dedup != nil {
+				dedup.Failed(msg.Body)
+			}
+			if !rootArgs.failFast {
+				return
+			}
+			notifier.Abort() // the queued messages are dropped instead of sent
+			select {
+			case doneCh <- stopFailFast:
+			default:
+			}
+		}
+	}
+	if rootArgs.priority {
+		notifierCfg.Envelope.PriorityOf = priorityOf(l, httpClient)
+	}
+	if rootArgs.deadLtr != "" {
+		deadLetter, err := internal.NewDeadLetterFile(rootArgs.deadLtr)
+		if err != nil {
+			fatal(l, exitConfig, "failed to setup dead-letter", zap.Error(err))
+		}
+		defer deadLetter.Close()
+		notifierCfg.DeadLetter = deadLetter
+	}
 
-	// create notifier
-	notifier := internal.NewNotifier(l, httpClient, rootArgs.interval, pChan, cChan)
+	// create notifier, in ordered mode every worker consumes its own lane
+	// and in priority mode the workers consume the priority lanes
+	notifier = internal.NewNotifier(l, httpClient, rootArgs.interval, pChan, cChan, notifierCfg)
+	switch {
+	case rootArgs.ordered && rootArgs.priority:
+		fatal(l, exitConfig, "ordered and priority modes can't be used together")
+	case rootArgs.ordered:
+		lanes := make([]chan *internal.Message, rootArgs.workers)
+		for i := range lanes {
+			lanes[i] = make(chan *internal.Message, 1)
+		}
+		notifier = internal.NewOrderedNotifier(l, httpClient, rootArgs.interval, pChan, lanes, rootArgs.key, notifierCfg)
+	case rootArgs.priority:
+		// lanes bounded by the workers, the input blocks while the lane of the next message is full
+		queue := internal.NewPriorityQueue(rootArgs.workers*internal.DefaultLaneCapacity, rootArgs.starve)
+		notifier = internal.NewPriorityNotifier(l, httpClient, rootArgs.interval, pChan, queue, notifierCfg)
+	}
+	queued := func() bool { return len(pChan) > 0 || notifier.Depth() > 0 }
+	metrics.QueueDepth("producer", func() int { return len(pChan) })
+	metrics.QueueDepth("consumer", notifier.Depth)
 
 	// setup cancellation context and wait group
 	// root background with cancellation support
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := new(sync.WaitGroup)
 
-	// start notifier and pass the cancellation ctx
-	go notifier.Start(ctx)
+	if rootArgs.metrics != "" {
+		go func() {
+			if err := metrics.Serve(ctx, l, rootArgs.metrics); err != nil {
+				fatal(l, exitConfig, "failed to serve metrics", zap.Error(err))
+			}
+		}()
+	}
+
+	// reload the routes on SIGHUP and config file changes
+	go (&reloader{logger: l, client: httpClient, clock: clock, metrics: metrics}).run(ctx)
+
+	// start notifier and pass the cancellation ctx, it returns once the producer channel is closed
+	// or once the messages left on the way are dropped on cancellation
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		notifier.Start(ctx)
+	}()
 
 	// start workers and add worker pool
-	wg.Add(workerPoolSize)
-	for i := 1; i <= workerPoolSize; i++ {
+	wg.Add(rootArgs.workers)
+	for i := 1; i <= rootArgs.workers; i++ {
 		go notifier.Process(wg, i)
 	}
+	// finished is closed once the workers and the whole chain are done
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		<-started
+		close(finished)
+	}()
 
-	doneCh := make(chan os.Signal, 1)
+	// input channel, the lines are wrapped as they are read, filtered and transformed by the pipeline,
+	// grouped by the aggregator and held by the scheduler until due before reaching the producer channel
+	inChan := pChan
+	var (
+		pipeline   internal.Pipeline
+		aggregator internal.Aggregator
+		scheduler  internal.Scheduler
+	)
+	if rootArgs.schedule || rootArgs.schedCfg.Delay > 0 || rootArgs.schedCfg.Store != "" {
+		var err error
+		if scheduler, err = internal.NewScheduler(l, rootArgs.schedCfg, clock); err != nil {
+			fatal(l, exitConfig, "failed to setup scheduler", zap.Error(err))
+		}
+		schedChan := make(chan *internal.Message, 1)
+		go scheduler.Run(ctx, schedChan, inChan)
+		inChan = schedChan
+		metrics.QueueDepth("scheduled", scheduler.Pending)
+	}
+	if rootArgs.aggCfg.Window > 0 {
+		var err error
+		if aggregator, err = internal.NewAggregator(l, rootArgs.aggCfg, notifierCfg.Envelope, clock); err != nil {
+			fatal(l, exitConfig, "failed to setup aggregation", zap.Error(err))
+		}
+		aggChan := make(chan *internal.Message, 1)
+		go aggregator.Run(ctx, aggChan, inChan)
+		inChan = aggChan
+	}
+	if len(rootArgs.stages) > 0 || rootArgs.dedup {
+		stages, err := internal.ParseStages(rootArgs.stages)
+		if err != nil {
+			fatal(l, exitConfig, "invalid pipeline stage", zap.Error(err))
+		}
+		if rootArgs.dedup {
+			if dedup, err = internal.NewDedupStage(l, rootArgs.dedupCfg); err != nil {
+				fatal(l, exitConfig, "failed to setup dedup", zap.Error(err))
+			}
+			stages = append(stages, dedup)
+		}
+		pipeline = internal.NewPipeline(l, stages...)
+		pipeChan := make(chan *internal.Message, 1)
+		go pipeline.Run(ctx, pipeChan, inChan)
+		inChan = pipeChan
+	}
 
-	// user input
-	go func(cancelFunc context.CancelFunc, doneCh chan os.Signal) {
-		// new buffer io scanner to get user input
-		scanner := bufio.NewScanner(os.Stdin)
-		var msg string
-		for scanner.Scan() {
-			msg = scanner.Text()
-			pChan <- msg // send in data to producer channel
-			l.Debug(msg)
-		}
-		// bufio.Scanner has max buffer size 64*1024 bytes which means
-		// in case file has any line greater than the size of 64*1024,
-		// then it will throw error
-		// Note: buffer limit can be increased by using scanner.Buffer
-		// just for the simplicity bufio.Scanner default is used
-		if err := scanner.Err(); err != nil {
-
-			l.Fatal("line length exceeded the bufio scanner max buffer size of 64*1024", zap.Error(err))
-			os.Exit(1)
-		}
-
-		<-time.Tick(time.Second * 1) // wait for all the workers to finish up
-		// once file read is completed, send quit system call
-		// exit the program
-		doneCh <- syscall.SIGQUIT
-	}(cancel, doneCh)
+	// lines read are wrapped with their read time and deadline, and counted for the metrics and the report
+	readChan := make(chan string, 1)
+	go metrics.CountRead(ctx, readChan, inChan, notifierCfg.Envelope)
+
+	// listener input, runs until interrupted
+	listeners := setupListeners(l, readChan)
+	if len(listeners) > 0 {
+		for _, listener := range listeners {
+			go func(listener internal.Listener) {
+				if err := listener.Serve(ctx); err != nil {
+					l.Error("listener stopped", zap.Error(err))
+					select {
+					case doneCh <- stopInputError:
+					default:
+					}
+				}
+			}(listener)
+		}
+	} else {
+		// user input
+		go readStdin(l, readChan, doneCh)
+	}
 
 	// handle manual interruption
 	signal.Notify(doneCh, syscall.SIGINT, syscall.SIGTERM)
 
-	switch <-doneCh { // blocks here until interrupted
+	// listeners run until interrupted, so the interruption only counts for stdin input
+	stop := <-doneCh // blocks here until interrupted
+	if stop == stopCompleted {
+		// the closed input drains the whole chain, the open digests are sent and the scheduled messages
+		// are sent before exiting unless they are persisted for the next run
+		l.Warn("file read is completed, waiting for the queued messages......")
+		if scheduler != nil && rootArgs.schedCfg.Store == "" {
+			if pending := scheduler.Pending(); pending > 0 {
+				l.Info("waiting for the scheduled messages", zap.Int("pending", pending))
+			}
+		}
+		select {
+		case <-finished:
+		case stop = <-doneCh: // interrupted or failed while draining
+		}
+	}
+	switch stop {
 	case syscall.SIGINT, syscall.SIGTERM:
 		l.Warn("CTRL-C received.Terminating......")
-	default:
-		l.Warn("file read is completed,exiting......")
+		if len(listeners) == 0 {
+			exitCode = exitInterrupted
+		}
+	case stopInputError:
+		l.Warn("input failed.Terminating......")
+		exitCode = exitInput
+	case stopFailFast:
+		l.Warn("permanent failure in fail fast mode.Terminating......")
 	}
 	signal.Stop(doneCh)
 
-	// handle shut down
+	// handle shut down, in fail fast mode the queued messages are dropped
+	if aggregator != nil && stop != stopFailFast {
+		aggregator.Flush() // send the open digests
+	}
+	if (aggregator != nil || scheduler != nil) && stop != stopFailFast {
+		drain(queued)
+	}
 	cancel() // cancel context
 	// even if cancellation received, current running job will be not be interrupted until it completes
-	wg.Wait() // wait for the workers to be completed
+	<-finished // wait for the workers to be completed and the stages to drop the messages left on the way
+	// the destinations are closed before the report, e.g. the open email digests are sent
+	if err := httpClient.Close(); err != nil {
+		l.Error("failed to close destinations", zap.Error(err))
+	}
+	if expired := notifier.Expired(); expired > 0 {
+		l.Warn("expired messages", zap.Uint64("expired", expired))
+	}
+	if err := tracer.Close(); err != nil {
+		l.Error("failed to export spans", zap.Error(err))
+	}
+
+	// end of run report, the messages left on the way were counted by the stages that dropped them
+	metrics.Dropped(notifier.Dropped())
+	if pipeline != nil {
+		metrics.Dropped(pipeline.Cancelled())
+	}
+	if aggregator != nil {
+		metrics.Dropped(aggregator.Dropped())
+	}
+	if scheduler != nil {
+		metrics.Dropped(scheduler.Dropped())
+		if rootArgs.schedCfg.Store == "" {
+			metrics.Dropped(uint64(scheduler.Pending()))
+		}
+	}
+	report := metrics.Report(<-clock.Since())
+	if pipeline != nil {
+		for _, stats := range pipeline.Stats() {
+			l.Info("pipeline stage", zap.String("stage", stats.Name), zap.Uint64("dropped", stats.Dropped))
+			report.Skipped += stats.Dropped
+		}
+	}
+	writeReport(l, cmd.ErrOrStderr(), report)
+	if exitCode == exitOK {
+		exitCode = deliveryExitCode(report)
+	}
+	if scheduler != nil {
+		if err := scheduler.Close(); err != nil {
+			l.Error("failed to close scheduler", zap.Error(err))
+		}
+	}
+	if dedup != nil {
+		if err := dedup.Close(); err != nil {
+			l.Error("failed to close dedup", zap.Error(err))
+		}
+	}
 	l.Warn("All jobs are done, shutting down")
 
 }
 
-// loggerSetup setup zap logger
-func loggerSetup() *zap.Logger {
-	if env == "prod" {
-		logger, err := zap.NewProduction()
+// writeReport prints the summary and writes the JSON report when configured
+func writeReport(l *zap.Logger, out io.Writer, report *internal.Report) {
+	if err := report.WriteText(out); err != nil {
+		l.Error("failed to print report", zap.Error(err))
+	}
+	if rootArgs.report != "" {
+		if err := report.WriteFile(rootArgs.report); err != nil {
+			l.Error("failed to write report", zap.Error(err))
+		}
+	}
+}
+
+// drain waits until the queued messages are picked up by the workers
+func drain(queued func() bool) {
+	timeout := time.After(5 * time.Second)
+	for queued() {
+		select {
+		case <-timeout:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// priorityOf returns the message priority from the priority field, or from the matching rule when routing is used
+func priorityOf(l *zap.Logger, router internal.Router) func(body string) internal.Priority {
+	return func(body string) internal.Priority {
+		if v, ok := internal.Field(body, rootArgs.prioKey); ok {
+			priority, err := internal.ParsePriority(v)
+			if err == nil {
+				return priority
+			}
+			l.Warn("invalid message priority", zap.Error(err))
+		}
+		if router != nil {
+			return router.Route(body).Priority
+		}
+		return internal.PriorityNormal
+	}
+}
+
+// setupListeners creates the network listeners configured via flags, exits on invalid configuration
+func setupListeners(l *zap.Logger, pChan chan string) []internal.Listener {
+	var listeners []internal.Listener
+	for _, addr := range rootArgs.listen {
+		listener, err := internal.NewListener(l, addr, rootArgs.listener, pChan)
+		if err != nil {
+			fatal(l, exitConfig, "failed to create listener", zap.Error(err))
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(rootArgs.syslog) == 0 {
+		return listeners
+	}
+	severity, err := internal.ParseSyslogSeverity(rootArgs.severity)
+	if err != nil {
+		fatal(l, exitConfig, "invalid syslog severity", zap.Error(err))
+	}
+	for _, addr := range rootArgs.syslog {
+		listener, err := internal.NewSyslogListener(l, addr, internal.SyslogConfig{ListenerConfig: rootArgs.listener, MaxSeverity: severity}, pChan)
 		if err != nil {
-			log.Fatalf("failed to create zap logger : %v", err)
-		}
-		logger.Info("logger setup done")
-		return logger
-	}
-
-	// setup dev logger to show different colors
-	cfg := zap.NewDevelopmentEncoderConfig()
-	cfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	log := zap.New(zapcore.NewCore(
-		zapcore.NewConsoleEncoder(cfg),
-		zapcore.AddSync(colorable.NewColorableStdout()),
-		zapcore.InfoLevel,
-	))
-	log.Info("logger setup done")
-	return log
+			fatal(l, exitConfig, "failed to create syslog listener", zap.Error(err))
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// addRetryFlags adds the retry policy flags
+func addRetryFlags(flags *pflag.FlagSet, retry *internal.RetryPolicy) {
+	flags.IntVar(&retry.Attempts, "retries", 0, "Number of retries of a failed notification (network errors, 5xx and 429), the chat url types retry 3 times when zero, -1 disables the retries")
+	flags.DurationVar(&retry.Backoff, "retry-backoff", internal.DefaultRetryBackoff, "Wait before the first retry, doubled for every next retry")
+	flags.DurationVar(&retry.MaxBackoff, "retry-max-backoff", internal.DefaultRetryMaxBackoff, "Max wait between retries")
+	flags.DurationVar(&retry.MaxWait, "retry-max-wait", internal.DefaultRetryMaxWait, "Max wait asked by the receiver with Retry-After before retrying, longer waits are cut short")
+}
+
+// readStdin reads the user input line by line, closes the channel and sends quit signal once the input is completed
+func readStdin(l *zap.Logger, pChan chan string, doneCh chan os.Signal) {
+	// new buffer io scanner to get user input
+	scanner := bufio.NewScanner(os.Stdin)
+	var msg string
+	for scanner.Scan() {
+		msg = scanner.Text()
+		pChan <- msg // send in data to producer channel
+		l.Debug("read line", zap.String("msg", msg))
+	}
+	// bufio.Scanner has max buffer size 64*1024 bytes which means
+	// in case file has any line greater than the size of 64*1024,
+	// then it will throw error
+	// Note: buffer limit can be increased by using scanner.Buffer
+	// just for the simplicity bufio.Scanner default is used
+	if err := scanner.Err(); err != nil {
+
+		l.Error("line length exceeded the bufio scanner max buffer size of 64*1024", zap.Error(err))
+		doneCh <- stopInputError
+		return
+	}
+
+	// once file read is completed, the closed channel drains the messages left on the way and quit is sent
+	close(pChan)
+	doneCh <- stopCompleted
+}
+
+// loggerSetup setup zap logger from the log flags, exits on invalid options
+func loggerSetup() (*zap.Logger, func() error) {
+	logger, closeLog, err := internal.NewLogger(logArgs)
+	if err != nil {
+		log.Printf("failed to create zap logger : %v", err)
+		os.Exit(exitConfig)
+	}
+	logger.Debug("logger setup done")
+	return logger, closeLog
 }
 
 func isValidURL(URL string) bool {
-	if rootArgs.url == "" {
+	if URL == "" {
 		fmt.Println("Error: url field is empty")
 		return false
 	}
+	// secret references are resolved and checked once the client is created
+	if internal.IsSecretRef(URL) {
+		return true
+	}
 
 	// parse url if valid
 	_, err := url.ParseRequestURI(URL)
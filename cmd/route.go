@@ -0,0 +1,100 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go-notifier/internal"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	routeCmd = &cobra.Command{
+		Use:   "route",
+		Short: "routing rules helpers",
+	}
+	routeTestCmd = &cobra.Command{
+		Use:   "test [sample line]",
+		Short: "show which rule a sample line hits",
+		Long:  `show which rules and destinations a sample line hits, sample lines are read from stdin when not passed as argument`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runRouteTestCmd,
+	}
+	routeArgs struct {
+		rules string // rules file
+		url   string // default route url
+	}
+)
+
+func init() {
+	flags := routeTestCmd.Flags()
+	flags.StringVar(&routeArgs.rules, "rules", "", "Rules file to be tested, the routes of the config file are tested when empty")
+	flags.StringVarP(&routeArgs.url, "url", "u", "", "URL of the default route")
+	routeCmd.AddCommand(routeTestCmd)
+	rootCmd.AddCommand(routeCmd)
+}
+
+func runRouteTestCmd(cmd *cobra.Command, args []string) error {
+	if routeArgs.rules == "" && configRoutes() == nil {
+		return errors.New("no rules file given and no routes in the config file")
+	}
+	router, err := newRouter(zap.NewNop(), routeArgs.rules, configRoutes(), routeArgs.url, internal.RetryPolicy{}, nil)
+	if err != nil {
+		return err
+	}
+	if closer, ok := router.(io.Closer); ok {
+		defer closer.Close()
+	}
+	out := cmd.OutOrStdout()
+	if len(args) == 1 {
+		printRoute(out, args[0], router.Route(args[0]))
+		return nil
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		printRoute(out, scanner.Text(), router.Route(scanner.Text()))
+	}
+	return scanner.Err()
+}
+
+func printRoute(out io.Writer, line string, route internal.Route) {
+	rules := "(default route)"
+	if len(route.Rules) > 0 {
+		rules = strings.Join(route.Rules, ", ")
+	}
+	destinations := "(none, message is dropped)"
+	if len(route.Destinations) > 0 {
+		destinations = strings.Join(route.Destinations, ", ")
+	}
+	fmt.Fprintf(out, "line:         %s\nrules:        %s\ndestinations: %s\n", line, rules, destinations)
+}
+
+// newRouter loads the rules file, or uses the routes of the config file when empty, and creates the router,
+// retry is used when the routes have no retry policy
+func newRouter(l *zap.Logger, rulesFile string, cfg *internal.RoutesConfig, defaultURL string, retry internal.RetryPolicy, metrics *internal.Metrics) (internal.Router, error) {
+	if rulesFile != "" || cfg == nil {
+		var err error
+		if cfg, err = internal.LoadRoutes(rulesFile); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Metrics = metrics
+	if cfg.Retry == (internal.RetryPolicy{}) {
+		cfg.Retry = retry
+	}
+	if cfg.Refresh == 0 {
+		cfg.Refresh = rootArgs.refresh
+	}
+	cfg.DefaultType = rootArgs.urlType
+	return internal.NewRouter(l, cfg, defaultURL)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+package cmd
+
+import (
+	"context"
+	"go-notifier/internal"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	scheduleCmd = &cobra.Command{
+		Use:   "schedule",
+		Short: "send recurring notifications on cron schedules",
+		Long: `send the message bodies of the jobs file on their cron schedules until interrupted, e.g. heartbeats to a monitor.
+Runs missed while the notifier was down are detected from the state file and sent per the missed policy (skip, once or all)`,
+		Args: cobra.NoArgs,
+		RunE: runScheduleCmd,
+	}
+	scheduleArgs struct {
+		jobs   string               // jobs file
+		url    string               // default destination url
+		state  string               // state file
+		missed string               // missed runs policy
+		retry  internal.RetryPolicy // retry of the failed notifications
+	}
+)
+
+func init() {
+	flags := scheduleCmd.Flags()
+	flags.StringVar(&scheduleArgs.jobs, "jobs", "", "Jobs file with the cron schedules and the message bodies")
+	flags.StringVarP(&scheduleArgs.url, "url", "u", "", "URL of the default destination")
+	flags.StringVar(&scheduleArgs.state, "state", "", "File recording the last run of every job, overrides the jobs file state")
+	flags.StringVar(&scheduleArgs.missed, "missed", "", "Policy for the runs missed during downtime (skip, once, all), overrides the jobs file policy")
+	addRetryFlags(flags, &scheduleArgs.retry)
+	cobra.MarkFlagRequired(flags, "jobs")
+	rootCmd.AddCommand(scheduleCmd)
+}
+
+func runScheduleCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := internal.LoadCron(scheduleArgs.jobs)
+	if err != nil {
+		return err
+	}
+	if scheduleArgs.state != "" {
+		cfg.State = scheduleArgs.state
+	}
+	if scheduleArgs.missed != "" {
+		cfg.Missed = scheduleArgs.missed
+	}
+	if cfg.Retry == (internal.RetryPolicy{}) {
+		cfg.Retry = scheduleArgs.retry
+	}
+	l, closeLog := loggerSetup()
+	defer closeLog()
+	cron, err := internal.NewCron(l, cfg, scheduleArgs.url, internal.NewClock())
+	if err != nil {
+		return err
+	}
+
+	// run until interrupted, the notifications in flight are completed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cron.Run(ctx)
+	l.Warn("All jobs are done, shutting down", zap.Int("jobs", len(cfg.Jobs)))
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultAggregateSamples = 3 // default number of sample messages kept per digest
+
+// AggregateConfig holds the aggregation options
+type AggregateConfig struct {
+	Regex    string        // regex grouping the messages, first capture group or the whole match is the key
+	Field    string        // dotted JSON field grouping the messages
+	Window   time.Duration // window after the first message of a group at which the digest is sent
+	Samples  int           // number of sample messages kept per digest
+	Template string        // text/template for the digest body, JSON digest is sent when empty
+}
+
+// Digest summarises the messages of a group received within the window
+type Digest struct {
+	Key     string    `json:"key"`
+	Count   int       `json:"count"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Samples []string  `json:"samples"`
+}
+
+// Aggregator is the interface that groups the Run, Flush and Dropped methods
+type Aggregator interface {
+	Run(ctx context.Context, in <-chan *Message, out chan<- *Message)
+	Flush()
+	Dropped() uint64
+}
+
+// aggregator type
+type aggregator struct {
+	logger  *zap.Logger        // logger
+	cfg     AggregateConfig    // options
+	regex   *regexp.Regexp     // key regex, nil when grouped by field
+	tmpl    *Template          // digest template, nil for JSON digest
+	env     *Envelope          // stamps the digests as they are sent, plain message when nil
+	groups  map[string]*Digest // open groups by key
+	flushCh chan chan struct{} // flush requests
+	done    chan struct{}      // closed when Run returns
+	dropped uint64             // messages dropped on cancellation
+	clock   Clock              // window time source
+}
+
+// NewAggregator constructor, the digests are wrapped in the envelope as new messages, real clock when nil
+func NewAggregator(logger *zap.Logger, cfg AggregateConfig, envelope *Envelope, clock Clock) (Aggregator, error) {
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("aggregate window should be positive")
+	}
+	if cfg.Samples <= 0 {
+		cfg.Samples = DefaultAggregateSamples
+	}
+	a := &aggregator{
+		logger:  logger,
+		cfg:     cfg,
+		env:     envelope,
+		groups:  map[string]*Digest{},
+		flushCh: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		clock:   orClock(clock),
+	}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregate regex: %w", err)
+		}
+		a.regex = re
+	}
+	if cfg.Template != "" {
+		tmpl, err := NewTemplate("aggregate", cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		a.tmpl = tmpl
+	}
+	return a, nil
+}
+
+// tick returns the interval at which the expired groups are checked
+func (a *aggregator) tick() time.Duration {
+	if tick := a.cfg.Window / 10; tick > 10*time.Millisecond {
+		return tick
+	}
+	return 10 * time.Millisecond
+}
+
+// Run groups the messages received from in and sends the digest of each group to out at the end of its window,
+// the open groups are flushed when in is closed and dropped on cancellation, out is closed once it returns
+func (a *aggregator) Run(ctx context.Context, in <-chan *Message, out chan<- *Message) {
+	defer close(out)
+	defer close(a.done)
+	ticker := a.clock.NewTicker(a.tick())
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				a.flush(ctx, out, true)
+				return
+			}
+			a.add(msg.Body)
+		case <-ticker.C():
+			a.flush(ctx, out, false)
+		case done := <-a.flushCh:
+			a.flush(ctx, out, true)
+			close(done)
+		case <-ctx.Done():
+			if len(a.groups) > 0 {
+				a.logger.Warn("dropping open aggregate groups", zap.Int("groups", len(a.groups)))
+			}
+			for _, group := range a.groups {
+				a.drop(group)
+			}
+			atomic.AddUint64(&a.dropped, discard(in))
+			return
+		}
+	}
+}
+
+// Dropped returns the number of messages dropped on cancellation, the messages of the open groups included
+func (a *aggregator) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (a *aggregator) drop(group *Digest) {
+	atomic.AddUint64(&a.dropped, uint64(group.Count))
+}
+
+// Flush sends the digest of every open group without waiting for the end of the window
+func (a *aggregator) Flush() {
+	done := make(chan struct{})
+	select {
+	case a.flushCh <- done:
+		<-done
+	case <-a.done:
+	}
+}
+
+// key returns the group key of the message
+func (a *aggregator) key(msg string) string {
+	if a.regex != nil {
+		match := a.regex.FindStringSubmatch(msg)
+		switch {
+		case len(match) > 1:
+			return match[1]
+		case len(match) == 1:
+			return match[0]
+		}
+		return ""
+	}
+	v, _ := Field(msg, a.cfg.Field)
+	return v
+}
+
+func (a *aggregator) add(msg string) {
+	key := a.key(msg)
+	now := a.clock.Now()
+	group, ok := a.groups[key]
+	if !ok {
+		group = &Digest{Key: key, First: now}
+		a.groups[key] = group
+	}
+	group.Count++
+	group.Last = now
+	if len(group.Samples) < a.cfg.Samples {
+		group.Samples = append(group.Samples, msg)
+	}
+}
+
+// flush sends the digests of the groups whose window ended, or all the groups when all is set
+func (a *aggregator) flush(ctx context.Context, out chan<- *Message, all bool) {
+	now := a.clock.Now()
+	var due []*Digest
+	for key, group := range a.groups {
+		if all || now.Sub(group.First) >= a.cfg.Window {
+			due = append(due, group)
+			delete(a.groups, key)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].First.Equal(due[j].First) {
+			return due[i].Key < due[j].Key
+		}
+		return due[i].First.Before(due[j].First)
+	})
+	for i, digest := range due {
+		body, err := a.render(digest)
+		if err != nil {
+			a.logger.Error("failed to render digest", zap.String("key", digest.Key), zap.Error(err))
+			continue
+		}
+		a.logger.Debug("sending digest", zap.String("key", digest.Key), zap.Int("count", digest.Count))
+		select {
+		case out <- a.env.Wrap(body):
+		case <-ctx.Done():
+			for _, group := range due[i:] {
+				a.drop(group)
+			}
+			return
+		}
+	}
+}
+
+func (a *aggregator) render(digest *Digest) (string, error) {
+	if a.tmpl != nil {
+		return a.tmpl.Execute(digest)
+	}
+	b, err := json.Marshal(digest)
+	return string(b), err
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_aggregator_Run(t *testing.T) {
+	tests := map[string]struct {
+		cfg   AggregateConfig
+		input []string
+		want  []Digest
+	}{
+		"Should group messages by regex capture": {
+			cfg:   AggregateConfig{Regex: `host=(\w+)`, Samples: 2},
+			input: []string{"cpu high host=a", "cpu high host=b", "disk full host=a", "mem high host=a"},
+			want: []Digest{
+				{Key: "a", Count: 3, Samples: []string{"cpu high host=a", "disk full host=a"}},
+				{Key: "b", Count: 1, Samples: []string{"cpu high host=b"}},
+			},
+		},
+		"Should group messages by json field": {
+			cfg:   AggregateConfig{Field: "service"},
+			input: []string{`{"service":"db"}`, `{"service":"db"}`, "plain"},
+			want: []Digest{
+				{Key: "", Count: 1, Samples: []string{"plain"}},
+				{Key: "db", Count: 2, Samples: []string{`{"service":"db"}`, `{"service":"db"}`}},
+			},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testCase.cfg.Window = time.Hour
+			// the groups opened at the same time are sent by key
+			a, err := NewAggregator(zap.NewNop(), testCase.cfg, nil, NewFakeClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)))
+			assert.NoError(t, err)
+
+			in := make(chan *Message)
+			out := make(chan *Message, len(testCase.want))
+			go func() {
+				for _, msg := range testCase.input {
+					in <- NewMessage(msg)
+				}
+				close(in) // flushes the open groups
+			}()
+			a.Run(context.Background(), in, out)
+
+			var got []Digest
+			for msg := range out {
+				var digest Digest
+				assert.NoError(t, json.Unmarshal([]byte(msg.Body), &digest))
+				assert.False(t, digest.Last.Before(digest.First))
+				digest.First, digest.Last = time.Time{}, time.Time{}
+				got = append(got, digest)
+			}
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func Test_aggregator_Window(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	agg, err := NewAggregator(zap.NewNop(), AggregateConfig{
+		Regex:    `^(\w+)`,
+		Window:   time.Minute,
+		Template: `{{.Key}}: {{.Count}} messages, first sample "{{index .Samples 0}}"`,
+	}, &Envelope{TTL: time.Minute, Clock: clock}, clock)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *Message)
+	out := make(chan *Message)
+	go agg.Run(ctx, in, out)
+
+	for _, msg := range []string{"error one", "error two", "error three"} {
+		in <- NewMessage(msg)
+	}
+	// the group is sent at the end of its window only
+	clock.Advance(30 * time.Second)
+	select {
+	case digest := <-out:
+		t.Fatalf("digest %q sent before the end of the window", digest.Body)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(30 * time.Second)
+	digest := <-out
+	assert.Equal(t, `error: 3 messages, first sample "error one"`, digest.Body)
+	// the digest is a new message
+	assert.Equal(t, start.Add(time.Minute), digest.Enqueued)
+	assert.Equal(t, start.Add(2*time.Minute), digest.Deadline)
+
+	// flush sends the open group before the end of the window
+	in <- NewMessage("warn one")
+	go agg.Flush()
+	assert.Equal(t, `warn: 1 messages, first sample "warn one"`, (<-out).Body)
+}
+
+func Test_aggregator_Dropped(t *testing.T) {
+	agg, err := NewAggregator(zap.NewNop(), AggregateConfig{Regex: `^(\w+)`, Window: time.Hour}, nil, NewFakeClock(time.Now()))
+	assert.NoError(t, err)
+	in := make(chan *Message, 3)
+	for _, msg := range []string{"a 1", "a 2", "b 1"} {
+		in <- NewMessage(msg)
+	}
+	close(in)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// nobody receives from out, the open groups and the messages left on the way are dropped
+	agg.Run(ctx, in, make(chan *Message))
+	assert.Equal(t, uint64(3), agg.Dropped())
+}
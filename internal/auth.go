@@ -0,0 +1,227 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	AuthBearer = "bearer" // token sent in the Authorization header
+	AuthHMAC   = "hmac"   // body signed with HMAC-SHA256, the signature is sent in the signature header
+	AuthOAuth2 = "oauth2" // token of the OAuth2 client credentials grant sent in the Authorization header
+
+	DefaultSignatureHeader = "X-Signature" // default header of the HMAC signature
+)
+
+// Auth is the authentication of the requests of a destination, the token, the secret and the client secret
+// are plain values or secret references, e.g. env:TOKEN or file:/run/secrets/token
+type Auth struct {
+	Type         string       `yaml:"type"`                    // bearer, hmac or oauth2
+	Token        string       `yaml:"token,omitempty"`         // bearer token
+	Secret       string       `yaml:"secret,omitempty"`        // HMAC key
+	Header       string       `yaml:"header,omitempty"`        // header of the HMAC signature, X-Signature when empty
+	TokenURL     string       `yaml:"token_url,omitempty"`     // OAuth2 token endpoint
+	ClientID     string       `yaml:"client_id,omitempty"`     // OAuth2 client id
+	ClientSecret string       `yaml:"client_secret,omitempty"` // OAuth2 client secret
+	Scopes       []string     `yaml:"scopes,omitempty"`        // OAuth2 scopes requested
+	credential   *Secret      // resolved token or key, the plain value is used when nil
+	tokens       *tokenSource // OAuth2 token cache, set once resolved
+}
+
+// Validate checks the auth type and its credentials
+func (a Auth) Validate() error {
+	switch a.Type {
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("%s auth without token", a.Type)
+		}
+	case AuthHMAC:
+		if a.Secret == "" {
+			return fmt.Errorf("%s auth without secret", a.Type)
+		}
+	case AuthOAuth2:
+		if _, err := url.ParseRequestURI(a.TokenURL); err != nil {
+			return fmt.Errorf("%s auth: invalid token url: %w", a.Type, err)
+		}
+		if a.ClientID == "" || a.ClientSecret == "" {
+			return fmt.Errorf("%s auth without client id or client secret", a.Type)
+		}
+	default:
+		return fmt.Errorf("invalid auth type %q, should be %s, %s or %s", a.Type, AuthBearer, AuthHMAC, AuthOAuth2)
+	}
+	return nil
+}
+
+// Resolve validates the auth and resolves its token or key, resolved again every refresh interval when set
+func (a *Auth) Resolve(refresh time.Duration, clock Clock) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	ref := a.Token
+	switch a.Type {
+	case AuthHMAC:
+		ref = a.Secret
+	case AuthOAuth2:
+		ref = a.ClientSecret
+	}
+	credential, err := NewSecret(ref, refresh, clock)
+	if err != nil {
+		return err
+	}
+	a.credential = credential
+	if a.Type == AuthOAuth2 {
+		a.tokens = newTokenSource(a.TokenURL, a.ClientID, credential, a.Scopes, clock)
+	}
+	return nil
+}
+
+// Masked returns a copy of the auth with the credentials masked
+func (a Auth) Masked() Auth {
+	a.Token = MaskSecret(a.Token)
+	a.Secret = MaskSecret(a.Secret)
+	a.ClientSecret = MaskSecret(a.ClientSecret)
+	return a
+}
+
+// Apply authenticates the request of the body, an error wrapping ErrStaleSecret is returned
+// once the request is authenticated with the last credential, any other error fails the request
+func (a Auth) Apply(req *http.Request, body string) error {
+	credential, err := a.Token, error(nil)
+	if a.Type == AuthHMAC {
+		credential = a.Secret
+	}
+	if a.credential != nil {
+		credential, err = a.credential.Value()
+	}
+	switch a.Type {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+credential)
+	case AuthOAuth2:
+		if a.tokens == nil {
+			return fmt.Errorf("%s auth is not resolved", a.Type)
+		}
+		token, err := a.tokens.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case AuthHMAC:
+		header := a.Header
+		if header == "" {
+			header = DefaultSignatureHeader
+		}
+		req.Header.Set(header, Sign(credential, body))
+	}
+	return err
+}
+
+// Refreshable reports whether a rejected request is retried once with a fresh token
+func (a *Auth) Refreshable() bool {
+	return a != nil && a.tokens != nil
+}
+
+// Invalidate drops the cached token of the rejected request so that the next request fetches a new one
+func (a *Auth) Invalidate(req *http.Request) {
+	if a.Refreshable() {
+		a.tokens.Invalidate(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	}
+}
+
+// Close stops the refresh of the resolved credential
+func (a *Auth) Close() error {
+	if a.credential != nil {
+		return a.credential.Close()
+	}
+	return nil
+}
+
+// Sign returns the HMAC-SHA256 signature of the body as sha256=<hex>
+func Sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestHeaders are the additional headers and the authentication of the requests of a destination,
+// shared by the http requests and the WebSocket handshakes
+type requestHeaders struct {
+	logger  *zap.Logger        // logger
+	headers map[string]*Secret // additional headers, values can be secret references
+	auth    *Auth              // authentication, none when nil
+}
+
+// newRequestHeaders resolves the secret references of the headers and of the authentication of the destination,
+// resolved again every refresh interval when set
+func newRequestHeaders(logger *zap.Logger, dest Destination, clock Clock) (*requestHeaders, error) {
+	h := &requestHeaders{logger: logger, headers: map[string]*Secret{}}
+	for k, v := range dest.Headers {
+		secret, err := NewSecret(v, dest.Refresh, clock)
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("header %s: %w", k, err)
+		}
+		h.headers[k] = secret
+	}
+	if dest.Auth != nil {
+		auth := *dest.Auth // resolved on a copy so that the config is kept as it is
+		if err := auth.Resolve(dest.Refresh, clock); err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.auth = &auth
+	}
+	return h, nil
+}
+
+// setDefault sets the header unless the destination has it
+func (h *requestHeaders) setDefault(key, value string) {
+	if _, ok := h.headers[key]; !ok {
+		h.headers[key], _ = NewSecret(value, 0, nil)
+	}
+}
+
+// apply sets the headers and the authentication of the request of the body,
+// the last value of a secret failing to refresh is used
+func (h *requestHeaders) apply(req *http.Request, body string) error {
+	for k, secret := range h.headers {
+		v, err := secret.Value()
+		if err != nil {
+			h.logger.Warn("failed to refresh secret, using the last value", zap.String("header", k), zap.Error(err))
+		}
+		req.Header.Set(k, v)
+	}
+	if h.auth != nil {
+		if err := h.auth.Apply(req, body); errors.Is(err, ErrStaleSecret) {
+			h.logger.Warn("failed to refresh secret, using the last value", zap.String("auth", h.auth.Type), zap.Error(err))
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the refresh of the secrets of the headers and of the authentication
+func (h *requestHeaders) Close() error {
+	for _, secret := range h.headers {
+		secret.Close()
+	}
+	if h.auth != nil {
+		h.auth.Close()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Destination types, the chat types format the message into the incoming webhook schema of the service
+// and email sends the message by SMTP
+const (
+	TypeWebhook = "webhook" // raw message or rendered template, the default
+	TypeSlack   = "slack"   // Slack incoming webhook
+	TypeTeams   = "teams"   // Microsoft Teams incoming webhook
+	TypeDiscord = "discord" // Discord webhook
+	TypeChat    = "chat"    // generic chat webhook taking {"text": "..."}, e.g. Mattermost or Rocket.Chat
+	TypeEmail   = "email"   // email sent with SMTP
+)
+
+// chatRetries is the number of retries of the chat destinations without retries, the services answer 429 with
+// the wait before retrying in Retry-After once their rate limit is exceeded, e.g. by other senders of the same webhook,
+// like every retry policy they also retry the network errors and the 5xx responses
+const chatRetries = 3
+
+// chatPreset is the payload, the length limit, the rate limit and the retries of a chat service
+type chatPreset struct {
+	maxLength int     // max characters of a message, longer messages are split
+	rate      float64 // notifications per second allowed by the service
+	burst     int     // burst allowed by the service
+	retries   int     // retries when the destination has none
+	payload   func(text string) interface{}
+}
+
+var chatPresets = map[string]chatPreset{
+	TypeSlack: {
+		maxLength: 40000,
+		rate:      1,
+		burst:     1,
+		retries:   chatRetries,
+		payload:   func(text string) interface{} { return map[string]string{"text": text} },
+	},
+	TypeTeams: {
+		maxLength: 20000,
+		rate:      4,
+		burst:     4,
+		retries:   chatRetries,
+		payload: func(text string) interface{} {
+			return map[string]string{"@type": "MessageCard", "@context": "https://schema.org/extensions", "text": text}
+		},
+	},
+	TypeDiscord: {
+		maxLength: 2000,
+		rate:      2.5,
+		burst:     5,
+		retries:   chatRetries,
+		payload:   func(text string) interface{} { return map[string]string{"content": text} },
+	},
+	TypeChat: {
+		retries: chatRetries,
+		payload: func(text string) interface{} { return map[string]string{"text": text} },
+	},
+}
+
+// checkType checks the destination type
+func checkType(kind string) error {
+	if kind == "" || kind == TypeWebhook || kind == TypeEmail {
+		return nil
+	}
+	if _, ok := chatPresets[kind]; !ok {
+		return fmt.Errorf("invalid type %q, should be %s, %s, %s, %s, %s or %s", kind, TypeWebhook, TypeSlack, TypeTeams, TypeDiscord, TypeChat, TypeEmail)
+	}
+	return nil
+}
+
+// body returns the webhook payload of the text
+func (p chatPreset) body(text string) (string, error) {
+	b, err := json.Marshal(p.payload(text))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// SplitMessage splits the text into parts of at most max characters, at the last line break
+// or space of a part when there is one, the whole text is returned when max is not positive
+func SplitMessage(text string, max int) []string {
+	if max <= 0 || utf8.RuneCountInString(text) <= max {
+		return []string{text}
+	}
+	var parts []string
+	runes := []rune(text)
+	for len(runes) > max {
+		cut := lastIndexFunc(runes[:max+1], func(r rune) bool { return r == '\n' })
+		if cut <= 0 {
+			cut = lastIndexFunc(runes[:max+1], unicode.IsSpace)
+		}
+		if cut <= 0 {
+			parts = append(parts, string(runes[:max]))
+			runes = runes[max:]
+			continue
+		}
+		// the separator is dropped
+		parts = append(parts, strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace))
+		runes = runes[cut+1:]
+	}
+	if len(runes) > 0 {
+		parts = append(parts, string(runes))
+	}
+	return parts
+}
+
+func lastIndexFunc(runes []rune, f func(rune) bool) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if f(runes[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseRetryAfter returns the wait of the Retry-After header in seconds or as http date,
+// or of the retry_after field of a JSON body in seconds as sent by Discord, zero when there is none
+func parseRetryAfter(header string, body []byte, now time.Time) time.Duration {
+	if header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if at, err := http.ParseTime(header); err == nil && at.After(now) {
+			return at.Sub(now)
+		}
+	}
+	var fields struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if len(body) > 0 && json.Unmarshal(body, &fields) == nil && fields.RetryAfter > 0 {
+		return time.Duration(fields.RetryAfter * float64(time.Second))
+	}
+	return 0
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_SplitMessage(t *testing.T) {
+	tests := map[string]struct {
+		text string
+		max  int
+		want []string
+	}{
+		"Should keep a short message": {
+			text: "disk full",
+			max:  20,
+			want: []string{"disk full"},
+		},
+		"Should not split without max": {
+			text: "disk full",
+			want: []string{"disk full"},
+		},
+		"Should split at line breaks": {
+			text: "line one\nline two\nline three",
+			max:  18,
+			want: []string{"line one\nline two", "line three"},
+		},
+		"Should split at spaces": {
+			text: "disk full on db-1",
+			max:  10,
+			want: []string{"disk full", "on db-1"},
+		},
+		"Should cut a long word": {
+			text: "abcdefghij",
+			max:  4,
+			want: []string{"abcd", "efgh", "ij"},
+		},
+		"Should count characters": {
+			text: "ééééé",
+			max:  2,
+			want: []string{"éé", "éé", "é"},
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, testCase.want, SplitMessage(testCase.text, testCase.max))
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		header string
+		body   string
+		want   time.Duration
+	}{
+		"Should parse seconds":            {header: "2", want: 2 * time.Second},
+		"Should parse the http date":      {header: "Wed, 01 Jun 2022 10:00:05 GMT", want: 5 * time.Second},
+		"Should parse the discord body":   {body: `{"message":"You are being rate limited.","retry_after":1.5}`, want: 1500 * time.Millisecond},
+		"Should prefer the header":        {header: "3", body: `{"retry_after":1.5}`, want: 3 * time.Second},
+		"Should ignore an invalid header": {header: "soon"},
+		"Should ignore a past date":       {header: "Wed, 01 Jun 2022 09:00:00 GMT"},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, testCase.want, parseRetryAfter(testCase.header, []byte(testCase.body), now))
+		})
+	}
+}
+
+// chatServer records the bodies posted to it
+type chatServer struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (s *chatServer) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func Test_ChatPresets(t *testing.T) {
+	tests := map[string]struct {
+		dest Destination
+		msg  string
+		want []string
+	}{
+		"Should send the slack text": {
+			dest: Destination{Type: TypeSlack},
+			msg:  `disk "full"`,
+			want: []string{`{"text":"disk \"full\""}`},
+		},
+		"Should send the teams message card": {
+			dest: Destination{Type: TypeTeams},
+			msg:  "disk full",
+			want: []string{`{"@context":"https://schema.org/extensions","@type":"MessageCard","text":"disk full"}`},
+		},
+		"Should send the discord content": {
+			dest: Destination{Type: TypeDiscord},
+			msg:  "disk full",
+			want: []string{`{"content":"disk full"}`},
+		},
+		"Should send the generic chat text of the template": {
+			dest: Destination{Type: TypeChat, Template: `{{field . "host"}}: {{field . "msg"}}`},
+			msg:  `{"host":"db-1","msg":"disk full"}`,
+			want: []string{`{"text":"db-1: disk full"}`},
+		},
+		"Should split the long message": {
+			dest: Destination{Type: TypeDiscord, MaxLength: 10},
+			msg:  "disk full on db-1",
+			want: []string{`{"content":"disk full"}`, `{"content":"on db-1"}`},
+		},
+		"Should split at the discord limit": {
+			dest: Destination{Type: TypeDiscord},
+			msg:  strings.Repeat("a", 2001),
+			want: []string{`{"content":"` + strings.Repeat("a", 2000) + `"}`, `{"content":"a"}`},
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			chat := &chatServer{}
+			srv := httptest.NewServer(chat.handler(t))
+			defer srv.Close()
+
+			dest := testCase.dest
+			dest.Name, dest.URL = "chat", srv.URL
+			client, err := NewDestinationClient(zap.NewNop(), dest)
+			assert.NoError(t, err)
+			assert.NoError(t, client.Notify(NewMessage(testCase.msg)))
+			assert.Equal(t, testCase.want, chat.bodies)
+		})
+	}
+
+	_, err := NewDestinationClient(zap.NewNop(), Destination{Name: "chat", URL: "http://localhost", Type: "irc"})
+	assert.EqualError(t, err, `destination chat: invalid type "irc", should be webhook, slack, teams, discord, chat or email`)
+}
+
+func Test_Chat_RateLimited(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		body   string
+		wait   time.Duration
+		retry  RetryPolicy
+	}{
+		"Should wait for the Retry-After header": {
+			header: "2",
+			wait:   2 * time.Second,
+			retry:  RetryPolicy{Attempts: 1, Backoff: 10 * time.Millisecond},
+		},
+		"Should wait for the discord retry_after": {
+			body:  `{"retry_after":1.5}`,
+			wait:  1500 * time.Millisecond,
+			retry: RetryPolicy{Attempts: 1, Backoff: 10 * time.Millisecond},
+		},
+		"Should retry without retries configured": {
+			header: "2",
+			wait:   2 * time.Second,
+		},
+		"Should cap the Retry-After wait at max wait": {
+			header: "3600",
+			wait:   DefaultRetryMaxWait,
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) == 1 {
+					if testCase.header != "" {
+						w.Header().Set("Retry-After", testCase.header)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					io.WriteString(w, testCase.body)
+				}
+			}))
+			defer srv.Close()
+
+			clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+			retry := testCase.retry
+			client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "chat", URL: srv.URL, Type: TypeDiscord, Retry: &retry, Clock: clock})
+			assert.NoError(t, err)
+			done := make(chan error)
+			go func() { done <- client.Notify(NewMessage("disk full")) }()
+
+			waitBlocked(clock)
+			clock.Advance(testCase.wait - time.Millisecond)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+			clock.Advance(time.Millisecond)
+			assert.NoError(t, <-done)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+		})
+	}
+}
+
+func Test_Chat_RateLimited_Abort(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "chat", URL: srv.URL, Type: TypeSlack, Clock: clock})
+	assert.NoError(t, err)
+	abort := make(chan struct{})
+	msg := NewMessage("disk full")
+	msg.Abort = abort
+	done := make(chan error)
+	go func() { done <- client.Notify(msg) }()
+
+	// the wait before retrying is cut short once the run is aborted
+	waitBlocked(clock)
+	close(abort)
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrAborted)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the retry wait was not interrupted")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func Test_Chat_RetriesDisabled(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	retry := RetryPolicy{Attempts: -1}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "chat", URL: srv.URL, Type: TypeSlack, Retry: &retry})
+	assert.NoError(t, err)
+	assert.Equal(t, &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, client.Notify(NewMessage("disk full")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
@@ -1,9 +1,31 @@
 package internal
 
-import "time"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
+// Clock is the source of the current time and the timers, so that timing can be faked in tests
 type Clock interface {
 	Since() <-chan time.Duration
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the interface of time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the interface of time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
 }
 
 type clock time.Time
@@ -16,3 +38,159 @@ func (c clock) Since() <-chan time.Duration {
 	durChan <- time.Since(time.Time(c))
 	return durChan
 }
+
+func (c clock) Now() time.Time { return time.Now() }
+
+func (c clock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (c clock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (c clock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// orClock returns the clock, or the real clock when nil
+func orClock(c Clock) Clock {
+	if c == nil {
+		return NewClock()
+	}
+	return c
+}
+
+// FakeClock is a manual clock for tests, time only moves on Advance
+type FakeClock struct {
+	mu     sync.Mutex
+	start  time.Time
+	now    time.Time
+	timers []*fakeTimer // active timers and tickers
+}
+
+// fakeTimer is a timer or, with a period, a ticker of the fake clock
+type fakeTimer struct {
+	clock  *FakeClock
+	at     time.Time     // next fire time
+	period time.Duration // ticker period, zero for timers
+	ch     chan time.Time
+}
+
+// NewFakeClock constructor, the clock starts at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{start: now, now: now}
+}
+
+func (c *FakeClock) Since() <-chan time.Duration {
+	durChan := make(chan time.Duration, 1)
+	durChan <- c.Now().Sub(c.start)
+	return durChan
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns the channel receiving the time once the clock is advanced by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer returns the timer firing once the clock is advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// NewTicker returns the ticker firing every time the clock is advanced by d
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: c, period: d, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.at = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	return fakeTicker{t}
+}
+
+// Advance moves the clock forward and fires the timers and tickers due in between in order,
+// like time.Ticker a tick is dropped when the previous one was not received yet
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.at
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			continue
+		}
+		c.timers = c.timers[1:]
+	}
+	c.now = end
+}
+
+// Waiters returns the number of active timers and tickers, so that tests can wait until the code under test blocks
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// remove deactivates the timer, reports whether it was active
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+// fakeTicker is the ticker view of the fake timer
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.remove(t)
+	if d <= 0 {
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		return active
+	}
+	t.at = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	return active
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fired reports whether the channel received a tick
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitBlocked waits until the code under test waits on a timer of the clock
+func waitBlocked(clock *FakeClock) {
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_FakeClock(t *testing.T) {
+	start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	after := clock.After(time.Minute)
+	timer := clock.NewTimer(2 * time.Minute)
+	stopped := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(30 * time.Second)
+	assert.Equal(t, 4, clock.Waiters())
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, start.Add(59*time.Second), clock.Now())
+	assert.False(t, fired(after))
+	assert.True(t, fired(ticker.C()))
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-after)
+	assert.False(t, fired(timer.C()))
+	assert.False(t, fired(stopped.C()))
+	// the second tick at 1m is received, ticks are not queued
+	assert.True(t, fired(ticker.C()))
+	assert.False(t, fired(ticker.C()))
+
+	// reset moves the timer from 2m to 1m30s
+	assert.True(t, timer.Reset(30*time.Second))
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(90*time.Second), <-timer.C())
+	assert.True(t, fired(ticker.C()))
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	assert.False(t, fired(ticker.C()))
+	assert.Equal(t, 0, clock.Waiters())
+	assert.Equal(t, time.Hour+90*time.Second, <-clock.Since())
+
+	// non positive durations fire at once
+	assert.Equal(t, clock.Now(), <-clock.After(0))
+}
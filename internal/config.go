@@ -0,0 +1,248 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigEnvPrefix = "NOTIFIER_" // prefix of the environment variables overriding the settings
+	DefaultConfig   = "notifier.yaml"
+	secretMask      = "******"
+)
+
+// Config is the configuration file, settings are the flag values by flag name (e.g. interval: 1s, stage: [trim])
+// and the routes use the rules file format, profiles override both when selected
+type Config struct {
+	Settings map[string]interface{} `yaml:",inline"`            // flag values by flag name
+	Routes   *RoutesConfig          `yaml:"routes,omitempty"`   // destinations and rules, replaces the rules file
+	Profiles map[string]*Config     `yaml:"profiles,omitempty"` // named overrides, e.g. staging or prod
+}
+
+// ConfigPaths returns the default config file search path in order
+func ConfigPaths() []string {
+	paths := []string{DefaultConfig}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "notifier", "config.yaml"))
+	}
+	return append(paths, filepath.Join("/etc", "notifier", "config.yaml"))
+}
+
+// FindConfig returns the first existing file of the default search path, empty when there is none
+func FindConfig() string {
+	for _, path := range ConfigPaths() {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads the config file
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg := new(Config)
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	for name, profile := range cfg.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("config file %s: empty profile %s", path, name)
+		}
+		if len(profile.Profiles) > 0 {
+			return nil, fmt.Errorf("config file %s: profile %s can't have profiles", path, name)
+		}
+	}
+	return cfg, nil
+}
+
+// Profile returns the config merged with the named profile, the config itself when name is empty,
+// profile settings replace the settings, destinations replace the same named ones and rules replace all the rules
+func (c *Config) Profile(name string) (*Config, error) {
+	merged := &Config{Settings: map[string]interface{}{}}
+	for k, v := range c.Settings {
+		merged.Settings[k] = v
+	}
+	if c.Routes != nil {
+		routes := *c.Routes
+		merged.Routes = &routes
+	}
+	if name == "" {
+		return merged, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, should be one of %s", name, strings.Join(c.profileNames(), ", "))
+	}
+	for k, v := range profile.Settings {
+		merged.Settings[k] = v
+	}
+	if profile.Routes == nil {
+		return merged, nil
+	}
+	if merged.Routes == nil {
+		routes := *profile.Routes
+		merged.Routes = &routes
+		return merged, nil
+	}
+	routes := merged.Routes
+	if profile.Routes.Mode != "" {
+		routes.Mode = profile.Routes.Mode
+	}
+	if len(profile.Routes.Default) > 0 {
+		routes.Default = profile.Routes.Default
+	}
+	if len(profile.Routes.Rules) > 0 {
+		routes.Rules = profile.Routes.Rules
+	}
+	if profile.Routes.Retry != (RetryPolicy{}) {
+		routes.Retry = profile.Routes.Retry
+	}
+	if profile.Routes.Refresh != 0 {
+		routes.Refresh = profile.Routes.Refresh
+	}
+	dests := append([]Destination(nil), routes.Destinations...)
+	for _, dest := range profile.Routes.Destinations {
+		replaced := false
+		for i := range dests {
+			if dests[i].Name == dest.Name {
+				dests[i], replaced = dest, true
+			}
+		}
+		if !replaced {
+			dests = append(dests, dest)
+		}
+	}
+	routes.Destinations = dests
+	return merged, nil
+}
+
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SettingValues returns the values of the setting as flag values, lists give one value per element
+func SettingValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			switch elem.(type) {
+			case nil, []interface{}, map[string]interface{}:
+				return nil, errors.New("list elements should be scalars")
+			}
+			values = append(values, fmt.Sprint(elem))
+		}
+		return values, nil
+	case map[string]interface{}:
+		return nil, errors.New("maps are not supported")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// SettingEnv returns the environment variable overriding the setting, e.g. NOTIFIER_LOG_LEVEL for log-level
+func SettingEnv(name string) string {
+	return ConfigEnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// IsSecretName reports whether the setting, header or field name holds a secret
+func IsSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"token", "secret", "password", "authorization", "api-key", "api_key", "apikey", "cookie"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskSecret masks the non empty secret, secret references are kept as they don't hold the secret
+func MaskSecret(s string) string {
+	if s == "" || IsSecretRef(s) {
+		return s
+	}
+	return secretMask
+}
+
+// MaskURL masks the password and the secret query values of the url of the destination type, and the path of the
+// chat webhooks which holds their token, secret references are kept
+func MaskURL(s, kind string) string {
+	if IsSecretRef(s) {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name := strings.SplitN(param, "=", 2)[0]
+			if unescaped, err := url.QueryUnescape(name); err == nil && IsSecretName(unescaped) {
+				params[i] = name + "=" + secretMask
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	if _, chat := chatPresets[kind]; chat && strings.Trim(u.Path, "/") != "" {
+		u.Path, u.RawPath = "/"+secretMask, "/"+secretMask
+	}
+	return u.Redacted()
+}
+
+// Masked returns a copy of the routes with the secrets of the destinations masked
+func (c *RoutesConfig) Masked() *RoutesConfig {
+	if c == nil {
+		return nil
+	}
+	masked := *c
+	masked.Destinations = make([]Destination, len(c.Destinations))
+	for i, dest := range c.Destinations {
+		dest.URL = MaskURL(dest.URL, dest.Type)
+		if len(dest.Headers) > 0 {
+			headers := make(map[string]string, len(dest.Headers))
+			for k, v := range dest.Headers {
+				if IsSecretName(k) {
+					v = MaskSecret(v)
+				}
+				headers[k] = v
+			}
+			dest.Headers = headers
+		}
+		if dest.Auth != nil {
+			auth := dest.Auth.Masked()
+			dest.Auth = &auth
+		}
+		if dest.Email != nil {
+			email := *dest.Email
+			email.Password = MaskSecret(email.Password)
+			dest.Email = &email
+		}
+		masked.Destinations[i] = dest
+	}
+	return &masked
+}
@@ -0,0 +1,437 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	MissedSkip = "skip" // runs missed during downtime are skipped
+	MissedOnce = "once" // a single notification is sent for the runs missed during downtime
+	MissedAll  = "all"  // every run missed during downtime is sent, up to maxMissedRuns
+
+	maxMissedRuns = 100 // max number of missed runs sent per job with the all policy
+)
+
+// CronConfig is the jobs file of the schedule command
+type CronConfig struct {
+	Timezone     string        `yaml:"timezone"`     // time zone of the cron expressions, local time when empty
+	Missed       string        `yaml:"missed"`       // policy for the runs missed during downtime, skip, once or all, defaults to skip
+	State        string        `yaml:"state"`        // file recording the last run of every job, missed runs are not detected when empty
+	Destinations []Destination `yaml:"destinations"` // named destinations
+	Retry        RetryPolicy   `yaml:"retry"`        // retry of the destinations without their own retry policy
+	Jobs         []CronJob     `yaml:"jobs"`         // recurring notifications
+}
+
+// CronJob sends the body to the destinations on the cron schedule
+type CronJob struct {
+	Name         string   `yaml:"name"`         // job name shown in logs and used as state key
+	Schedule     string   `yaml:"schedule"`     // cron expression, e.g. */5 * * * * or @hourly
+	Body         string   `yaml:"body"`         // message sent on every run
+	Destinations []string `yaml:"destinations"` // destinations of the message, default destination when empty
+	Missed       string   `yaml:"missed"`       // missed runs policy of the job, overrides the file policy
+}
+
+// Cron is the interface that wraps the Run method
+// Run sends the notifications of the jobs on schedule until the context is cancelled
+type Cron interface {
+	Run(ctx context.Context)
+}
+
+// cronJob is a job with its parsed schedule
+type cronJob struct {
+	CronJob
+	schedule *CronSchedule
+	next     time.Time // next run
+}
+
+// cron type
+type cron struct {
+	mu           sync.Mutex
+	logger       *zap.Logger           // logger
+	clock        Clock                 // current time and timers
+	loc          *time.Location        // time zone of the cron expressions
+	jobs         []*cronJob            // jobs
+	destinations map[string]HttpClient // http clients by destination name
+	state        string                // state file
+	last         map[string]time.Time  // last run by job name
+	wg           sync.WaitGroup        // notifications in flight
+}
+
+// LoadCron reads the jobs file
+func LoadCron(path string) (*CronConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jobs file: %w", err)
+	}
+	cfg := new(CronConfig)
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse jobs file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// NewCron constructor, defaultURL is added as the default destination when not empty
+func NewCron(logger *zap.Logger, cfg *CronConfig, defaultURL string, clock Clock) (Cron, error) {
+	c := &cron{
+		logger: logger,
+		clock:  clock,
+		loc:    time.Local,
+		state:  cfg.State,
+		last:   map[string]time.Time{},
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+		c.loc = loc
+	}
+	dests := cfg.Destinations
+	if defaultURL != "" {
+		dests = append([]Destination{{Name: DefaultDestination, URL: defaultURL}}, dests...)
+	}
+	var err error
+	if c.destinations, err = newDestinationClients(logger, dests, cfg.Retry, 0, clock, nil); err != nil {
+		return nil, err
+	}
+	if len(cfg.Jobs) == 0 {
+		return nil, errors.New("no jobs configured")
+	}
+	for i, job := range cfg.Jobs {
+		if job.Name == "" {
+			job.Name = "job-" + strconv.Itoa(i+1)
+		}
+		if job.Missed == "" {
+			job.Missed = cfg.Missed
+		}
+		switch job.Missed {
+		case "":
+			job.Missed = MissedSkip
+		case MissedSkip, MissedOnce, MissedAll:
+		default:
+			return nil, fmt.Errorf("job %s: invalid missed policy %q, should be %s, %s or %s", job.Name, job.Missed, MissedSkip, MissedOnce, MissedAll)
+		}
+		if len(job.Destinations) == 0 {
+			job.Destinations = []string{DefaultDestination}
+		}
+		for _, dest := range job.Destinations {
+			if _, ok := c.destinations[dest]; !ok {
+				return nil, fmt.Errorf("job %s: unknown destination %s", job.Name, dest)
+			}
+		}
+		schedule, err := ParseCron(job.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", job.Name, err)
+		}
+		c.jobs = append(c.jobs, &cronJob{CronJob: job, schedule: schedule})
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Run sends the runs missed since the last recorded run per the missed policy,
+// then sends the notification of every job when due
+func (c *cron) Run(ctx context.Context) {
+	defer c.wg.Wait()
+	now := c.clock.Now().In(c.loc)
+	for _, job := range c.jobs {
+		c.catchUp(job, now)
+		job.next = job.schedule.Next(now)
+		c.logger.Info("job scheduled", zap.String("job", job.Name), zap.Time("next", job.next))
+	}
+	for {
+		next := c.next()
+		if next.IsZero() {
+			c.logger.Warn("no more runs scheduled")
+			return
+		}
+		select {
+		case <-c.clock.After(next.Sub(now)):
+		case <-ctx.Done():
+			return
+		}
+		now = c.clock.Now().In(c.loc)
+		for _, job := range c.jobs {
+			if !job.next.IsZero() && !job.next.After(now) {
+				c.fire(job, job.next)
+				job.next = job.schedule.Next(now)
+			}
+		}
+	}
+}
+
+// next returns the earliest next run of the jobs
+func (c *cron) next() time.Time {
+	var next time.Time
+	for _, job := range c.jobs {
+		if !job.next.IsZero() && (next.IsZero() || job.next.Before(next)) {
+			next = job.next
+		}
+	}
+	return next
+}
+
+// catchUp sends the runs missed since the last recorded run of the job
+func (c *cron) catchUp(job *cronJob, now time.Time) {
+	last, ok := c.last[job.Name]
+	if !ok || job.Missed == MissedSkip {
+		return
+	}
+	var missed []time.Time
+	for t := job.schedule.Next(last.In(c.loc)); !t.IsZero() && !t.After(now); t = job.schedule.Next(t) {
+		missed = append(missed, t)
+		if job.Missed == MissedAll && len(missed) == maxMissedRuns {
+			break
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+	c.logger.Warn("missed runs", zap.String("job", job.Name), zap.Int("missed", len(missed)), zap.String("policy", job.Missed))
+	if job.Missed == MissedOnce {
+		missed = missed[len(missed)-1:]
+	}
+	for _, at := range missed {
+		c.fire(job, at)
+	}
+}
+
+// fire sends the job notification of the run to every destination of the job
+func (c *cron) fire(job *cronJob, at time.Time) {
+	c.logger.Debug("running job", zap.String("job", job.Name), zap.Time("run", at))
+	c.mu.Lock()
+	c.last[job.Name] = at
+	if err := c.save(); err != nil {
+		c.logger.Error("failed to save the job state", zap.Error(err))
+	}
+	c.mu.Unlock()
+	for _, dest := range job.Destinations {
+		c.wg.Add(1)
+		go func(client HttpClient) {
+			defer c.wg.Done()
+			if err := client.Notify(NewMessage(job.Body)); err != nil {
+				c.logger.Warn("job notification failed", zap.String("job", job.Name), zap.Error(err))
+			}
+		}(c.destinations[dest])
+	}
+}
+
+// save writes the last runs to the state file
+func (c *cron) save() error {
+	if c.state == "" {
+		return nil
+	}
+	b, err := json.Marshal(c.last)
+	if err != nil {
+		return err
+	}
+	// write to temp file and rename, so that the state is never partially written
+	tmp := c.state + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.state)
+}
+
+// load restores the last runs from the state file
+func (c *cron) load() error {
+	if c.state == "" {
+		return nil
+	}
+	b, err := os.ReadFile(c.state)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read job state: %w", err)
+	}
+	if err := json.Unmarshal(b, &c.last); err != nil {
+		return fmt.Errorf("failed to parse job state %s: %w", c.state, err)
+	}
+	return nil
+}
+
+// CronSchedule is a parsed cron expression
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64        // allowed values as bit sets
+	domAny, dowAny                bool          // day of month or day of week is unrestricted
+	every                         time.Duration // fixed interval of @every
+}
+
+// cronField is the range and the names of a cron expression field
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMonths = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	cronDays   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+	cronFields = []cronField{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: cronMonths},
+		{name: "day of week", min: 0, max: 7, names: cronDays},
+	}
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// ParseCron parses the standard five field cron expression (minute hour day-of-month month day-of-week),
+// the @yearly, @monthly, @weekly, @daily, @hourly descriptors and @every <duration>
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("invalid cron expression %q, @every needs a duration of at least 1s", expr)
+		}
+		return &CronSchedule{every: every}, nil
+	}
+	if spec, ok := cronDescriptors[expr]; ok {
+		expr = spec
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q, should have 5 fields", expr)
+	}
+	var bits [5]uint64
+	for i, part := range parts {
+		b, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		bits[i] = b
+	}
+	// sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &CronSchedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseCronField parses the comma separated list of values, ranges and steps, e.g. 1,15-20,*/5
+func parseCronField(s string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid %s step %q", field.name, item)
+			}
+			rng = item[:i]
+		}
+		lo, hi := field.min, field.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = cronValue(bounds[0], field); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(bounds[1], field); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if lo, err = cronValue(rng, field); err != nil {
+				return 0, err
+			}
+			// a single value is a range only with a step, e.g. 5/15
+			if step == 1 {
+				hi = lo
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("invalid %s range %q", field.name, item)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, field cronField) (int, error) {
+	if v, ok := field.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < field.min || v > field.max {
+		return 0, fmt.Errorf("invalid %s %q, should be between %d and %d", field.name, s, field.min, field.max)
+	}
+	return v, nil
+}
+
+// Next returns the first run after the given time in its location, zero when there is no run within 5 years
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	if s.every > 0 {
+		return after.Add(s.every)
+	}
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatch(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatch checks the day of month and the day of week, either of them matches when both are restricted
+func (s *CronSchedule) dayMatch(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
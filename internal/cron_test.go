@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_CronSchedule_Next(t *testing.T) {
+	from := time.Date(2022, 6, 1, 10, 7, 30, 0, time.UTC) // wednesday
+	tests := map[string]struct {
+		expr string
+		want time.Time
+	}{
+		"Should run every minute": {
+			expr: "* * * * *",
+			want: time.Date(2022, 6, 1, 10, 8, 0, 0, time.UTC),
+		},
+		"Should run on the step": {
+			expr: "*/5 * * * *",
+			want: time.Date(2022, 6, 1, 10, 10, 0, 0, time.UTC),
+		},
+		"Should run on the list and range": {
+			expr: "0,30 9-11 * * *",
+			want: time.Date(2022, 6, 1, 10, 30, 0, 0, time.UTC),
+		},
+		"Should roll over to the next day": {
+			expr: "15 8 * * *",
+			want: time.Date(2022, 6, 2, 8, 15, 0, 0, time.UTC),
+		},
+		"Should run on the named week day": {
+			expr: "0 9 * * mon-fri",
+			want: time.Date(2022, 6, 2, 9, 0, 0, 0, time.UTC),
+		},
+		"Should treat 7 as sunday": {
+			expr: "0 0 * * 7",
+			want: time.Date(2022, 6, 5, 0, 0, 0, 0, time.UTC),
+		},
+		"Should match either day when both days are restricted": {
+			expr: "0 0 15 * sat",
+			want: time.Date(2022, 6, 4, 0, 0, 0, 0, time.UTC),
+		},
+		"Should run on the named month": {
+			expr: "0 0 1 jan *",
+			want: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"Should run on the descriptor": {
+			expr: "@hourly",
+			want: time.Date(2022, 6, 1, 11, 0, 0, 0, time.UTC),
+		},
+		"Should run on the fixed interval": {
+			expr: "@every 90s",
+			want: time.Date(2022, 6, 1, 10, 9, 0, 0, time.UTC),
+		},
+		"Should not run on a day which never comes": {
+			expr: "0 0 30 feb *",
+			want: time.Time{},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			s, err := ParseCron(testCase.expr)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, s.Next(from))
+		})
+	}
+}
+
+func Test_ParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@every 1ms", "@weekdays"} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := ParseCron(expr)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// cronServer returns the test server recording the request bodies
+func cronServer(t *testing.T) (*httptest.Server, chan string) {
+	received := make(chan string, 200)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- r.URL.Path + " " + string(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func Test_cron_Run(t *testing.T) {
+	srv, received := cronServer(t)
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 7, 0, 0, time.UTC))
+	c, err := NewCron(zap.NewNop(), &CronConfig{
+		Timezone:     "UTC",
+		Destinations: []Destination{{Name: "monitor", URL: srv.URL + "/monitor"}},
+		Jobs: []CronJob{
+			{Name: "heartbeat", Schedule: "*/5 * * * *", Body: "alive"},
+			{Name: "report", Schedule: "0 11 * * *", Body: "daily", Destinations: []string{"monitor", DefaultDestination}},
+		},
+	}, srv.URL+"/default", clock)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+
+	waitBlocked(clock)
+	clock.Advance(2 * time.Minute) // 10:09
+	waitBlocked(clock)
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected notification %s", msg)
+	default:
+	}
+	clock.Advance(time.Minute) // 10:10
+	assert.Equal(t, "/default alive", <-received)
+
+	for i := 0; i < 10; i++ { // 11:00
+		waitBlocked(clock)
+		clock.Advance(5 * time.Minute)
+	}
+	got := map[string]int{}
+	for i := 0; i < 12; i++ {
+		got[<-received]++
+	}
+	assert.Equal(t, map[string]int{"/default alive": 10, "/monitor daily": 1, "/default daily": 1}, got)
+
+	waitBlocked(clock)
+	cancel()
+	<-done
+}
+
+func Test_cron_Missed(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 7, 0, 0, time.UTC)
+	tests := map[string]struct {
+		missed string
+		want   int
+	}{
+		"Should skip the missed runs":            {missed: MissedSkip, want: 0},
+		"Should send the missed runs once":       {missed: MissedOnce, want: 1},
+		"Should send every missed run":           {missed: MissedAll, want: 6},
+		"Should skip the missed runs by default": {missed: "", want: 0},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			srv, received := cronServer(t)
+			state := filepath.Join(t.TempDir(), "state.json")
+			// last run half an hour ago
+			b, _ := json.Marshal(map[string]time.Time{"heartbeat": now.Add(-30 * time.Minute)})
+			assert.NoError(t, os.WriteFile(state, b, 0o600))
+
+			clock := NewFakeClock(now)
+			c, err := NewCron(zap.NewNop(), &CronConfig{
+				Timezone: "UTC",
+				Missed:   testCase.missed,
+				State:    state,
+				Jobs:     []CronJob{{Name: "heartbeat", Schedule: "*/5 * * * *", Body: "alive"}},
+			}, srv.URL, clock)
+			assert.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				c.Run(ctx)
+			}()
+			waitBlocked(clock)
+			cancel()
+			<-done
+			assert.Equal(t, testCase.want, len(received))
+
+			// last run is recorded in the state file
+			var last map[string]time.Time
+			b, _ = os.ReadFile(state)
+			assert.NoError(t, json.Unmarshal(b, &last))
+			want := now.Add(-30 * time.Minute)
+			if testCase.want > 0 {
+				want = time.Date(2022, 6, 1, 10, 5, 0, 0, time.UTC)
+			}
+			assert.True(t, want.Equal(last["heartbeat"]))
+		})
+	}
+}
+
+func Test_NewCron_Invalid(t *testing.T) {
+	tests := map[string]*CronConfig{
+		"Should fail without jobs": {},
+		"Should fail when schedule is invalid": {
+			Jobs: []CronJob{{Name: "j", Schedule: "* *"}},
+		},
+		"Should fail when job refers unknown destination": {
+			Jobs: []CronJob{{Name: "j", Schedule: "@hourly", Destinations: []string{"missing"}}},
+		},
+		"Should fail when missed policy is invalid": {
+			Missed: "sometimes",
+			Jobs:   []CronJob{{Name: "j", Schedule: "@hourly"}},
+		},
+		"Should fail when timezone is invalid": {
+			Timezone: "Mars/Olympus",
+			Jobs:     []CronJob{{Name: "j", Schedule: "@hourly"}},
+		},
+	}
+	for testName, cfg := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := NewCron(zap.NewNop(), cfg, "http://localhost", NewFakeClock(time.Now()))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DeadLetterExpired = "expired" // message deadline passed before it was delivered
+	DeadLetterFailed  = "failed"  // message could not be delivered
+	DeadLetterPartial = "partial" // message could not be delivered to some of its destinations
+)
+
+// DeadLetter is the interface that groups the Write and Close methods
+// Write records the message that could not be delivered along with the reason
+type DeadLetter interface {
+	Write(msg *Message, reason string, cause error) error
+	Close() error
+}
+
+// deadLetterRecord is a line of the dead-letter file
+type deadLetterRecord struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+	Priority string    `json:"priority"`
+	Enqueued time.Time `json:"enqueued"`
+	Message  string    `json:"message"`
+}
+
+// deadLetterFile type appends the records as JSON lines
+type deadLetterFile struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewDeadLetterFile constructor, records are appended to the file
+func NewDeadLetterFile(path string) (DeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	return &deadLetterFile{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends the record of the message
+func (d *deadLetterFile) Write(msg *Message, reason string, cause error) error {
+	record := deadLetterRecord{
+		Time:     time.Now(),
+		Reason:   reason,
+		Priority: msg.Priority.String(),
+		Enqueued: msg.Enqueued,
+		Message:  msg.Body,
+	}
+	if cause != nil {
+		record.Error = cause.Error()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enc.Encode(record)
+}
+
+// Close closes the file
+func (d *deadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,211 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultDedupSize = 10000 // default number of keys remembered when no window is configured
+
+// DedupConfig holds the deduplication options
+type DedupConfig struct {
+	Field  string        // dotted JSON field used as key, content hash is used when empty or missing
+	Window time.Duration // how long a key is remembered, unbounded when zero
+	Size   int           // max number of keys remembered, the oldest key is evicted first
+	Store  string        // file to persist the window across runs, in memory only when empty
+}
+
+// DedupStage is the pipeline stage dropping the messages seen within the window,
+// the key of a message is persisted once it is delivered and forgotten when its delivery failed
+type DedupStage interface {
+	Stage
+	Delivered(msg string)
+	Failed(msg string)
+	Suppressed() uint64
+	Close() error
+}
+
+// dedupEntry is a remembered key
+type dedupEntry struct {
+	Key       string    `json:"key"`
+	Seen      time.Time `json:"seen"`
+	delivered bool      // persisted only once delivered, the restored keys were delivered
+}
+
+// dedupStage type
+type dedupStage struct {
+	mu         sync.Mutex
+	logger     *zap.Logger              // logger
+	cfg        DedupConfig              // options
+	keys       map[string]*list.Element // remembered keys
+	order      *list.List               // keys in the order they were first seen
+	suppressed uint64                   // number of duplicates dropped
+	now        func() time.Time         // current time
+}
+
+// NewDedupStage constructor, the persisted window is loaded from the store when configured
+func NewDedupStage(logger *zap.Logger, cfg DedupConfig) (DedupStage, error) {
+	if cfg.Window <= 0 && cfg.Size <= 0 {
+		cfg.Size = DefaultDedupSize
+	}
+	d := &dedupStage{
+		logger: logger,
+		cfg:    cfg,
+		keys:   map[string]*list.Element{},
+		order:  list.New(),
+		now:    time.Now,
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dedupStage) Name() string { return "dedup" }
+
+// Apply drops the message when its key was already seen within the window
+func (d *dedupStage) Apply(msg string) (string, bool) {
+	key := d.key(msg)
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(now)
+	if _, ok := d.keys[key]; ok {
+		d.suppressed++
+		d.logger.Debug("duplicate message suppressed", zap.String("key", key))
+		return "", false
+	}
+	d.keys[key] = d.order.PushBack(&dedupEntry{Key: key, Seen: now})
+	if d.cfg.Size > 0 && d.order.Len() > d.cfg.Size {
+		d.remove(d.order.Front())
+	}
+	return msg, true
+}
+
+// Delivered marks the key of the delivered message to be persisted
+func (d *dedupStage) Delivered(msg string) {
+	key := d.key(msg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.keys[key]; ok {
+		e.Value.(*dedupEntry).delivered = true
+	}
+}
+
+// Failed forgets the key of the message whose delivery failed, so that it is not suppressed when sent again
+func (d *dedupStage) Failed(msg string) {
+	key := d.key(msg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.keys[key]; ok && !e.Value.(*dedupEntry).delivered {
+		d.remove(e)
+	}
+}
+
+// key returns the configured field value or the content hash of the message
+func (d *dedupStage) key(msg string) string {
+	if d.cfg.Field != "" {
+		if v, ok := Field(msg, d.cfg.Field); ok {
+			return d.cfg.Field + "=" + v
+		}
+	}
+	sum := sha256.Sum256([]byte(msg))
+	return hex.EncodeToString(sum[:16])
+}
+
+// evict removes the keys older than the window
+func (d *dedupStage) evict(now time.Time) {
+	if d.cfg.Window <= 0 {
+		return
+	}
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(*dedupEntry).Seen) >= d.cfg.Window; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+func (d *dedupStage) remove(e *list.Element) {
+	delete(d.keys, e.Value.(*dedupEntry).Key)
+	d.order.Remove(e)
+}
+
+// Suppressed returns the number of duplicates dropped
+func (d *dedupStage) Suppressed() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.suppressed
+}
+
+// Close persists the delivered keys of the window to the store and logs the number of suppressed duplicates
+func (d *dedupStage) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logger.Info("duplicate messages suppressed", zap.Uint64("suppressed", d.suppressed))
+	if d.cfg.Store == "" {
+		return nil
+	}
+	d.evict(d.now())
+	entries := make([]*dedupEntry, 0, d.order.Len())
+	for e := d.order.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*dedupEntry); entry.delivered {
+			entries = append(entries, entry)
+		}
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// write to temp file and rename, so that the store is never partially written
+	tmp := d.cfg.Store + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to persist dedup window: %w", err)
+	}
+	return os.Rename(tmp, d.cfg.Store)
+}
+
+// load restores the persisted window
+func (d *dedupStage) load() error {
+	if d.cfg.Store == "" {
+		return nil
+	}
+	b, err := os.ReadFile(d.cfg.Store)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dedup store: %w", err)
+	}
+	var entries []*dedupEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("failed to parse dedup store %s: %w", d.cfg.Store, err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Seen.Before(entries[j].Seen) })
+	for _, entry := range entries {
+		entry.delivered = true
+		if _, ok := d.keys[entry.Key]; !ok {
+			d.keys[entry.Key] = d.order.PushBack(entry)
+		}
+	}
+	for d.cfg.Size > 0 && d.order.Len() > d.cfg.Size {
+		d.remove(d.order.Front())
+	}
+	d.evict(d.now())
+	d.logger.Debug("dedup window restored", zap.Int("keys", d.order.Len()))
+	return nil
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_dedupStage_Apply(t *testing.T) {
+	type input struct {
+		msg     string
+		elapsed time.Duration // time elapsed before the message arrives
+	}
+	tests := map[string]struct {
+		cfg            DedupConfig
+		input          []input
+		want           []string
+		wantSuppressed uint64
+	}{
+		"Should suppress duplicates by content hash": {
+			input:          []input{{msg: "a"}, {msg: "b"}, {msg: "a"}, {msg: "a"}},
+			want:           []string{"a", "b"},
+			wantSuppressed: 2,
+		},
+		"Should suppress duplicates by json field": {
+			cfg:            DedupConfig{Field: "id"},
+			input:          []input{{msg: `{"id":1,"v":"x"}`}, {msg: `{"id":1,"v":"y"}`}, {msg: `{"id":2}`}, {msg: "no json"}},
+			want:           []string{`{"id":1,"v":"x"}`, `{"id":2}`, "no json"},
+			wantSuppressed: 1,
+		},
+		"Should forget keys older than the time window": {
+			cfg:            DedupConfig{Window: time.Minute},
+			input:          []input{{msg: "a"}, {msg: "a", elapsed: 30 * time.Second}, {msg: "a", elapsed: 31 * time.Second}},
+			want:           []string{"a", "a"},
+			wantSuppressed: 1,
+		},
+		"Should forget the oldest keys above the count window": {
+			cfg:            DedupConfig{Size: 2},
+			input:          []input{{msg: "a"}, {msg: "b"}, {msg: "c"}, {msg: "a"}, {msg: "c"}},
+			want:           []string{"a", "b", "c", "a"},
+			wantSuppressed: 1,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			stage, err := NewDedupStage(zap.NewNop(), testCase.cfg)
+			assert.NoError(t, err)
+			d := stage.(*dedupStage)
+			now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+			d.now = func() time.Time { return now }
+
+			var got []string
+			for _, in := range testCase.input {
+				now = now.Add(in.elapsed)
+				if msg, ok := d.Apply(in.msg); ok {
+					got = append(got, msg)
+				}
+			}
+			assert.Equal(t, testCase.want, got)
+			assert.Equal(t, testCase.wantSuppressed, d.Suppressed())
+		})
+	}
+}
+
+func Test_dedupStage_Store(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "dedup.json")
+	first, err := NewDedupStage(zap.NewNop(), DedupConfig{Window: time.Hour, Store: store})
+	assert.NoError(t, err)
+	_, ok := first.Apply("a")
+	assert.True(t, ok)
+	first.Delivered("a")
+	assert.NoError(t, first.Close())
+
+	// resumed run remembers the persisted window
+	second, err := NewDedupStage(zap.NewNop(), DedupConfig{Window: time.Hour, Store: store})
+	assert.NoError(t, err)
+	_, ok = second.Apply("a")
+	assert.False(t, ok)
+	_, ok = second.Apply("b")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), second.Suppressed())
+}
+
+func Test_dedupStage_Delivery(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "dedup.json")
+	first, err := NewDedupStage(zap.NewNop(), DedupConfig{Window: time.Hour, Store: store})
+	assert.NoError(t, err)
+	for _, msg := range []string{"sent", "failed", "queued"} {
+		_, ok := first.Apply(msg)
+		assert.True(t, ok)
+	}
+	first.Delivered("sent")
+	first.Failed("failed")
+
+	// the failed message is sent again when it is seen again
+	_, ok := first.Apply("failed")
+	assert.True(t, ok)
+	first.Failed("failed")
+	assert.NoError(t, first.Close())
+
+	// only the delivered keys are persisted
+	second, err := NewDedupStage(zap.NewNop(), DedupConfig{Window: time.Hour, Store: store})
+	assert.NoError(t, err)
+	for msg, want := range map[string]bool{"sent": false, "failed": true, "queued": true} {
+		_, ok := second.Apply(msg)
+		assert.Equal(t, want, ok, msg)
+	}
+}
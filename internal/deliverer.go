@@ -0,0 +1,98 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// deliverer runs the delivery attempts of a destination with its rate limit, retry policy, spans and metrics
+type deliverer struct {
+	logger   *zap.Logger // logger
+	limiter  RateLimiter // rate limiter, unlimited when nil
+	retry    RetryPolicy // retry of the failed notifications
+	clock    Clock       // retry backoff and expiry time source
+	name     string      // destination name
+	metrics  *Metrics    // delivery metrics, disabled when nil
+	codeAttr string      // span attribute of the status code of an attempt
+}
+
+func newDeliverer(logger *zap.Logger, dest Destination, codeAttr string) deliverer {
+	d := deliverer{
+		logger:   logger.With(zap.String("destination", dest.Name)),
+		clock:    orClock(dest.Clock),
+		name:     dest.Name,
+		metrics:  dest.Metrics,
+		codeAttr: codeAttr,
+	}
+	if dest.Retry != nil {
+		d.retry = *dest.Retry
+	}
+	if dest.Rate > 0 {
+		d.limiter = NewRateLimiter(dest.Rate, dest.Burst, d.clock)
+	}
+	return d
+}
+
+// deliver calls send until it succeeds, fails with an error that isn't retryable, the retries are exhausted
+// or the run is aborted while waiting to retry, send returns the status code of the attempt, zero when there is none
+func (d *deliverer) deliver(msg *Message, send func(span *Span) (int, error)) error {
+	for attempt := 1; ; attempt++ {
+		if d.limiter != nil {
+			d.limiter.Wait()
+		}
+		span := msg.Span.Child(SpanAttempt)
+		span.SetAttr("destination", d.name)
+		span.SetAttr("attempt", strconv.Itoa(attempt))
+		start := d.clock.Now()
+		code, err := send(span)
+		d.metrics.ObserveLatency(d.name, d.clock.Now().Sub(start))
+		// sinks without status codes only count their errors
+		if code > 0 || err != nil {
+			d.metrics.Response(d.name, code)
+		}
+		if code > 0 {
+			span.SetAttr(d.codeAttr, strconv.Itoa(code))
+		}
+		span.End(err)
+		if err == nil {
+			return nil
+		}
+		if !IsRetryable(err) || attempt > d.retry.Attempts {
+			d.logger.Error("failed to notify the message", zap.Int("attempt", attempt), zap.Stringer("priority", msg.Priority), zap.Error(err))
+			d.metrics.Failed(d.name, err)
+			return err
+		}
+		// the receiver may ask for a longer wait, e.g. when rate limited
+		var asked time.Duration
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			asked = statusErr.RetryAfter
+		}
+		delay := d.retry.Wait(attempt, asked)
+		// don't retry when the message would be stale by then
+		if msg.Expired(d.clock.Now().Add(delay)) {
+			d.logger.Warn("message expired while retrying", zap.Int("attempt", attempt), zap.Stringer("priority", msg.Priority), zap.Error(err))
+			err = fmt.Errorf("%w after %d attempts: %v", ErrExpired, attempt, err)
+			d.metrics.Failed(d.name, err)
+			return err
+		}
+		d.metrics.Retried(d.name)
+		d.logger.Warn("failed to notify the message, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))
+		select {
+		case <-d.clock.After(delay):
+		case <-msg.Abort:
+			d.logger.Warn("run aborted while retrying", zap.Int("attempt", attempt), zap.Stringer("priority", msg.Priority), zap.Error(err))
+			return fmt.Errorf("%w after %d attempts: %v", ErrAborted, attempt, err)
+		}
+	}
+}
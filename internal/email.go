@@ -0,0 +1,348 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SchemeSMTP  = "smtp"  // SMTP with STARTTLS when the server offers it
+	SchemeSMTPS = "smtps" // SMTP over implicit TLS
+
+	defaultSMTPPort  = "587"
+	defaultSMTPSPort = "465"
+	emailTimeout     = 30 * time.Second // max time of the connection, from dial to quit
+	emailSubjectLen  = 78               // max characters of the default subject
+)
+
+// EmailConfig is the email of an email destination, the url of the destination is smtp://host:port
+// or smtps://host:port for implicit TLS
+type EmailConfig struct {
+	From        string        `yaml:"from"`                   // sender address, e.g. Notifier <notifier@example.com>
+	To          []string      `yaml:"to"`                     // recipient addresses
+	Subject     string        `yaml:"subject,omitempty"`      // text/template of the subject, first line of the message when empty
+	Username    string        `yaml:"username,omitempty"`     // SMTP auth username, no auth when empty
+	Password    string        `yaml:"password,omitempty"`     // SMTP auth password, plain value or secret reference
+	BatchWindow time.Duration `yaml:"batch_window,omitempty"` // messages received within the window are sent as one digest, one email per message when zero
+	BatchSize   int           `yaml:"batch_size,omitempty"`   // max messages of a digest, unlimited when zero
+	TLSConfig   *tls.Config   `yaml:"-"`                      // TLS of the connection, system roots when nil
+}
+
+// emailBatch is the digest of the messages of a batch window
+type emailBatch struct {
+	msgs []*Message
+	full chan struct{} // closed once the batch size is reached
+	done chan struct{} // closed once the digest is sent or failed
+	err  error         // error of the digest, set before done is closed
+}
+
+// emailClient sends the messages by email
+type emailClient struct {
+	deliverer
+	addr      string      // host:port of the SMTP server
+	host      string      // server name checked by TLS and auth
+	implicit  bool        // implicit TLS instead of STARTTLS
+	tlsConfig *tls.Config // TLS of the connection
+	from      *mail.Address
+	to        []*mail.Address
+	subject   *Template // subject template, first line of the message when nil
+	template  *Template // body template, raw message is sent when nil
+	username  string    // SMTP auth username, no auth when empty
+	password  *Secret   // SMTP auth password
+	window    time.Duration
+	size      int
+	mu        sync.Mutex     // guards batch and closed
+	batch     *emailBatch    // open batch, none when nil
+	closed    bool           // set once closed, the messages are sent one by one
+	stop      chan struct{}  // closed once closed, the open batch is sent at once
+	flushing  sync.WaitGroup // batches waiting to be sent
+}
+
+func newEmailClient(logger *zap.Logger, dest Destination) (HttpClient, error) {
+	cfg := dest.Email
+	if cfg == nil {
+		return nil, fmt.Errorf("destination %s: email type without email", dest.Name)
+	}
+	u, err := url.Parse(dest.URL)
+	if err != nil || (u.Scheme != SchemeSMTP && u.Scheme != SchemeSMTPS) || u.Hostname() == "" {
+		return nil, fmt.Errorf("destination %s: invalid url %q, should be smtp://host:port or smtps://host:port", dest.Name, MaskURL(dest.URL, dest.Type))
+	}
+	client := &emailClient{
+		deliverer: newDeliverer(logger, dest, "smtp.status_code"),
+		host:      u.Hostname(),
+		implicit:  u.Scheme == SchemeSMTPS,
+		username:  cfg.Username,
+		window:    cfg.BatchWindow,
+		size:      cfg.BatchSize,
+		stop:      make(chan struct{}),
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultSMTPPort
+		if client.implicit {
+			port = defaultSMTPSPort
+		}
+	}
+	client.addr = net.JoinHostPort(client.host, port)
+	client.tlsConfig = &tls.Config{ServerName: client.host}
+	if cfg.TLSConfig != nil {
+		client.tlsConfig = cfg.TLSConfig.Clone()
+		if client.tlsConfig.ServerName == "" {
+			client.tlsConfig.ServerName = client.host
+		}
+	}
+	if client.from, err = mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("destination %s: invalid from address %q: %w", dest.Name, cfg.From, err)
+	}
+	if len(cfg.To) == 0 {
+		return nil, fmt.Errorf("destination %s: no recipients", dest.Name)
+	}
+	for _, to := range cfg.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: invalid recipient %q: %w", dest.Name, to, err)
+		}
+		client.to = append(client.to, addr)
+	}
+	if cfg.Subject != "" {
+		if client.subject, err = NewTemplate(dest.Name+" subject", cfg.Subject); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+	}
+	if dest.Template != "" {
+		if client.template, err = NewTemplate(dest.Name, dest.Template); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+	}
+	if cfg.Username != "" {
+		if client.password, err = NewSecret(cfg.Password, dest.Refresh, client.clock); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+	}
+	return client, nil
+}
+
+// Notify sends the message by email, in batch mode it adds the message to the open batch
+// and returns the error of its digest once sent
+func (n *emailClient) Notify(msg *Message) error {
+	n.logger.Debug("sending email", zap.String("msg", msg.Body), zap.Stringer("priority", msg.Priority))
+	if n.window > 0 {
+		if batch := n.join(msg); batch != nil {
+			<-batch.done
+			return batch.err
+		}
+	}
+	if err := n.send([]*Message{msg}); err != nil {
+		return err
+	}
+	n.metrics.Delivered(n.name, msg.Priority)
+	return nil
+}
+
+// join adds the message to the open batch, a new batch is opened and flushed after the window when there is none,
+// it returns the batch of the message, none once the client is closed
+func (n *emailClient) join(msg *Message) *emailBatch {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil
+	}
+	batch := n.batch
+	if batch == nil {
+		batch = &emailBatch{full: make(chan struct{}), done: make(chan struct{})}
+		n.batch = batch
+		n.flushing.Add(1)
+		go n.flush(batch, n.clock.After(n.window))
+	}
+	batch.msgs = append(batch.msgs, msg)
+	if n.size > 0 && len(batch.msgs) >= n.size {
+		n.batch = nil
+		close(batch.full)
+	}
+	return batch
+}
+
+// flush sends the batch once the window is over, the batch is full or the client is closed,
+// the error of the digest is returned to the callers waiting for it
+func (n *emailClient) flush(batch *emailBatch, window <-chan time.Time) {
+	defer n.flushing.Done()
+	defer close(batch.done)
+	select {
+	case <-window:
+	case <-batch.full:
+	case <-n.stop:
+	}
+	n.mu.Lock()
+	if n.batch == batch {
+		n.batch = nil
+	}
+	msgs := batch.msgs
+	n.mu.Unlock()
+	if batch.err = n.send(msgs); batch.err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		n.metrics.Delivered(n.name, msg.Priority)
+	}
+}
+
+// Close sends the open batch at once and waits for the batches being sent
+func (n *emailClient) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.stop)
+	}
+	n.mu.Unlock()
+	n.flushing.Wait()
+	if n.password != nil {
+		n.password.Close()
+	}
+	return nil
+}
+
+// send renders the email of the messages, a digest when there are several, and sends it with retries
+func (n *emailClient) send(msgs []*Message) error {
+	subject, body, err := n.render(msgs)
+	if err != nil {
+		n.logger.Error("failed to render email", zap.Error(err))
+		return err
+	}
+	if err := n.deliver(msgs[0], func(span *Span) (int, error) { return n.sendMail(subject, body) }); err != nil {
+		return err
+	}
+	n.logger.Info("successfully sent the email", zap.Int("messages", len(msgs)))
+	return nil
+}
+
+// render returns the subject, rendered from the first message, and the body of the messages
+func (n *emailClient) render(msgs []*Message) (string, string, error) {
+	bodies := make([]string, len(msgs))
+	for i, msg := range msgs {
+		bodies[i] = msg.Body
+		if n.template != nil {
+			var err error
+			if bodies[i], err = n.template.Render(msg.Body); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	subject := strings.SplitN(strings.TrimSpace(bodies[0]), "\n", 2)[0]
+	if n.subject != nil {
+		var err error
+		if subject, err = n.subject.Render(msgs[0].Body); err != nil {
+			return "", "", err
+		}
+	} else if utf8.RuneCountInString(subject) > emailSubjectLen {
+		subject = string([]rune(subject)[:emailSubjectLen-3]) + "..."
+	}
+	if len(msgs) > 1 {
+		subject = fmt.Sprintf("%s (+%d more)", subject, len(msgs)-1)
+	}
+	// line breaks in the subject would inject headers
+	subject = strings.Join(strings.Fields(subject), " ")
+	return subject, strings.Join(bodies, "\n"), nil
+}
+
+// sendMail sends the email and returns the SMTP reply code, 250 when accepted
+func (n *emailClient) sendMail(subject, body string) (int, error) {
+	conn, err := net.DialTimeout("tcp", n.addr, emailTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	if n.implicit {
+		conn = tls.Client(conn, n.tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return smtpCode(err), err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && !n.implicit {
+		if err := c.StartTLS(n.tlsConfig); err != nil {
+			return smtpCode(err), err
+		}
+	}
+	if n.username != "" {
+		password, err := n.password.Value()
+		if err != nil {
+			n.logger.Warn("failed to refresh secret, using the last value", zap.Error(err))
+		}
+		// plain auth refuses to send the password unencrypted to a remote server
+		if err := c.Auth(smtp.PlainAuth("", n.username, password, n.host)); err != nil {
+			return smtpCode(err), err
+		}
+	}
+	if err := c.Mail(n.from.Address); err != nil {
+		return smtpCode(err), err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to.Address); err != nil {
+			return smtpCode(err), err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpCode(err), err
+	}
+	if _, err := w.Write(n.message(subject, body)); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return smtpCode(err), err
+	}
+	c.Quit()
+	return 250, nil
+}
+
+// message returns the plain text email with a quoted printable body
+func (n *emailClient) message(subject, body string) []byte {
+	to := make([]string, len(n.to))
+	for i, addr := range n.to {
+		to[i] = addr.String()
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", n.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", n.clock.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(body)) // line breaks are written as CRLF
+	qp.Close()
+	return buf.Bytes()
+}
+
+// smtpCode returns the code of the SMTP reply, zero for the other errors
+func smtpCode(err error) int {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
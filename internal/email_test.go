@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testCertificate returns a self signed certificate of 127.0.0.1 and the pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// smtpMail is an email received by the fake SMTP server
+type smtpMail struct {
+	from    string
+	to      []string
+	subject string
+	body    string
+	tls     bool // sent over TLS
+	auth    bool // sent by an authenticated client
+}
+
+// smtpServer is an in-process SMTP server recording the emails
+type smtpServer struct {
+	ln         net.Listener
+	tlsConfig  *tls.Config // STARTTLS offered when set
+	user, pass string      // AUTH PLAIN offered when set
+	reject     int         // reply code to the recipients, accepted when zero
+	mu         sync.Mutex
+	mails      []smtpMail
+}
+
+func newSMTPServer(t *testing.T, implicit bool, tlsConfig *tls.Config) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	if implicit {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	s := &smtpServer{ln: ln, tlsConfig: tlsConfig}
+	if implicit {
+		s.tlsConfig = nil // no STARTTLS on the TLS connection
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn, implicit)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *smtpServer) addr() string { return s.ln.Addr().String() }
+
+func (s *smtpServer) received() []smtpMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMail(nil), s.mails...)
+}
+
+func (s *smtpServer) serve(t *testing.T, conn net.Conn, secure bool) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 127.0.0.1 ESMTP fake")
+	mail := smtpMail{tls: secure}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			tp.PrintfLine("250-127.0.0.1")
+			if s.tlsConfig != nil && !mail.tls {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			if s.user != "" {
+				tp.PrintfLine("250-AUTH PLAIN")
+			}
+			tp.PrintfLine("250 8BITMIME")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, mail.tls = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if string(b) != "\x00"+s.user+"\x00"+s.pass {
+				tp.PrintfLine("535 5.7.8 authentication failed")
+				continue
+			}
+			mail.auth = true
+			tp.PrintfLine("235 2.7.0 authenticated")
+		case "MAIL":
+			from := strings.Fields(strings.TrimPrefix(arg, "FROM:"))[0] // without the BODY parameter
+			mail.from = strings.Trim(from, "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			if s.reject > 0 {
+				tp.PrintfLine("%d recipient rejected", s.reject)
+				continue
+			}
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := readMail(data)
+			assert.NoError(t, err)
+			mail.subject, mail.body = msg.subject, msg.body
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// readMail decodes the subject and the quoted printable body
+func readMail(data []byte) (smtpMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return smtpMail{}, err
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return smtpMail{}, err
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	// the client ends the data with a line break
+	text := strings.TrimSuffix(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	return smtpMail{subject: subject, body: text}, err
+}
+
+func Test_emailClient(t *testing.T) {
+	cert, pool := testCertificate(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tests := map[string]struct {
+		scheme   string
+		implicit bool
+		tls      *tls.Config
+		user     string
+		email    EmailConfig
+		template string
+		msg      string
+		want     smtpMail
+	}{
+		"Should send the message in plain text": {
+			scheme: SchemeSMTP,
+			email:  EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com", "Dev Team <dev@example.com>"}},
+			msg:    "disk full\non db-1",
+			want: smtpMail{
+				from:    "notifier@example.com",
+				to:      []string{"ops@example.com", "dev@example.com"},
+				subject: "disk full",
+				body:    "disk full\non db-1",
+			},
+		},
+		"Should upgrade with STARTTLS and authenticate": {
+			scheme: SchemeSMTP,
+			tls:    serverTLS,
+			user:   "notifier",
+			email: EmailConfig{
+				From:     "notifier@example.com",
+				To:       []string{"ops@example.com"},
+				Subject:  `[{{field . "level"}}] {{field . "host"}}`,
+				Username: "notifier",
+				Password: "s3cr3t",
+			},
+			template: `{{field . "msg"}}`,
+			msg:      `{"level":"crit","host":"db-1","msg":"disk full é"}`,
+			want: smtpMail{
+				from:    "notifier@example.com",
+				to:      []string{"ops@example.com"},
+				subject: "[crit] db-1",
+				body:    "disk full é",
+				tls:     true,
+				auth:    true,
+			},
+		},
+		"Should send over implicit TLS": {
+			scheme:   SchemeSMTPS,
+			implicit: true,
+			tls:      serverTLS,
+			user:     "notifier",
+			email:    EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com"}, Username: "notifier", Password: "s3cr3t"},
+			msg:      "disk full",
+			want: smtpMail{
+				from:    "notifier@example.com",
+				to:      []string{"ops@example.com"},
+				subject: "disk full",
+				body:    "disk full",
+				tls:     true,
+				auth:    true,
+			},
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newSMTPServer(t, testCase.implicit, testCase.tls)
+			srv.user, srv.pass = testCase.user, "s3cr3t"
+			email := testCase.email
+			email.TLSConfig = &tls.Config{RootCAs: pool}
+			client, err := NewDestinationClient(zap.NewNop(), Destination{
+				Name:     "mail",
+				Type:     TypeEmail,
+				URL:      testCase.scheme + "://" + srv.addr(),
+				Template: testCase.template,
+				Email:    &email,
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, client.Notify(NewMessage(testCase.msg)))
+			assert.Equal(t, []smtpMail{testCase.want}, srv.received())
+		})
+	}
+}
+
+func Test_emailClient_Digest(t *testing.T) {
+	srv := newSMTPServer(t, false, nil)
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	email := &EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com"}, BatchWindow: time.Minute, BatchSize: 3}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "mail", Type: TypeEmail, URL: "smtp://" + srv.addr(), Email: email, Clock: clock})
+	assert.NoError(t, err)
+	sent := func(errs ...<-chan error) {
+		for _, err := range errs {
+			assert.NoError(t, <-err)
+		}
+	}
+
+	// queued in the open batch until the window is over
+	first, second := queueMail(t, client, "disk full", 1), queueMail(t, client, "cpu high", 2)
+	assert.Empty(t, srv.received())
+	assert.Empty(t, first, "waiting for the digest")
+	clock.Advance(time.Minute)
+	sent(first, second)
+	assert.Len(t, srv.received(), 1)
+	// sent once full
+	sent(queueMail(t, client, "a", 1), queueMail(t, client, "b", 2), queueMail(t, client, "c", 0))
+	assert.Len(t, srv.received(), 2)
+	// sent at once on close, the later messages are sent one by one
+	x, y := queueMail(t, client, "x", 1), queueMail(t, client, "y", 2)
+	assert.NoError(t, client.(io.Closer).Close())
+	sent(x, y)
+	assert.Len(t, srv.received(), 3)
+	assert.NoError(t, client.Notify(NewMessage("z")))
+
+	mails := srv.received()
+	assert.Len(t, mails, 4)
+	assert.Equal(t, "disk full (+1 more)", mails[0].subject)
+	assert.Equal(t, "disk full\ncpu high", mails[0].body)
+	assert.Equal(t, "a (+2 more)", mails[1].subject)
+	assert.Equal(t, "a\nb\nc", mails[1].body)
+	assert.Equal(t, "x\ny", mails[2].body)
+	assert.Equal(t, "z", mails[3].body)
+}
+
+func Test_emailClient_DigestRejected(t *testing.T) {
+	srv := newSMTPServer(t, false, nil)
+	srv.reject = 550
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	email := &EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com"}, BatchWindow: time.Minute}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "mail", Type: TypeEmail, URL: "smtp://" + srv.addr(), Email: email, Clock: clock})
+	assert.NoError(t, err)
+
+	// every message of the rejected digest fails with it
+	errs := []<-chan error{queueMail(t, client, "disk full", 1), queueMail(t, client, "cpu high", 2)}
+	clock.Advance(time.Minute)
+	for _, errCh := range errs {
+		err := <-errCh
+		assert.Error(t, err)
+		assert.Equal(t, 550, smtpCode(err))
+	}
+	assert.Empty(t, srv.received())
+}
+
+// queueMail notifies the message in the background and waits for the open batch to hold the given number of messages,
+// zero once it was sent full
+func queueMail(t *testing.T, client HttpClient, msg string, batch int) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- client.Notify(NewMessage(msg)) }()
+	assert.Eventually(t, func() bool { return batched(client) == batch }, time.Second, time.Millisecond)
+	return done
+}
+
+// batched returns the number of messages of the open batch
+func batched(client HttpClient) int {
+	c := client.(*emailClient)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.batch == nil {
+		return 0
+	}
+	return len(c.batch.msgs)
+}
+
+func Test_emailClient_Rejected(t *testing.T) {
+	tests := map[string]struct {
+		code      int
+		retryable bool
+	}{
+		"Should not retry a permanent failure": {code: 550},
+		"Should retry a transient failure":     {code: 451, retryable: true},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newSMTPServer(t, false, nil)
+			srv.reject = testCase.code
+			metrics := NewMetrics()
+			client, err := NewDestinationClient(zap.NewNop(), Destination{
+				Name:    "mail",
+				Type:    TypeEmail,
+				URL:     "smtp://" + srv.addr(),
+				Email:   &EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com"}},
+				Metrics: metrics,
+			})
+			assert.NoError(t, err)
+			err = client.Notify(NewMessage("disk full"))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "recipient rejected")
+			}
+			assert.Equal(t, testCase.code, smtpCode(err))
+			assert.Equal(t, testCase.retryable, IsRetryable(err))
+			assert.Empty(t, srv.received())
+			assert.Equal(t, float64(1), metrics.responses.total())
+		})
+	}
+}
+
+func Test_emailClient_Invalid(t *testing.T) {
+	email := &EmailConfig{From: "notifier@example.com", To: []string{"ops@example.com"}}
+	tests := map[string]struct {
+		dest    Destination
+		wantErr string
+	}{
+		"Should require the email": {
+			dest:    Destination{URL: "smtp://localhost"},
+			wantErr: "destination mail: email type without email",
+		},
+		"Should require the smtp url": {
+			dest:    Destination{URL: "https://localhost", Email: email},
+			wantErr: `destination mail: invalid url "https://localhost", should be smtp://host:port or smtps://host:port`,
+		},
+		"Should require the recipients": {
+			dest:    Destination{URL: "smtp://localhost", Email: &EmailConfig{From: "notifier@example.com"}},
+			wantErr: "destination mail: no recipients",
+		},
+		"Should check the recipients": {
+			dest:    Destination{URL: "smtp://localhost", Email: &EmailConfig{From: "notifier@example.com", To: []string{"ops"}}},
+			wantErr: `destination mail: invalid recipient "ops": mail: missing '@' or angle-addr`,
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			dest := testCase.dest
+			dest.Name, dest.Type = "mail", TypeEmail
+			_, err := NewDestinationClient(zap.NewNop(), dest)
+			assert.EqualError(t, err, testCase.wantErr)
+		})
+	}
+}
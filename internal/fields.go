@@ -0,0 +1,61 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// ParseFields decodes the message as JSON object, it returns nil when the message is not a JSON object
+func ParseFields(msg string) map[string]interface{} {
+	trimmed := strings.TrimSpace(msg)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// LookupField returns the value of the dotted field path (e.g. labels.team) as string
+func LookupField(fields map[string]interface{}, path string) (string, bool) {
+	var cur interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if cur, ok = obj[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
+
+// Field returns the value of the dotted field path of the JSON message
+func Field(msg, path string) (string, bool) {
+	return LookupField(ParseFields(msg), path)
+}
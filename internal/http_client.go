@@ -7,79 +7,265 @@ Email bhakiya.kalimuthu@gmail.com
 package internal
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// HttpClient is the interface that wraps the Notify method
+// Notify sends the message and returns the error once it can't be delivered,
+// the clients holding files or connections also implement io.Closer to release them
+// and the clients serving subscribers implement Start, called before the first message
 type HttpClient interface {
-	Notify(msg string)
+	Notify(msg *Message) error
 }
 
-type httpClient struct {
-	logger     *zap.Logger  // logger
-	httpClient *http.Client // http client for sending notification
-	url        string       // url where notification to be sent
+// closeClient closes the client or the sink when it implements io.Closer
+func closeClient(v interface{}) error {
+	if closer, ok := v.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// StartClient starts the client or the sink when it implements Start, e.g. the server of an sse sink,
+// the clients are created without starting them so that validating a config binds no port
+func StartClient(v interface{}) error {
+	if starter, ok := v.(interface{ Start() error }); ok {
+		return starter.Start()
+	}
+	return nil
 }
-type httpClient1 struct {
-	logger     *zap.Logger // logger
-	httpClient http.Client // http client for sending notification
-	url        string      // url where notification to be sent
+
+// sinkClient renders the messages of a destination and delivers them to the sink of its url
+type sinkClient struct {
+	deliverer             // attempts with the rate limit, retries and metrics of the destination
+	sink      Sink        // delivery of the rendered body
+	template  *Template   // body template, raw message is sent when nil
+	preset    *chatPreset // chat webhook payload, raw body is sent when nil
+	maxLength int         // max characters of a message, longer messages are split, never when zero
 }
 
-func NewHttpClient(logger *zap.Logger, url string) HttpClient {
-	client := &http.Client{Timeout: time.Second * 5} // default timeout set to 5s
-	return &httpClient{
-		logger:     logger,
-		httpClient: client,
-		url:        url,
+// httpSink posts the body to the url
+type httpSink struct {
+	logger     *zap.Logger     // logger
+	clock      Clock           // Retry-After time source
+	httpClient *http.Client    // http client for sending notification
+	url        string          // url where notification to be sent
+	shownURL   string          // url shown in the errors, the secret reference or the url with its password masked
+	headers    *requestHeaders // additional headers and authentication of the requests
+}
+
+// Destination is a named notification target with its own url, headers, template and rate limit
+type Destination struct {
+	Name      string            `yaml:"name"`                 // name referred by the routing rules
+	Type      string            `yaml:"type,omitempty"`       // webhook, slack, teams, discord, chat or email, webhook when empty
+	URL       string            `yaml:"url"`                  // url where notification to be sent, can be a secret reference
+	Headers   map[string]string `yaml:"headers,omitempty"`    // additional request headers, values can be secret references
+	Auth      *Auth             `yaml:"auth,omitempty"`       // request authentication, none when nil
+	Template  string            `yaml:"template,omitempty"`   // text/template for the request body
+	Rate      float64           `yaml:"rate,omitempty"`       // max notifications per second, the chat service limit or unlimited when zero, unlimited when negative
+	Burst     int               `yaml:"burst,omitempty"`      // max burst of notifications above the rate
+	MaxLength int               `yaml:"max_length,omitempty"` // max characters of a message, longer messages are split, the chat service limit when zero
+	Email     *EmailConfig      `yaml:"email,omitempty"`      // sender, recipients and digest of the email type
+	Retry     *RetryPolicy      `yaml:"retry,omitempty"`      // retry of the failed notifications, routes default when nil
+	Clock     Clock             `yaml:"-"`                    // retry backoff time source, real clock when nil
+	Metrics   *Metrics          `yaml:"-"`                    // delivery metrics, disabled when nil
+	Refresh   time.Duration     `yaml:"-"`                    // interval after which the secret references are resolved again, never when zero
+}
+
+// NewDestinationClient creates the client of the destination type, delivering to the sink of the url scheme
+func NewDestinationClient(logger *zap.Logger, dest Destination) (HttpClient, error) {
+	if err := checkType(dest.Type); err != nil {
+		return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+	}
+	if dest.Type == TypeEmail {
+		return newEmailClient(logger, dest)
+	}
+	preset, chat := chatPresets[dest.Type]
+	if chat && dest.Rate == 0 {
+		dest.Rate, dest.Burst = preset.rate, preset.burst
+	}
+	// the rate limited requests are retried after the wait asked by the service unless the retries are disabled with -1,
+	// the network errors and the 5xx responses are retried as well
+	if chat && (dest.Retry == nil || dest.Retry.Attempts == 0) {
+		var retry RetryPolicy
+		if dest.Retry != nil {
+			retry = *dest.Retry
+		}
+		retry.Attempts = preset.retries
+		dest.Retry = &retry
+	}
+	// the url is a secret when it is a reference, e.g. a webhook url carrying its token
+	rawURL := dest.URL
+	if !IsSinkURL(dest.URL) {
+		var err error
+		if rawURL, err = ResolveSecret(dest.URL); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+	}
+	u, err := url.ParseRequestURI(rawURL)
+	if err == nil && u.Scheme == "" {
+		err = errors.New("missing scheme")
+	}
+	if err != nil {
+		if IsSecretRef(dest.URL) {
+			return nil, fmt.Errorf("destination %s: invalid url of %s", dest.Name, dest.URL)
+		}
+		return nil, fmt.Errorf("destination %s: invalid url: %w", dest.Name, err)
+	}
+	factory := sinkFactory(u.Scheme)
+	if factory == nil {
+		return nil, fmt.Errorf("destination %s: invalid url scheme %q, should be %s", dest.Name, u.Scheme, strings.Join(sinkSchemes(), ", "))
+	}
+	client := &sinkClient{
+		deliverer: newDeliverer(logger, dest, "http.status_code"),
+		maxLength: dest.MaxLength,
+	}
+	if chat {
+		client.preset = &preset
+		if client.maxLength == 0 {
+			client.maxLength = preset.maxLength
+		}
+	}
+	if dest.Template != "" {
+		if client.template, err = NewTemplate(dest.Name, dest.Template); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
 	}
+	if client.sink, err = factory(client.logger, dest, u); err != nil {
+		return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+	}
+	return client, nil
 }
 
-func NewHttpClient1(logger *zap.Logger, url string) HttpClient {
-	client := http.Client{Timeout: time.Second * 5} // default timeout set to 5s
-	return &httpClient1{
+// newHTTPSink creates the sink posting to the url with the headers and the authentication of the destination
+func newHTTPSink(logger *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+	sink := &httpSink{
 		logger:     logger,
-		httpClient: client,
-		url:        url,
+		clock:      orClock(dest.Clock),
+		httpClient: &http.Client{Timeout: time.Second * 5}, // default timeout set to 5s
+		url:        u.String(),
+		shownURL:   MaskURL(dest.URL, dest.Type),
+	}
+	var err error
+	if sink.headers, err = newRequestHeaders(logger, dest, sink.clock); err != nil {
+		return nil, err
+	}
+	if _, chat := chatPresets[dest.Type]; chat {
+		sink.headers.setDefault("Content-Type", "application/json")
 	}
+	return sink, nil
 }
 
-// Notify using http client to make http post request
-func (n *httpClient) Notify(msg string) {
-	n.logger.Debug("making http request", zap.String("msg", msg))
-	// create http request
-	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewBuffer([]byte(msg)))
-	if err != nil {
-		n.logger.Error("failed to make new request", zap.Error(err))
-		return
+// Notify renders the message and delivers it to the sink, a message longer than the max length
+// is sent as several parts in order
+func (n *sinkClient) Notify(msg *Message) error {
+	n.logger.Debug("sending message", zap.String("msg", msg.Body), zap.Stringer("priority", msg.Priority))
+	text := msg.Body
+	if n.template != nil {
+		var err error
+		if text, err = n.template.Render(msg.Body); err != nil {
+			n.logger.Error("failed to render body", zap.Error(err))
+			return err
+		}
 	}
-	// make post request
-	_, err = n.httpClient.Do(req)
-	if err != nil {
-		n.logger.Error("failed to make new request", zap.Error(err))
-		return
+	parts := SplitMessage(text, n.maxLength)
+	for i, part := range parts {
+		body := part
+		if n.preset != nil {
+			var err error
+			if body, err = n.preset.body(part); err != nil {
+				n.logger.Error("failed to render body", zap.Error(err))
+				return err
+			}
+		}
+		if err := n.deliver(msg, func(span *Span) (int, error) { return n.sink.Send(body, span) }); err != nil {
+			if len(parts) > 1 {
+				n.logger.Error("message partially sent", zap.Int("sent", i), zap.Int("parts", len(parts)))
+			}
+			return err
+		}
 	}
-	n.logger.Info("successfully notified the message", zap.String("msg", msg))
+	n.logger.Info("successfully notified the message", zap.String("msg", msg.Body), zap.Stringer("priority", msg.Priority))
+	n.metrics.Delivered(n.name, msg.Priority)
+	return nil
+}
 
+// Start starts the sink, e.g. the server of the subscribers
+func (n *sinkClient) Start() error {
+	return StartClient(n.sink)
 }
 
-// Notify using http client to make http post request
-func (n *httpClient1) Notify(msg string) {
-	n.logger.Debug("making http request", zap.String("msg", msg))
-	// create http request
-	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewBuffer([]byte(msg)))
-	if err != nil {
-		n.logger.Error("failed to make new request", zap.Error(err))
-		return
+// Close closes the sink, e.g. the file or the connection
+func (n *sinkClient) Close() error {
+	return closeClient(n.sink)
+}
+
+// Close stops the refresh of the secrets of the requests
+func (n *httpSink) Close() error {
+	return n.headers.Close()
+}
+
+// Send makes the http post request and returns the status code, non 2xx response is returned as StatusError,
+// the span of the attempt is propagated in the traceparent header,
+// a request rejected with 401 is sent once more with a fresh OAuth2 token as the cached one may have been revoked
+func (n *httpSink) Send(body string, span *Span) (int, error) {
+	for try := 1; ; try++ {
+		req, err := n.request(body, span)
+		if err != nil {
+			return 0, err
+		}
+		code, err := n.do(req)
+		if code != http.StatusUnauthorized || try > 1 || !n.headers.auth.Refreshable() {
+			return code, err
+		}
+		n.logger.Warn("request unauthorized, retrying with a fresh token")
+		n.headers.auth.Invalidate(req)
 	}
-	// make post request
-	_, err = n.httpClient.Do(req)
+}
+
+// request creates the http request of the body with the headers and the authentication
+func (n *httpSink) request(body string, span *Span) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(body))
 	if err != nil {
-		n.logger.Error("failed to make new request", zap.Error(err))
-		return
+		return nil, err
+	}
+	if err := n.headers.apply(req, body); err != nil {
+		return nil, err
+	}
+	if span != nil {
+		req.Header.Set(TraceparentHeader, span.Traceparent())
 	}
-	n.logger.Info("successfully notified the message", zap.String("msg", msg))
+	return req, nil
+}
 
+// do makes the request and returns the status code
+func (n *httpSink) do(req *http.Request) (int, error) {
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		// keep the secrets of the url out of the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = n.shownURL
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, &StatusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), b, n.clock.Now())}
+	}
+	// drain the body so that the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, &StatusError{StatusCode: resp.StatusCode}
+	}
+	return resp.StatusCode, nil
 }
@@ -0,0 +1,198 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultListenMaxConns    = 64        // default number of concurrent connections per listener
+	DefaultListenMaxLineSize = 64 * 1024 // default max line size, same as bufio.Scanner default
+	DefaultListenConnBuffer  = 16        // default number of lines buffered per connection
+)
+
+// Listener is the interface that wraps the Serve method
+// Serve accepts newline delimited messages until the context is cancelled
+type Listener interface {
+	Serve(ctx context.Context) error
+}
+
+// ListenerConfig holds the limits applied to every listener connection
+type ListenerConfig struct {
+	MaxConns    int // max number of concurrent connections, new connections above the limit are rejected
+	MaxLineSize int // max size of a single line, connection is closed when exceeded
+	ConnBuffer  int // number of lines buffered per connection before the connection is back pressured
+}
+
+// listener type
+type listener struct {
+	logger       *zap.Logger    // logger
+	network      string         // tcp or unix
+	address      string         // address to listen on
+	cfg          ListenerConfig // connection limits
+	producerChan chan string    // channel to send the received lines
+	conns        chan struct{}  // semaphore to limit the concurrent connections
+}
+
+// ParseListenAddr parses the listen address of the form unix:///path.sock or tcp://host:port
+func ParseListenAddr(raw string) (network, address string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		address = u.Path
+		if address == "" {
+			address = u.Opaque
+		}
+	case "tcp":
+		address = u.Host
+	default:
+		return "", "", fmt.Errorf("invalid listen address %q: unsupported scheme %q", raw, u.Scheme)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("invalid listen address %q: empty address", raw)
+	}
+	return u.Scheme, address, nil
+}
+
+// NewListener constructor
+func NewListener(logger *zap.Logger, rawAddr string, cfg ListenerConfig, producerChan chan string) (Listener, error) {
+	network, address, err := ParseListenAddr(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultListenMaxConns
+	}
+	if cfg.MaxLineSize <= 0 {
+		cfg.MaxLineSize = DefaultListenMaxLineSize
+	}
+	if cfg.ConnBuffer <= 0 {
+		cfg.ConnBuffer = DefaultListenConnBuffer
+	}
+	return &listener{
+		logger:       logger.With(zap.String("listen", rawAddr)),
+		network:      network,
+		address:      address,
+		cfg:          cfg,
+		producerChan: producerChan,
+		conns:        make(chan struct{}, cfg.MaxConns),
+	}, nil
+}
+
+// Serve listens on the configured address and handles each connection concurrently
+func (l *listener) Serve(ctx context.Context) error {
+	if l.network == "unix" {
+		// remove stale socket file left behind by previous run, any other file is kept
+		if info, err := os.Lstat(l.address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("failed to listen on unix://%s: existing file is not a socket", l.address)
+			}
+			if err := os.Remove(l.address); err != nil {
+				return fmt.Errorf("failed to remove stale socket %s: %w", l.address, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to check stale socket %s: %w", l.address, err)
+		}
+	}
+	ln, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s://%s: %w", l.network, l.address, err)
+	}
+	l.logger.Info("listening for messages", zap.String("addr", ln.Addr().String()))
+
+	wg := new(sync.WaitGroup)
+	go func() {
+		<-ctx.Done()
+		ln.Close() // unblock accept
+	}()
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			l.logger.Error("failed to accept connection", zap.Error(err))
+			return err
+		}
+		select {
+		case l.conns <- struct{}{}:
+		default:
+			l.logger.Warn("connection limit reached, rejecting connection", zap.Int("maxConns", l.cfg.MaxConns))
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-l.conns }()
+			l.handle(ctx, conn)
+		}()
+	}
+}
+
+// handle reads lines from the connection into its own buffer, so that a slow consumer
+// only back pressures this connection and not the others
+func (l *listener) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	logger := l.logger.With(zap.String("remote", conn.RemoteAddr().String()))
+	logger.Debug("connection accepted")
+
+	lines := make(chan string, l.cfg.ConnBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range lines {
+			select {
+			case l.producerChan <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// close the connection on cancellation to unblock the scanner
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), l.cfg.MaxLineSize)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text(): // blocks when buffer is full, which stops reading from the socket
+		case <-done:
+		}
+	}
+	close(lines)
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			logger.Warn("line exceeded max line size, closing connection", zap.Int("maxLineSize", l.cfg.MaxLineSize))
+		} else {
+			logger.Debug("connection read error", zap.Error(err))
+		}
+	}
+	<-done
+	logger.Debug("connection closed")
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_ParseListenAddr(t *testing.T) {
+	tests := map[string]struct {
+		raw         string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		"Should parse unix socket address": {
+			raw:         "unix:///tmp/notifier.sock",
+			wantNetwork: "unix",
+			wantAddress: "/tmp/notifier.sock",
+		},
+		"Should parse tcp address": {
+			raw:         "tcp://:9000",
+			wantNetwork: "tcp",
+			wantAddress: ":9000",
+		},
+		"Should fail when scheme is not supported": {
+			raw:     "udp://:9000",
+			wantErr: true,
+		},
+		"Should fail when address is empty": {
+			raw:     "tcp://",
+			wantErr: true,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			network, address, err := ParseListenAddr(testCase.raw)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.wantNetwork, network)
+			assert.Equal(t, testCase.wantAddress, address)
+		})
+	}
+}
+
+func Test_listener_Serve(t *testing.T) {
+	tests := map[string]struct {
+		rawAddr string
+		cfg     ListenerConfig
+		conns   int
+		lines   []string
+		want    int
+	}{
+		"Should receive lines from multiple concurrent tcp connections": {
+			rawAddr: "tcp://127.0.0.1:0",
+			conns:   3,
+			lines:   []string{"msg1", "msg2", "msg3"},
+			want:    9,
+		},
+		"Should receive lines from unix socket connection": {
+			rawAddr: "unix://" + filepath.Join(t.TempDir(), "notifier.sock"),
+			conns:   1,
+			lines:   []string{"msg1", "msg2"},
+			want:    2,
+		},
+		"Should drop the line exceeding max line size": {
+			rawAddr: "tcp://127.0.0.1:0",
+			cfg:     ListenerConfig{MaxLineSize: 8},
+			conns:   1,
+			lines:   []string{"msg1", strings.Repeat("x", 32)},
+			want:    1,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			producerChan := make(chan string)
+			ln, err := NewListener(zap.NewNop(), testCase.rawAddr, testCase.cfg, producerChan)
+			assert.NoError(t, err)
+			l := ln.(*listener)
+			if l.network == "tcp" {
+				// resolve a free port upfront so that the test can dial it
+				probe, err := net.Listen("tcp", l.address)
+				assert.NoError(t, err)
+				l.address = probe.Addr().String()
+				probe.Close()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- l.Serve(ctx) }()
+
+			wg := new(sync.WaitGroup)
+			for i := 0; i < testCase.conns; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn := dialRetry(t, l.network, l.address)
+					defer conn.Close()
+					for _, line := range testCase.lines {
+						fmt.Fprintf(conn, "%s\n", line)
+					}
+				}()
+			}
+
+			var got []string
+			timeout := time.After(2 * time.Second)
+			for len(got) < testCase.want {
+				select {
+				case msg := <-producerChan:
+					got = append(got, msg)
+				case <-timeout:
+					t.Fatalf("timed out, received %d of %d messages", len(got), testCase.want)
+				}
+			}
+			wg.Wait()
+			cancel()
+			assert.NoError(t, <-served)
+			assert.Equal(t, testCase.want, len(got))
+		})
+	}
+}
+
+func Test_listener_MaxConns(t *testing.T) {
+	producerChan := make(chan string)
+	ln, err := NewListener(zap.NewNop(), "tcp://127.0.0.1:0", ListenerConfig{MaxConns: 1}, producerChan)
+	assert.NoError(t, err)
+	l := ln.(*listener)
+	probe, err := net.Listen("tcp", l.address)
+	assert.NoError(t, err)
+	l.address = probe.Addr().String()
+	probe.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	first := dialRetry(t, l.network, l.address)
+	defer first.Close()
+	fmt.Fprintf(first, "msg1\n")
+	assert.Equal(t, "msg1", <-producerChan)
+
+	// second connection is rejected while the first one is open
+	second := dialRetry(t, l.network, l.address)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_listener_StaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	// a socket left behind by a previous run
+	stale := filepath.Join(dir, "stale.sock")
+	old, err := net.Listen("unix", stale)
+	assert.NoError(t, err)
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	// a regular file at the socket path
+	regular := filepath.Join(dir, "notifier.log")
+	assert.NoError(t, os.WriteFile(regular, []byte("keep"), 0o600))
+
+	ln, err := NewListener(zap.NewNop(), "unix://"+stale, ListenerConfig{}, make(chan string))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ln.Serve(ctx) }()
+	dialRetry(t, "unix", stale).Close()
+	cancel()
+	assert.NoError(t, <-served)
+
+	ln, err = NewListener(zap.NewNop(), "unix://"+regular, ListenerConfig{}, make(chan string))
+	assert.NoError(t, err)
+	assert.EqualError(t, ln.Serve(context.Background()), "failed to listen on unix://"+regular+": existing file is not a socket")
+	b, err := os.ReadFile(regular)
+	assert.NoError(t, err)
+	assert.Equal(t, "keep", string(b))
+}
+
+func dialRetry(t *testing.T, network, address string) net.Conn {
+	t.Helper()
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial(network, address); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to dial %s://%s: %v", network, address, err)
+	return nil
+}
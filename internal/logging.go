@@ -0,0 +1,278 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-colorable"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Log formats, outputs and redaction modes
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+
+	LogOutputStderr = "stderr"
+	LogOutputStdout = "stdout"
+
+	RedactNone     = "none"
+	RedactHash     = "hash"
+	RedactTruncate = "truncate"
+
+	DefaultLogMaxSize     = 100 // default size in MB after which the log file is rotated
+	DefaultLogMaxBackups  = 5   // default number of rotated log files kept
+	DefaultRedactTruncate = 16  // default number of characters kept by the truncate redaction
+)
+
+// redactedFields are the log fields carrying message contents
+var redactedFields = map[string]bool{"msg": true, "key": true}
+
+// LogConfig holds the logger options
+type LogConfig struct {
+	Level      string `yaml:"level"`       // debug, info, warn or error
+	Format     string `yaml:"format"`      // console or json
+	Output     string `yaml:"output"`      // stderr, stdout or a file path
+	MaxSize    int    `yaml:"max_size"`    // size in MB after which the log file is rotated, never rotated when zero
+	MaxBackups int    `yaml:"max_backups"` // number of rotated log files kept
+	Sample     int    `yaml:"sample"`      // identical entries logged per second before sampling, no sampling when zero
+	Thereafter int    `yaml:"thereafter"`  // every nth identical entry logged once sampling
+	Redact     string `yaml:"redact"`      // none, hash or truncate the message contents
+	Truncate   int    `yaml:"truncate"`    // characters kept by the truncate redaction
+}
+
+// Validate checks the options without opening the output
+func (cfg LogConfig) Validate() error {
+	if _, err := cfg.level(); err != nil {
+		return err
+	}
+	if cfg.Format != "" && cfg.Format != LogFormatConsole && cfg.Format != LogFormatJSON {
+		return fmt.Errorf("invalid log format %q, should be console or json", cfg.Format)
+	}
+	_, err := newRedactor(cfg.Redact, cfg.Truncate)
+	return err
+}
+
+func (cfg LogConfig) level() (zapcore.Level, error) {
+	level := zapcore.InfoLevel
+	if cfg.Level != "" {
+		if err := level.Set(cfg.Level); err != nil {
+			return level, fmt.Errorf("invalid log level %q", cfg.Level)
+		}
+	}
+	return level, nil
+}
+
+// NewLogger creates the logger of the options, the returned function syncs and closes the output
+func NewLogger(cfg LogConfig) (*zap.Logger, func() error, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	level, _ := cfg.level()
+	redact, _ := newRedactor(cfg.Redact, cfg.Truncate)
+
+	var (
+		out      zapcore.WriteSyncer
+		closeOut = func() error { return nil }
+		tty      bool // colors only on the terminal
+	)
+	switch cfg.Output {
+	case "", LogOutputStderr:
+		out, tty = zapcore.AddSync(colorable.NewColorableStderr()), true
+	case LogOutputStdout:
+		out, tty = zapcore.AddSync(colorable.NewColorableStdout()), true
+	default:
+		file, err := NewRotatingFile(cfg.Output, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, closeOut = file, file.Close
+	}
+
+	var encoder zapcore.Encoder
+	switch cfg.Format {
+	case "", LogFormatConsole:
+		encCfg := zap.NewDevelopmentEncoderConfig()
+		if tty {
+			encCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+		encoder = zapcore.NewConsoleEncoder(encCfg)
+	case LogFormatJSON:
+		encCfg := zap.NewProductionEncoderConfig()
+		encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		encCfg.MessageKey = "message" // msg is the message contents field
+		encoder = zapcore.NewJSONEncoder(encCfg)
+	}
+
+	core := zapcore.NewCore(encoder, out, level)
+	if redact != nil {
+		core = &redactingCore{Core: core, redact: redact}
+	}
+	// the sampler wraps the redaction, its Check is where the entries are sampled
+	if cfg.Sample > 0 {
+		thereafter := cfg.Thereafter
+		if thereafter <= 0 {
+			thereafter = cfg.Sample
+		}
+		core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.Sample, thereafter)
+	}
+	logger := zap.New(core)
+	return logger, func() error {
+		logger.Sync()
+		return closeOut()
+	}, nil
+}
+
+// newRedactor returns the redaction of the message contents, nil when disabled
+func newRedactor(mode string, truncate int) (func(string) string, error) {
+	switch mode {
+	case "", RedactNone:
+		return nil, nil
+	case RedactHash:
+		return func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return "sha256:" + hex.EncodeToString(sum[:8])
+		}, nil
+	case RedactTruncate:
+		if truncate <= 0 {
+			truncate = DefaultRedactTruncate
+		}
+		return func(s string) string {
+			if utf8.RuneCountInString(s) <= truncate {
+				return s
+			}
+			return fmt.Sprintf("%s...(%d bytes)", string([]rune(s)[:truncate]), len(s))
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid log redaction %q, should be none, hash or truncate", mode)
+}
+
+// redactingCore redacts the message contents of the fields before they are encoded
+type redactingCore struct {
+	zapcore.Core
+	redact func(string) string
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.fields(fields)), redact: c.redact}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, c.fields(fields))
+}
+
+// fields returns the fields with the message contents redacted
+func (c *redactingCore) fields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		if f.Type == zapcore.StringType && redactedFields[f.Key] {
+			f.String = c.redact(f.String)
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
+
+// RotatingFile is the log file rotated once it grows over the max size,
+// rotated files are renamed to path.1, path.2... up to the max backups
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // bytes, never rotated when zero
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens the log file for appending, maxSize is in MB
+func NewRotatingFile(path string, maxSize, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: int64(maxSize) * 1024 * 1024, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends to the file, the file is rotated first when the write would exceed the max size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, the oldest one is removed
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups > 0 {
+		os.Remove(backupName(f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(backupName(f.path, i), backupName(f.path, i+1))
+		}
+		if err := os.Rename(f.path, backupName(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Sync flushes the file
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_NewLogger_Redact(t *testing.T) {
+	tests := map[string]struct {
+		cfg  LogConfig
+		want string
+	}{
+		"Should log the message contents without redaction": {
+			cfg:  LogConfig{Format: LogFormatJSON},
+			want: `"msg":"jane@example.com signed up"`,
+		},
+		"Should hash the message contents": {
+			cfg:  LogConfig{Format: LogFormatJSON, Redact: RedactHash},
+			want: `"msg":"sha256:`,
+		},
+		"Should truncate the message contents": {
+			cfg:  LogConfig{Format: LogFormatJSON, Redact: RedactTruncate, Truncate: 4},
+			want: `"msg":"jane...(26 bytes)"`,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testCase.cfg.Output = filepath.Join(t.TempDir(), "notifier.log")
+			l, closeLog, err := NewLogger(testCase.cfg)
+			assert.NoError(t, err)
+			l.With(zap.String("key", "jane@example.com")).Info("notified", zap.String("msg", "jane@example.com signed up"), zap.String("destination", "ops"))
+			assert.NoError(t, closeLog())
+
+			b, err := os.ReadFile(testCase.cfg.Output)
+			assert.NoError(t, err)
+			assert.Contains(t, string(b), testCase.want)
+			assert.Contains(t, string(b), `"message":"notified"`)
+			assert.Contains(t, string(b), `"destination":"ops"`)
+			if testCase.cfg.Redact != "" {
+				assert.NotContains(t, string(b), "jane@example.com")
+			}
+		})
+	}
+}
+
+func Test_NewLogger_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifier.log")
+	l, closeLog, err := NewLogger(LogConfig{Level: "warn", Output: path, Sample: 2, Thereafter: 100})
+	assert.NoError(t, err)
+	l.Info("dropped by level")
+	for i := 0; i < 5; i++ {
+		l.Warn("retrying")
+	}
+	assert.NoError(t, closeLog())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "dropped by level")
+	assert.Equal(t, 2, strings.Count(string(b), "retrying"), "identical entries are sampled")
+	assert.NotContains(t, string(b), "\x1b[", "no colors in files")
+}
+
+func Test_NewLogger_SampleRedact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifier.log")
+	l, closeLog, err := NewLogger(LogConfig{Format: LogFormatJSON, Output: path, Sample: 1, Thereafter: 100, Redact: RedactHash})
+	assert.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		l.Info("notified", zap.String("msg", "jane@example.com signed up"))
+	}
+	assert.NoError(t, closeLog())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "notified"), "identical entries are sampled with redaction")
+	assert.NotContains(t, string(b), "jane@example.com")
+}
+
+func Test_NewLogger_Invalid(t *testing.T) {
+	for _, cfg := range []LogConfig{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Redact: "encrypt"},
+		{Output: filepath.Join(t.TempDir(), "missing", "notifier.log")},
+	} {
+		_, _, err := NewLogger(cfg)
+		assert.Error(t, err, cfg)
+	}
+}
+
+func Test_RotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifier.log")
+	f, err := NewRotatingFile(path, 1, 2)
+	assert.NoError(t, err)
+	line := []byte(strings.Repeat("x", 400*1024) + "\n")
+	for i := 0; i < 7; i++ {
+		_, err := f.Write(line)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+
+	// 2 lines fit in 1MB, the oldest backup is removed
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(1024*1024))
+	}
+	assert.NoFileExists(t, path+".3")
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(len(line)), info.Size())
+}
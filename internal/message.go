@@ -0,0 +1,154 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrExpired is returned when the message deadline passed before it was delivered
+var ErrExpired = errors.New("message expired")
+
+// ErrAborted is the cause of the messages dropped once the run is aborted
+var ErrAborted = errors.New("run aborted")
+
+// Priority of the message delivery, the zero value is normal priority
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityLow
+
+	priorityLevels = 3 // number of priority lanes
+)
+
+// ParsePriority returns the priority for the given name
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "high", "urgent", "critical", "0":
+		return PriorityHigh, nil
+	case "normal", "default", "1", "":
+		return PriorityNormal, nil
+	case "low", "bulk", "2":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, should be high, normal or low", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// Message is the envelope of a notification on its way from the producer to the workers
+type Message struct {
+	Body     string          // message content
+	Priority Priority        // delivery priority
+	Enqueued time.Time       // time the message was read from the input, or created on the way such as a digest
+	Queued   time.Time       // time the message was queued for the workers
+	Deadline time.Time       // time after which the message is expired instead of sent, never expires when zero
+	Span     *Span           // span of the message journey, not traced when nil
+	Abort    <-chan struct{} // closed once the run is aborted, cuts the retry waits short, never when nil
+}
+
+// NewMessage constructor, message has normal priority
+func NewMessage(body string) *Message {
+	return &Message{Body: body}
+}
+
+// Expired reports whether the message deadline passed
+func (m *Message) Expired(now time.Time) bool {
+	return !m.Deadline.IsZero() && !now.Before(m.Deadline)
+}
+
+// Envelope builds the message envelope of the bodies read from the input
+type Envelope struct {
+	TTL        time.Duration              // time to live of every message, no expiry when zero
+	TTLField   string                     // JSON field carrying the time to live of the message, e.g. "30s" or 30
+	PriorityOf func(body string) Priority // priority of the message, normal when nil
+	Clock      Clock                      // enqueue time source, real clock when nil
+	Tracer     *Tracer                    // starts the message spans, not traced when nil
+	TraceField string                     // JSON field carrying the traceparent or trace id to be continued
+}
+
+// Wrap returns the message envelope of the body, stamped with the current time as read time
+func (e *Envelope) Wrap(body string) *Message {
+	msg := NewMessage(body)
+	if e != nil {
+		e.stamp(msg)
+	}
+	return msg
+}
+
+// Queue completes the envelope of the message handed to the workers, the priority is taken from the final body
+// and the messages created on the way, e.g. digests, are stamped with the current time. The read span covering
+// the way from the input to the queue is ended
+func (e *Envelope) Queue(msg *Message) {
+	if e == nil {
+		return
+	}
+	if msg.Enqueued.IsZero() {
+		e.stamp(msg)
+	}
+	msg.Queued = orClock(e.Clock).Now()
+	msg.Span.ChildAt(SpanRead, msg.Span.Start()).End(nil)
+	if e.PriorityOf != nil {
+		msg.Priority = e.PriorityOf(msg.Body)
+	}
+	msg.Span.SetAttr("priority", msg.Priority.String())
+}
+
+// stamp sets the enqueue time, the deadline from the time to live and starts the span
+func (e *Envelope) stamp(msg *Message) {
+	msg.Enqueued = orClock(e.Clock).Now()
+	ttl := e.TTL
+	if e.TTLField != "" {
+		if v, ok := Field(msg.Body, e.TTLField); ok {
+			if d, err := ParseTTL(v); err == nil {
+				ttl = d
+			}
+		}
+	}
+	if ttl > 0 {
+		msg.Deadline = msg.Enqueued.Add(ttl)
+	}
+	if e.Tracer != nil && msg.Span == nil {
+		var parent TraceContext
+		if v, ok := Field(msg.Body, e.TraceField); ok && e.TraceField != "" {
+			parent, _ = ParseTraceContext(v) // a new trace is started on invalid context
+		}
+		msg.Span = e.Tracer.Start(SpanMessage, parent)
+	}
+}
+
+// discard drains the messages left in the channel of the previous stage until it is closed and returns their number,
+// it is called on cancellation to drop them
+func discard(in <-chan *Message) uint64 {
+	var n uint64
+	for range in {
+		n++
+	}
+	return n
+}
+
+// ParseTTL parses the time to live given as duration (e.g. 30s) or as number of seconds
+func ParseTTL(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,446 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxLatencySamples = 10000 // max number of latency samples kept for the report
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the request latency histogram
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects the notifier metrics and exposes them in the Prometheus text format,
+// every method is a no-op on a nil Metrics so that metrics are optional
+type Metrics struct {
+	read      *metricVec // messages read from the input
+	queued    *metricVec // messages queued for the workers by priority
+	inFlight  *metricVec // messages being sent by the workers
+	delivered *metricVec // messages delivered by destination and priority
+	failed    *metricVec // messages failed by destination and status class
+	expired   *metricVec // messages expired before delivery
+	dropped   *metricVec // messages dropped on shutdown
+	processed *metricVec // messages processed by the workers by outcome
+	retries   *metricVec // retries by destination
+	responses *metricVec // responses by destination and status code
+	latency   *histogramVec
+	depth     *metricVec // queue depth, computed on scrape
+	workers   *metricVec // worker pool size
+	busy      *metricVec // workers sending a message
+	busyTime  *metricVec // time the workers spent sending
+
+	mu      sync.Mutex
+	depths  map[string]func() int // queue depth by queue name
+	samples []float64             // latency samples in seconds for the percentiles of the report
+	seen    int                   // number of latencies observed
+}
+
+// NewMetrics constructor
+func NewMetrics() *Metrics {
+	return &Metrics{
+		read:      newMetricVec("notifier_messages_read_total", "Messages read from the input.", "counter"),
+		queued:    newMetricVec("notifier_messages_queued_total", "Messages queued for the workers.", "counter", "priority"),
+		inFlight:  newMetricVec("notifier_messages_in_flight", "Messages being sent by the workers.", "gauge"),
+		delivered: newMetricVec("notifier_messages_delivered_total", "Messages delivered.", "counter", "destination", "priority"),
+		failed:    newMetricVec("notifier_messages_failed_total", "Messages failed after all retries by status class.", "counter", "destination", "status_class"),
+		expired:   newMetricVec("notifier_messages_expired_total", "Messages expired before delivery.", "counter"),
+		dropped:   newMetricVec("notifier_messages_dropped_total", "Messages dropped on shutdown before delivery.", "counter"),
+		processed: newMetricVec("notifier_messages_processed_total", "Messages processed by the workers by outcome.", "counter", "outcome"),
+		retries:   newMetricVec("notifier_retries_total", "Retries of failed requests.", "counter", "destination"),
+		responses: newMetricVec("notifier_responses_total", "Responses by status code, error for network errors.", "counter", "destination", "code"),
+		latency:   newHistogramVec("notifier_request_duration_seconds", "Request latency.", DefaultLatencyBuckets, "destination"),
+		depth:     newMetricVec("notifier_queue_depth", "Messages waiting in the queue.", "gauge", "queue"),
+		workers:   newMetricVec("notifier_workers", "Worker pool size.", "gauge"),
+		busy:      newMetricVec("notifier_workers_busy", "Workers sending a message.", "gauge"),
+		busyTime:  newMetricVec("notifier_worker_busy_seconds_total", "Time the workers spent sending, utilization is its rate divided by the pool size.", "counter"),
+		depths:    map[string]func() int{},
+	}
+}
+
+// Read counts a message read from the input
+func (m *Metrics) Read() {
+	if m != nil {
+		m.read.add(1)
+	}
+}
+
+// Queued counts a message queued for the workers
+func (m *Metrics) Queued(p Priority) {
+	if m != nil {
+		m.queued.add(1, p.String())
+	}
+}
+
+// Delivered counts a message delivered to the destination
+func (m *Metrics) Delivered(destination string, p Priority) {
+	if m != nil {
+		m.delivered.add(1, destination, p.String())
+	}
+}
+
+// Failed counts a message which could not be delivered to the destination
+func (m *Metrics) Failed(destination string, err error) {
+	if m != nil {
+		m.failed.add(1, destination, StatusClass(err))
+	}
+}
+
+// Expired counts a message expired before delivery
+func (m *Metrics) Expired() {
+	if m != nil {
+		m.expired.add(1)
+	}
+}
+
+// Dropped counts the messages dropped on shutdown before delivery
+func (m *Metrics) Dropped(n uint64) {
+	if m != nil && n > 0 {
+		m.dropped.add(float64(n))
+	}
+}
+
+// Processed counts a message processed by a worker, the outcome is sent, failed, expired or partial
+func (m *Metrics) Processed(outcome string) {
+	if m != nil {
+		m.processed.add(1, outcome)
+	}
+}
+
+// Response counts a response of the destination, code is zero for network errors
+func (m *Metrics) Response(destination string, code int) {
+	if m != nil {
+		label := "error"
+		if code > 0 {
+			label = strconv.Itoa(code)
+		}
+		m.responses.add(1, destination, label)
+	}
+}
+
+// Retried counts a retry of the destination
+func (m *Metrics) Retried(destination string) {
+	if m != nil {
+		m.retries.add(1, destination)
+	}
+}
+
+// ObserveLatency records the duration of a request to the destination
+func (m *Metrics) ObserveLatency(destination string, d time.Duration) {
+	if m != nil {
+		m.latency.observe(d.Seconds(), destination)
+		m.sample(d.Seconds())
+	}
+}
+
+// sample keeps a uniform sample of the latencies, so that the memory is bounded on long runs
+func (m *Metrics) sample(seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seen++
+	if len(m.samples) < maxLatencySamples {
+		m.samples = append(m.samples, seconds)
+		return
+	}
+	if i := rand.Intn(m.seen); i < maxLatencySamples {
+		m.samples[i] = seconds
+	}
+}
+
+// SetWorkers records the worker pool size
+func (m *Metrics) SetWorkers(n int) {
+	if m != nil {
+		m.workers.set(float64(n))
+	}
+}
+
+// WorkerBusy records a worker starting to send a message
+func (m *Metrics) WorkerBusy() {
+	if m != nil {
+		m.busy.add(1)
+		m.inFlight.add(1)
+	}
+}
+
+// WorkerIdle records a worker done with a message after the busy duration
+func (m *Metrics) WorkerIdle(busy time.Duration) {
+	if m != nil {
+		m.busy.add(-1)
+		m.inFlight.add(-1)
+		m.busyTime.add(busy.Seconds())
+	}
+}
+
+// CountRead counts the lines received from in and passes them to out wrapped in the envelope as they are read,
+// so that the time spent on the way to the workers counts towards the time to live, until in is closed or the context
+// is cancelled. The line being passed on is dropped on cancellation and out is closed once it returns
+func (m *Metrics) CountRead(ctx context.Context, in <-chan string, out chan<- *Message, envelope *Envelope) {
+	defer close(out)
+	for {
+		select {
+		case body, ok := <-in:
+			if !ok {
+				return
+			}
+			m.Read()
+			select {
+			case out <- envelope.Wrap(body):
+			case <-ctx.Done():
+				m.Dropped(1)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// QueueDepth registers the function returning the depth of the queue, called on scrape
+func (m *Metrics) QueueDepth(queue string, depth func() int) {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.depths[queue] = depth
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	for queue, depth := range m.depths {
+		m.depth.set(float64(depth()), queue)
+	}
+	m.mu.Unlock()
+	var b strings.Builder
+	for _, vec := range []*metricVec{m.read, m.queued, m.inFlight, m.delivered, m.failed, m.expired, m.dropped, m.processed, m.retries, m.responses} {
+		vec.write(&b)
+	}
+	m.latency.write(&b)
+	for _, vec := range []*metricVec{m.depth, m.workers, m.busy, m.busyTime} {
+		vec.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for scraping
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// Serve exposes the metrics on /metrics of the address until the context is cancelled
+func (m *Metrics) Serve(ctx context.Context, logger *zap.Logger, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Info("serving metrics", zap.String("addr", ln.Addr().String()))
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// StatusClass returns the status class of the delivery outcome, e.g. 2xx, 5xx, expired or error for network errors
+func StatusClass(err error) string {
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		return "2xx"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.As(err, &statusErr):
+		return strconv.Itoa(statusErr.StatusCode/100) + "xx"
+	}
+	return "error"
+}
+
+// metricVec is a counter or gauge family with its series by label values
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]float64 // values by label values joined with \xff
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+func (v *metricVec) set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[strings.Join(labelValues, "\xff")] = value
+}
+
+// total returns the sum of the series
+func (v *metricVec) total() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var total float64
+	for _, value := range v.values {
+		total += value
+	}
+	return total
+}
+
+// sumBy returns the sum of the series by the value of the label
+func (v *metricVec) sumBy(label string) map[string]float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	index := -1
+	for i, name := range v.labels {
+		if name == label {
+			index = i
+		}
+	}
+	sums := map[string]float64{}
+	for key, value := range v.values {
+		sums[strings.Split(key, "\xff")[index]] += value
+	}
+	return sums
+}
+
+func (v *metricVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	// the series without labels is always exposed, starting at zero
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		fmt.Fprintf(b, "%s 0\n", v.name)
+	}
+	for _, key := range sortedKeys(v.values) {
+		var labelValues []string
+		if len(v.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		fmt.Fprintf(b, "%s%s %s\n", v.name, labelPairs(v.labels, labelValues), formatFloat(v.values[key]))
+	}
+}
+
+// histogram is a single histogram series
+type histogram struct {
+	counts []uint64 // cumulative counts are computed on write
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram family with its series by label values
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogram{}}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.series[key] = h
+	}
+	if i := sort.SearchFloat64s(v.buckets, value); i < len(v.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v *histogramVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.series[key]
+		var labelValues []string
+		if len(v.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		bucketLabels := append(append([]string{}, v.labels...), "le")
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += h.counts[i]
+			labels := labelPairs(bucketLabels, append(append([]string{}, labelValues...), formatFloat(le)))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, labels, cumulative)
+		}
+		labels := labelPairs(bucketLabels, append(append([]string{}, labelValues...), "+Inf"))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, labels, h.count)
+		labels = labelPairs(v.labels, labelValues)
+		fmt.Fprintf(b, "%s_sum%s %s\n%s_count%s %d\n", v.name, labels, formatFloat(h.sum), v.name, labels, h.count)
+	}
+}
+
+// labelPairs encodes the label names and values, e.g. {destination="ops",priority="high"}
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
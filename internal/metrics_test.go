@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_Metrics_WriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.SetWorkers(5)
+	m.Read()
+	m.Read()
+	m.Queued(PriorityHigh)
+	m.Queued(PriorityNormal)
+	m.Delivered("ops", PriorityHigh)
+	m.Failed("ops", &StatusError{StatusCode: 503})
+	m.Failed("chat", errors.New("connection refused"))
+	m.Retried("ops")
+	m.Processed(OutcomeSent)
+	m.Dropped(2)
+	m.Response("ops", 503)
+	m.ObserveLatency("ops", 30*time.Millisecond)
+	m.ObserveLatency("ops", 2*time.Second)
+	m.WorkerBusy()
+	m.WorkerBusy()
+	m.WorkerIdle(1500 * time.Millisecond)
+	m.QueueDepth("producer", func() int { return 3 })
+
+	var b strings.Builder
+	_, err := m.WriteTo(&b)
+	assert.NoError(t, err)
+	got := b.String()
+	for _, want := range []string{
+		"# TYPE notifier_messages_read_total counter\nnotifier_messages_read_total 2\n",
+		`notifier_messages_queued_total{priority="high"} 1`,
+		`notifier_messages_queued_total{priority="normal"} 1`,
+		"notifier_messages_in_flight 1\n",
+		`notifier_messages_delivered_total{destination="ops",priority="high"} 1`,
+		`notifier_messages_failed_total{destination="chat",status_class="error"} 1`,
+		`notifier_messages_failed_total{destination="ops",status_class="5xx"} 1`,
+		"notifier_messages_expired_total 0\n",
+		"# TYPE notifier_messages_dropped_total counter\nnotifier_messages_dropped_total 2\n",
+		`notifier_retries_total{destination="ops"} 1`,
+		`notifier_messages_processed_total{outcome="sent"} 1`,
+		`notifier_responses_total{destination="ops",code="503"} 1`,
+		"# TYPE notifier_request_duration_seconds histogram\n",
+		`notifier_request_duration_seconds_bucket{destination="ops",le="0.025"} 0`,
+		`notifier_request_duration_seconds_bucket{destination="ops",le="0.05"} 1`,
+		`notifier_request_duration_seconds_bucket{destination="ops",le="2.5"} 2`,
+		`notifier_request_duration_seconds_bucket{destination="ops",le="+Inf"} 2`,
+		`notifier_request_duration_seconds_sum{destination="ops"} 2.03`,
+		`notifier_request_duration_seconds_count{destination="ops"} 2`,
+		`notifier_queue_depth{queue="producer"} 3`,
+		"notifier_workers 5\n",
+		"notifier_workers_busy 1\n",
+		"notifier_worker_busy_seconds_total 1.5\n",
+	} {
+		assert.Contains(t, got, want)
+	}
+}
+
+func Test_Metrics_Nil(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.Read()
+		m.Queued(PriorityLow)
+		m.Delivered("ops", PriorityLow)
+		m.Failed("ops", nil)
+		m.Processed(OutcomeFailed)
+		m.Response("ops", 0)
+		m.ObserveLatency("ops", time.Second)
+		m.WorkerBusy()
+		m.WorkerIdle(time.Second)
+		m.QueueDepth("producer", func() int { return 0 })
+	})
+}
+
+func Test_StatusClass(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"Should be 2xx on success":            {err: nil, want: "2xx"},
+		"Should be the status code class":     {err: &StatusError{StatusCode: 429}, want: "4xx"},
+		"Should be expired on expiry":         {err: ErrExpired, want: "expired"},
+		"Should unwrap the destination error": {err: DestinationErrors{{Destination: "ops", Err: &StatusError{StatusCode: 502}}}, want: "5xx"},
+		"Should be error on network errors":   {err: io.ErrUnexpectedEOF, want: "error"},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.want, StatusClass(testCase.err))
+		})
+	}
+}
+
+func Test_Metrics_Delivery(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	m := NewMetrics()
+	retry := RetryPolicy{Attempts: 1, Backoff: time.Millisecond}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "ops", URL: srv.URL, Retry: &retry, Metrics: m})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Notify(&Message{Body: "msg1", Priority: PriorityHigh}))
+	assert.Error(t, client.Notify(NewMessage("msg2")))
+
+	// metrics are scraped over http
+	scrape := httptest.NewServer(m)
+	defer scrape.Close()
+	resp, err := http.Get(scrape.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	b, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`notifier_messages_delivered_total{destination="ops",priority="high"} 1`,
+		`notifier_messages_failed_total{destination="ops",status_class="4xx"} 1`,
+		`notifier_retries_total{destination="ops"} 1`,
+		`notifier_request_duration_seconds_count{destination="ops"} 3`,
+		`notifier_responses_total{destination="ops",code="503"} 1`,
+		`notifier_responses_total{destination="ops",code="400"} 1`,
+	} {
+		assert.Contains(t, string(b), want)
+	}
+}
@@ -21,4 +21,7 @@ type httpClientMock struct {
 	mock.Mock
 }
 
-func (n *httpClientMock) Notify(msg string) { n.Called() }
+func (n *httpClientMock) Notify(msg *Message) error {
+	n.Called()
+	return nil
+}
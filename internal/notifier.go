@@ -8,61 +8,370 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// Notifier is the interface that groups the Start and Process methods
+// DefaultLaneCapacity is the number of messages queued per worker lane, the input blocks once the lane is full
+const DefaultLaneCapacity = 10
+
+// Notifier is the interface that groups the Start, Process, Abort, Expired, Dropped and Depth methods
 type Notifier interface {
 	Process(wg *sync.WaitGroup, workerID int)
 	Start(ctx context.Context)
+	Abort()
+	Expired() uint64
+	Dropped() uint64
+	Depth() int
+}
+
+// NotifierConfig holds the options shared by every notifier mode
+type NotifierConfig struct {
+	Envelope   *Envelope                     // completes the message envelope with the priority, plain message when nil
+	DeadLetter DeadLetter                    // records the expired and failed messages, disabled when nil
+	Clock      Clock                         // interval and expiry time source, real clock when nil
+	Metrics    *Metrics                      // queue and worker metrics, disabled when nil
+	OnSent     func(msg *Message)            // called when a message was delivered
+	OnFailed   func(msg *Message, err error) // called when a message failed after all retries, e.g. to abort the run
 }
 
 // notifier type
 type notifier struct {
-	logger       *zap.Logger   // logger
-	httpClient   HttpClient    // http client for sending notification
-	interval     time.Duration // interval in which notification to be sent
-	producerChan chan string   // channel to receive from stdio
-	consumerChan chan string   // chanel to consume the data
-
+	logger       *zap.Logger     // logger
+	httpClient   HttpClient      // http client for sending notification
+	interval     time.Duration   // interval in which notification to be sent
+	producerChan chan *Message   // channel to receive from stdio
+	consumerChan chan *Message   // chanel to consume the data
+	lanes        []chan *Message // dedicated channel per worker in ordered mode
+	inboxes      []chan *Message // messages of the lanes, held back while the worker of the lane is busy
+	held         int64           // number of held back messages
+	partitionKey string          // JSON field hashed onto the lanes, whole line when empty
+	queue        PriorityQueue   // priority lanes in priority mode
+	envelope     *Envelope       // completes the message envelope
+	deadLetter   DeadLetter      // records the expired and failed messages
+	expired      uint64          // number of expired messages
+	dropped      uint64          // number of messages dropped on cancellation or once aborted
+	aborted      int32           // set once the run is aborted, the queued messages are dropped
+	abort        chan struct{}   // closed once the run is aborted, interrupts the retry waits
+	abortOnce    sync.Once
+	clock        Clock                         // interval and expiry time source
+	metrics      *Metrics                      // queue and worker metrics
+	onSent       func(msg *Message)            // called when a message was delivered
+	onFailed     func(msg *Message, err error) // called when a message failed after all retries
 }
 
 // NewNotifier constructor
-func NewNotifier(logger *zap.Logger, httpClient HttpClient, interval time.Duration, producerChan, consumerChan chan string) Notifier {
+func NewNotifier(logger *zap.Logger, httpClient HttpClient, interval time.Duration, producerChan chan *Message, consumerChan chan *Message, cfg NotifierConfig) Notifier {
 	return &notifier{
 		logger:       logger,
 		interval:     interval,
 		producerChan: producerChan,
 		consumerChan: consumerChan,
 		httpClient:   httpClient,
+		envelope:     cfg.Envelope,
+		deadLetter:   cfg.DeadLetter,
+		clock:        orClock(cfg.Clock),
+		metrics:      cfg.Metrics,
+		onSent:       cfg.OnSent,
+		onFailed:     cfg.OnFailed,
+		abort:        make(chan struct{}),
 	}
 }
 
-// Process starts the worker process based on the number items in the consumer channel until it closes
+// NewOrderedNotifier constructor, messages with the same partition key are hashed onto the same lane
+// and delivered strictly in order by the worker of the lane, while different lanes run in parallel
+func NewOrderedNotifier(logger *zap.Logger, httpClient HttpClient, interval time.Duration, producerChan chan *Message, lanes []chan *Message, partitionKey string, cfg NotifierConfig) Notifier {
+	inboxes := make([]chan *Message, len(lanes))
+	for i := range inboxes {
+		inboxes[i] = make(chan *Message)
+	}
+	return &notifier{
+		logger:       logger,
+		interval:     interval,
+		producerChan: producerChan,
+		lanes:        lanes,
+		inboxes:      inboxes,
+		partitionKey: partitionKey,
+		httpClient:   httpClient,
+		envelope:     cfg.Envelope,
+		deadLetter:   cfg.DeadLetter,
+		clock:        orClock(cfg.Clock),
+		metrics:      cfg.Metrics,
+		onSent:       cfg.OnSent,
+		onFailed:     cfg.OnFailed,
+		abort:        make(chan struct{}),
+	}
+}
+
+// NewPriorityNotifier constructor, messages are queued on the lane of their priority
+// and the workers serve the high priority lanes first
+func NewPriorityNotifier(logger *zap.Logger, httpClient HttpClient, interval time.Duration, producerChan chan *Message, queue PriorityQueue, cfg NotifierConfig) Notifier {
+	return &notifier{
+		logger:       logger,
+		interval:     interval,
+		producerChan: producerChan,
+		queue:        queue,
+		httpClient:   httpClient,
+		envelope:     cfg.Envelope,
+		deadLetter:   cfg.DeadLetter,
+		clock:        orClock(cfg.Clock),
+		metrics:      cfg.Metrics,
+		onSent:       cfg.OnSent,
+		onFailed:     cfg.OnFailed,
+		abort:        make(chan struct{}),
+	}
+}
+
+// Process starts the worker process based on the number items in the consumer channel until it closes,
+// in ordered mode the worker consumes its own lane and in priority mode the priority queue
 func (n *notifier) Process(wg *sync.WaitGroup, workerID int) {
 	defer wg.Done()
-	for job := range n.consumerChan {
-		<-time.After(n.interval) // wait for the provided interval
-		n.logger.Debug("starting job", zap.Int("workerID", workerID))
-		n.httpClient.Notify(job) // call http client to make notification
+	if n.queue != nil {
+		for job, ok := n.queue.Pop(); ok; job, ok = n.queue.Pop() {
+			n.notify(job, workerID)
+		}
+		n.logger.Warn("gracefully finishing job", zap.Int("workerID", workerID))
+		return
+	}
+	consumerChan := n.consumerChan
+	if len(n.lanes) > 0 {
+		consumerChan = n.lanes[(workerID-1)%len(n.lanes)]
+	}
+	for job := range consumerChan {
+		n.notify(job, workerID)
 	}
 	n.logger.Warn("gracefully finishing job", zap.Int("workerID", workerID))
 }
 
-// Start acts as a proxy between producer and consumer channel,also supports the graceful cancellation
+func (n *notifier) notify(job *Message, workerID int) {
+	if n.abandon(job) {
+		return
+	}
+	<-n.clock.After(n.interval) // wait for the provided interval
+	if n.abandon(job) {
+		return
+	}
+	job.Span.ChildAt(SpanQueued, job.Queued).End(nil)
+	if job.Expired(n.clock.Now()) {
+		n.expire(job, ErrExpired)
+		return
+	}
+	n.logger.Debug("starting job", zap.Int("workerID", workerID), zap.Stringer("priority", job.Priority))
+	n.metrics.WorkerBusy()
+	start := n.clock.Now()
+	job.Abort = n.abort
+	err := n.httpClient.Notify(job) // call http client to make notification
+	n.metrics.WorkerIdle(n.clock.Now().Sub(start))
+	switch {
+	case err == nil:
+		n.metrics.Processed(OutcomeSent)
+		job.Span.SetAttr("outcome", OutcomeSent)
+		job.Span.End(nil)
+		if n.onSent != nil {
+			n.onSent(job)
+		}
+	case errors.Is(err, ErrExpired):
+		n.expire(job, err)
+	case errors.Is(err, ErrAborted):
+		n.drop(job, err)
+	case errors.Is(err, ErrPartialDelivery):
+		n.metrics.Processed(OutcomePartial)
+		job.Span.SetAttr("outcome", OutcomePartial)
+		job.Span.End(err)
+		n.writeDeadLetter(job, DeadLetterPartial, err)
+		if n.onFailed != nil {
+			n.onFailed(job, err)
+		}
+	default:
+		n.metrics.Processed(OutcomeFailed)
+		job.Span.SetAttr("outcome", OutcomeFailed)
+		job.Span.End(err)
+		n.writeDeadLetter(job, DeadLetterFailed, err)
+		if n.onFailed != nil {
+			n.onFailed(job, err)
+		}
+	}
+}
+
+// abandon drops the message instead of sending it once the run is aborted
+func (n *notifier) abandon(job *Message) bool {
+	if atomic.LoadInt32(&n.aborted) == 0 {
+		return false
+	}
+	n.drop(job, ErrAborted)
+	return true
+}
+
+// drop counts the message as dropped once the run is aborted
+func (n *notifier) drop(job *Message, err error) {
+	atomic.AddUint64(&n.dropped, 1)
+	job.Span.SetAttr("outcome", OutcomeDropped)
+	job.Span.End(err)
+}
+
+// expire drops the stale message instead of sending it
+func (n *notifier) expire(job *Message, err error) {
+	atomic.AddUint64(&n.expired, 1)
+	n.metrics.Expired()
+	n.metrics.Processed(OutcomeExpired)
+	job.Span.SetAttr("outcome", OutcomeExpired)
+	job.Span.End(err)
+	n.logger.Warn("message expired", zap.Stringer("priority", job.Priority), zap.Duration("age", n.clock.Now().Sub(job.Enqueued)))
+	n.writeDeadLetter(job, DeadLetterExpired, err)
+}
+
+func (n *notifier) writeDeadLetter(job *Message, reason string, cause error) {
+	if n.deadLetter == nil {
+		return
+	}
+	if err := n.deadLetter.Write(job, reason, cause); err != nil {
+		n.logger.Error("failed to write dead-letter", zap.String("reason", reason), zap.Error(err))
+	}
+}
+
+// Abort stops the deliveries, the messages queued for the workers are dropped instead of sent
+// while the deliveries in progress are completed without waiting to retry them
+func (n *notifier) Abort() {
+	atomic.StoreInt32(&n.aborted, 1)
+	n.abortOnce.Do(func() { close(n.abort) })
+}
+
+// Expired returns the number of expired messages
+func (n *notifier) Expired() uint64 {
+	return atomic.LoadUint64(&n.expired)
+}
+
+// Dropped returns the number of messages dropped on cancellation or once aborted
+func (n *notifier) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// Depth returns the number of messages waiting for the workers
+func (n *notifier) Depth() int {
+	switch {
+	case n.queue != nil:
+		return n.queue.Len(PriorityHigh) + n.queue.Len(PriorityNormal) + n.queue.Len(PriorityLow)
+	case len(n.lanes) > 0:
+		depth := int(atomic.LoadInt64(&n.held))
+		for _, lane := range n.lanes {
+			depth += len(lane)
+		}
+		return depth
+	}
+	return len(n.consumerChan)
+}
+
+// Start acts as a proxy between producer and consumer channel,also supports the graceful cancellation,
+// once cancelled the messages left in the producer channel are dropped until it is closed
 func (n *notifier) Start(ctx context.Context) {
+	for i, lane := range n.lanes {
+		go n.holdBack(ctx, n.inboxes[i], lane)
+	}
+	if n.queue != nil {
+		// unblock the push to a full bounded lane on cancellation
+		go func() {
+			<-ctx.Done()
+			n.queue.Close()
+		}()
+	}
 	for {
 		select {
-		case job := <-n.producerChan: // fetch job from producer
+		case job, ok := <-n.producerChan: // fetch job from producer
+			if !ok {
+				n.stop()
+				return
+			}
 			n.logger.Debug("received msg from consumerChan")
-			n.consumerChan <- job // pass job to consumer
+			n.envelope.Queue(job)
+			n.metrics.Queued(job.Priority)
+			if n.queue != nil {
+				if !n.queue.Push(job) {
+					atomic.AddUint64(&n.dropped, 1) // closed on cancellation
+				}
+				continue
+			}
+			if len(n.lanes) == 0 {
+				n.consumerChan <- job // pass job to consumer
+				continue
+			}
+			select {
+			case n.inboxFor(job) <- job: // pass job to the lane
+			case <-ctx.Done():
+				atomic.AddUint64(&n.dropped, 1)
+			}
 		case <-ctx.Done():
 			n.logger.Warn("received context cancellation......")
-			close(n.consumerChan) // when context is done, close the consumer channel
+			n.stop()
+			if dropped := discard(n.producerChan); dropped > 0 {
+				n.logger.Warn("dropping queued messages", zap.Uint64("dropped", dropped))
+				atomic.AddUint64(&n.dropped, dropped)
+			}
+			return
+		}
+	}
+}
+
+// stop closes the consumer channels, the lanes are closed once their messages are passed
+func (n *notifier) stop() {
+	switch {
+	case n.queue != nil:
+		n.queue.Close()
+	case len(n.lanes) == 0:
+		close(n.consumerChan)
+	}
+}
+
+// holdBack passes the messages of the inbox to the lane in order, they are held back while the worker of the lane
+// is busy so that a retrying lane never blocks the others, up to DefaultLaneCapacity messages after which the inbox
+// blocks the input until the worker catches up, the held back messages are dropped on cancellation
+func (n *notifier) holdBack(ctx context.Context, inbox <-chan *Message, lane chan<- *Message) {
+	defer close(lane)
+	var held []*Message
+	for {
+		var (
+			next *Message
+			out  chan<- *Message // nil while nothing is held back
+			in   = inbox         // nil while the lane is full
+		)
+		if len(held) > 0 {
+			next, out = held[0], lane
+		}
+		if len(held) >= DefaultLaneCapacity {
+			in = nil
+		}
+		select {
+		case job := <-in:
+			held = append(held, job)
+			atomic.AddInt64(&n.held, 1)
+		case out <- next:
+			held[0] = nil
+			held = held[1:]
+			atomic.AddInt64(&n.held, -1)
+		case <-ctx.Done():
+			if len(held) > 0 {
+				n.logger.Warn("dropping held back messages", zap.Int("dropped", len(held)))
+				atomic.AddUint64(&n.dropped, uint64(len(held)))
+				atomic.AddInt64(&n.held, -int64(len(held)))
+			}
 			return
 		}
 	}
 }
+
+// inboxFor returns the inbox of the lane of the job, the lane is picked by the partition key hash
+func (n *notifier) inboxFor(job *Message) chan *Message {
+	key := job.Body
+	if n.partitionKey != "" {
+		if v, ok := Field(job.Body, n.partitionKey); ok {
+			key = v
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return n.inboxes[h.Sum32()%uint32(len(n.inboxes))]
+}
@@ -2,9 +2,12 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,7 +18,7 @@ func Test_notifier_Process(t *testing.T) {
 	tests := map[string]struct {
 		httpClientFunc func(*httpClientMock) HttpClient
 		interval       time.Duration
-		consumerChan   chan string
+		consumerChan   chan *Message
 		data           []string
 		want           int
 	}{
@@ -25,7 +28,7 @@ func Test_notifier_Process(t *testing.T) {
 				return client
 			},
 			interval:     time.Nanosecond,
-			consumerChan: make(chan string),
+			consumerChan: make(chan *Message),
 			data:         []string{"msg1"},
 			want:         1,
 		},
@@ -35,7 +38,7 @@ func Test_notifier_Process(t *testing.T) {
 				return client
 			},
 			interval:     time.Nanosecond,
-			consumerChan: make(chan string),
+			consumerChan: make(chan *Message),
 			data:         []string{"msg1", "msg2", "msg3", "msg4", "msg5"},
 			want:         5,
 		},
@@ -47,6 +50,7 @@ func Test_notifier_Process(t *testing.T) {
 				logger:       zap.NewNop(),
 				interval:     testCase.interval,
 				consumerChan: testCase.consumerChan,
+				clock:        NewClock(),
 			}
 			if testCase.httpClientFunc != nil {
 				n.httpClient = testCase.httpClientFunc(client)
@@ -55,7 +59,7 @@ func Test_notifier_Process(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				for _, i := range testCase.data {
-					testCase.consumerChan <- i
+					testCase.consumerChan <- NewMessage(i)
 				}
 				close(testCase.consumerChan)
 			}()
@@ -75,32 +79,32 @@ func Test_notifier_Start(t *testing.T) {
 	tests := map[string]struct {
 		ctx          context.Context
 		cancelFunc   context.CancelFunc
-		producerChan chan string
-		consumerChan chan string
+		producerChan chan *Message
+		consumerChan chan *Message
 		data         []string
 		want         int
 	}{
 		"Should successfully msg received on consumer channel when single msg passed to producer channel": {
 			ctx:          ctx1,
 			cancelFunc:   cancel1,
-			producerChan: make(chan string),
-			consumerChan: make(chan string, 1),
+			producerChan: make(chan *Message),
+			consumerChan: make(chan *Message, 1),
 			data:         []string{"msg1"},
 			want:         1,
 		},
 		"Should successfully msg received on consumer channel when multiple msg passed to producer channel": {
 			ctx:          ctx2,
 			cancelFunc:   cancel2,
-			producerChan: make(chan string, 1),
-			consumerChan: make(chan string, 3),
+			producerChan: make(chan *Message, 1),
+			consumerChan: make(chan *Message, 3),
 			data:         []string{"msg1", "msg2", "msg3"},
 			want:         3,
 		},
 		"Should not fail  when no msg passed to producer channel": {
 			ctx:          ctx3,
 			cancelFunc:   cancel3,
-			producerChan: make(chan string, 1),
-			consumerChan: make(chan string, 1),
+			producerChan: make(chan *Message, 1),
+			consumerChan: make(chan *Message, 1),
 			data:         []string{},
 			want:         0,
 		},
@@ -112,6 +116,7 @@ func Test_notifier_Start(t *testing.T) {
 				interval:     1 * time.Nanosecond,
 				producerChan: testCase.producerChan,
 				consumerChan: testCase.consumerChan,
+				clock:        NewClock(),
 			}
 			wg := new(sync.WaitGroup)
 			wg.Add(1)
@@ -121,12 +126,485 @@ func Test_notifier_Start(t *testing.T) {
 			}()
 
 			for _, i := range testCase.data {
-				testCase.producerChan <- i
+				testCase.producerChan <- NewMessage(i)
 			}
 			testCase.cancelFunc()
+			close(testCase.producerChan) // the producer stops on cancellation
 			wg.Wait()
-			assert.Equal(t, testCase.want, len(testCase.consumerChan))
+			// a message still on the producer channel at cancellation is dropped
+			assert.Equal(t, testCase.want, len(testCase.consumerChan)+int(n.Dropped()))
 		})
 
 	}
 }
+
+// recordingClient records the notified messages in order
+type recordingClient struct {
+	mu    sync.Mutex
+	delay func(msg string) time.Duration
+	err   func(msg string) error
+	msgs  []string
+}
+
+func (r *recordingClient) Notify(msg *Message) error {
+	if r.delay != nil {
+		time.Sleep(r.delay(msg.Body))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg.Body)
+	if r.err != nil {
+		return r.err(msg.Body)
+	}
+	return nil
+}
+
+func Test_notifier_Ordered(t *testing.T) {
+	tests := map[string]struct {
+		partitionKey string
+		data         []string
+		keyOf        func(msg string) string
+	}{
+		"Should deliver messages of the same json field in order": {
+			partitionKey: "id",
+			data: []string{
+				`{"id":"a","seq":1}`, `{"id":"b","seq":1}`, `{"id":"a","seq":2}`, `{"id":"c","seq":1}`,
+				`{"id":"b","seq":2}`, `{"id":"a","seq":3}`, `{"id":"c","seq":2}`, `{"id":"b","seq":3}`,
+			},
+			keyOf: func(msg string) string {
+				v, _ := Field(msg, "id")
+				return v
+			},
+		},
+		"Should deliver the same lines in order": {
+			data:  []string{"x", "y", "x", "z", "y", "x"},
+			keyOf: func(msg string) string { return msg },
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			// the first message of every key is slow, so that an unordered delivery would overtake it
+			seen := map[string]bool{}
+			delays := map[string]time.Duration{}
+			for _, msg := range testCase.data {
+				if key := testCase.keyOf(msg); !seen[key] {
+					seen[key] = true
+					delays[msg] = 20 * time.Millisecond
+				}
+			}
+			client := &recordingClient{delay: func(msg string) time.Duration { return delays[msg] }}
+
+			lanes := make([]chan *Message, 3)
+			for i := range lanes {
+				lanes[i] = make(chan *Message, 1)
+			}
+			producerChan := make(chan *Message)
+			n := NewOrderedNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, lanes, testCase.partitionKey, NotifierConfig{})
+			ctx, cancel := context.WithCancel(context.Background())
+			go n.Start(ctx)
+			wg := new(sync.WaitGroup)
+			wg.Add(len(lanes))
+			for i := 1; i <= len(lanes); i++ {
+				go n.Process(wg, i)
+			}
+			for _, msg := range testCase.data {
+				producerChan <- NewMessage(msg)
+			}
+			for len(client.snapshot()) < len(testCase.data) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			wg.Wait()
+
+			perKey := func(msgs []string) map[string][]string {
+				out := map[string][]string{}
+				for _, msg := range msgs {
+					out[testCase.keyOf(msg)] = append(out[testCase.keyOf(msg)], msg)
+				}
+				return out
+			}
+			assert.Equal(t, perKey(testCase.data), perKey(client.snapshot()))
+		})
+	}
+}
+
+func (r *recordingClient) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.msgs...)
+}
+
+// deadLetterRecorder records the dead-letter reasons per message
+type deadLetterRecorder struct {
+	mu      sync.Mutex
+	reasons map[string]string
+}
+
+func (d *deadLetterRecorder) Write(msg *Message, reason string, _ error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reasons[msg.Body] = reason
+	return nil
+}
+
+func (d *deadLetterRecorder) Close() error { return nil }
+
+func Test_notifier_Expire(t *testing.T) {
+	now := time.Now()
+	client := &recordingClient{err: func(msg string) error {
+		switch msg {
+		case "retrying":
+			return fmt.Errorf("%w after 2 attempts", ErrExpired)
+		case "failing":
+			return &StatusError{StatusCode: 500}
+		case "partial":
+			return &PartialDeliveryError{Delivered: []string{"ops"}, Errors: DestinationErrors{{Destination: "pager", Err: ErrExpired}}}
+		}
+		return nil
+	}}
+	deadLetter := &deadLetterRecorder{reasons: map[string]string{}}
+	var sent, failed []string
+	onSent := func(msg *Message) { sent = append(sent, msg.Body) }
+	onFailed := func(msg *Message, err error) { failed = append(failed, msg.Body) }
+	consumerChan := make(chan *Message, 6)
+	n := NewNotifier(zap.NewNop(), client, time.Nanosecond, nil, consumerChan, NotifierConfig{DeadLetter: deadLetter, OnSent: onSent, OnFailed: onFailed})
+	consumerChan <- &Message{Body: "stale", Deadline: now.Add(-time.Second)}
+	consumerChan <- &Message{Body: "fresh", Deadline: now.Add(time.Hour)}
+	consumerChan <- &Message{Body: "retrying", Deadline: now.Add(time.Hour)}
+	consumerChan <- &Message{Body: "failing"}
+	consumerChan <- NewMessage("partial")
+	consumerChan <- NewMessage("forever")
+	close(consumerChan)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	n.Process(wg, 1)
+
+	assert.Equal(t, []string{"fresh", "retrying", "failing", "partial", "forever"}, client.snapshot())
+	assert.Equal(t, uint64(2), n.Expired(), "partially delivered messages are not expired")
+	assert.Equal(t, map[string]string{
+		"stale": DeadLetterExpired, "retrying": DeadLetterExpired, "failing": DeadLetterFailed, "partial": DeadLetterPartial,
+	}, deadLetter.reasons)
+	assert.Equal(t, []string{"fresh", "forever"}, sent)
+	assert.Equal(t, []string{"failing", "partial"}, failed, "only permanent failures are reported")
+}
+
+func Test_Envelope_Wrap(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		envelope *Envelope
+		body     string
+		want     *Message
+	}{
+		"Should not expire without ttl": {
+			envelope: nil,
+			body:     "msg",
+			want:     &Message{Body: "msg"},
+		},
+		"Should use the global ttl": {
+			envelope: &Envelope{TTL: time.Minute, Clock: NewFakeClock(now)},
+			body:     "msg",
+			want:     &Message{Body: "msg", Enqueued: now, Deadline: now.Add(time.Minute)},
+		},
+		"Should prefer the ttl field in seconds": {
+			envelope: &Envelope{TTL: time.Minute, TTLField: "ttl", Clock: NewFakeClock(now)},
+			body:     `{"ttl":5}`,
+			want:     &Message{Body: `{"ttl":5}`, Enqueued: now, Deadline: now.Add(5 * time.Second)},
+		},
+		"Should parse the ttl field as duration": {
+			envelope: &Envelope{TTLField: "meta.ttl", Clock: NewFakeClock(now)},
+			body:     `{"meta":{"ttl":"2h"}}`,
+			want:     &Message{Body: `{"meta":{"ttl":"2h"}}`, Enqueued: now, Deadline: now.Add(2 * time.Hour)},
+		},
+		"Should fall back to the global ttl when the field is invalid": {
+			envelope: &Envelope{TTL: time.Minute, TTLField: "ttl", Clock: NewFakeClock(now)},
+			body:     `{"ttl":"soon"}`,
+			want:     &Message{Body: `{"ttl":"soon"}`, Enqueued: now, Deadline: now.Add(time.Minute)},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.want, testCase.envelope.Wrap(testCase.body))
+		})
+	}
+}
+
+func Test_Envelope_Queue(t *testing.T) {
+	read := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(read)
+	envelope := &Envelope{TTL: time.Minute, PriorityOf: func(body string) Priority {
+		if body == "urgent" {
+			return PriorityHigh
+		}
+		return PriorityLow
+	}, Clock: clock}
+	msg := envelope.Wrap("bulk")
+	clock.Advance(time.Second)
+
+	// the read time is kept and the priority is taken from the final body
+	msg.Body = "urgent"
+	envelope.Queue(msg)
+	queued := read.Add(time.Second)
+	assert.Equal(t, &Message{Body: "urgent", Priority: PriorityHigh, Enqueued: read, Queued: queued, Deadline: read.Add(time.Minute)}, msg)
+
+	// a message created on the way is stamped when queued
+	digest := NewMessage("digest")
+	envelope.Queue(digest)
+	assert.Equal(t, &Message{Body: "digest", Priority: PriorityLow, Enqueued: queued, Queued: queued, Deadline: queued.Add(time.Minute)}, digest)
+}
+
+func Test_notifier_Interval(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	client := &recordingClient{}
+	consumerChan := make(chan *Message, 2)
+	n := NewNotifier(zap.NewNop(), client, time.Minute, nil, consumerChan, NotifierConfig{Clock: clock})
+	consumerChan <- &Message{Body: "msg1", Deadline: clock.Now().Add(90 * time.Second)}
+	consumerChan <- &Message{Body: "msg2", Deadline: clock.Now().Add(90 * time.Second)}
+	close(consumerChan)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+
+	// the message is sent once the interval passed
+	waitBlocked(clock)
+	clock.Advance(59 * time.Second)
+	assert.Empty(t, client.snapshot())
+	clock.Advance(time.Second)
+	for len(client.snapshot()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the deadline of the next message passes within its interval
+	waitBlocked(clock)
+	clock.Advance(time.Minute)
+	wg.Wait()
+	assert.Equal(t, []string{"msg1"}, client.snapshot())
+	assert.Equal(t, uint64(1), n.Expired())
+}
+
+func Test_notifier_Ordered_HoldBack(t *testing.T) {
+	// the first message of key a is retrying until released
+	release := make(chan struct{})
+	client := &recordingClient{delay: func(msg string) time.Duration {
+		if msg == `{"id":"a","seq":1}` {
+			<-release
+		}
+		return 0
+	}}
+	lanes := []chan *Message{make(chan *Message, 1), make(chan *Message, 1)}
+	producerChan := make(chan *Message)
+	n := NewOrderedNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, lanes, "id", NotifierConfig{})
+	laneOf := func(key string) chan *Message { return n.(*notifier).inboxFor(NewMessage(`{"id":"` + key + `"}`)) }
+	assert.NotEqual(t, laneOf("a"), laneOf("b"), "keys should be on different lanes")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Start(ctx)
+	wg := new(sync.WaitGroup)
+	wg.Add(len(lanes))
+	for i := 1; i <= len(lanes); i++ {
+		go n.Process(wg, i)
+	}
+	// the later messages of key a are held back without blocking key b
+	for seq := 1; seq <= 5; seq++ {
+		producerChan <- NewMessage(fmt.Sprintf(`{"id":"a","seq":%d}`, seq))
+	}
+	for seq := 1; seq <= 3; seq++ {
+		producerChan <- NewMessage(fmt.Sprintf(`{"id":"b","seq":%d}`, seq))
+	}
+	assert.Eventually(t, func() bool { return len(client.snapshot()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{`{"id":"b","seq":1}`, `{"id":"b","seq":2}`, `{"id":"b","seq":3}`}, client.snapshot())
+	assert.Equal(t, 4, n.Depth())
+
+	close(release)
+	assert.Eventually(t, func() bool { return len(client.snapshot()) == 8 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{
+		`{"id":"a","seq":1}`, `{"id":"a","seq":2}`, `{"id":"a","seq":3}`, `{"id":"a","seq":4}`, `{"id":"a","seq":5}`,
+	}, client.snapshot()[3:])
+	cancel()
+	wg.Wait()
+	assert.Equal(t, uint64(0), n.Dropped())
+}
+
+func Test_notifier_Ordered_FullLane(t *testing.T) {
+	release := make(chan struct{})
+	client := &recordingClient{delay: func(msg string) time.Duration {
+		<-release
+		return 0
+	}}
+	lanes := []chan *Message{make(chan *Message, 1)}
+	producerChan := make(chan *Message)
+	n := NewOrderedNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, lanes, "", NotifierConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Start(ctx)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+
+	// one message is sent, one waits on the lane, the lane capacity is held back and one is passed to the inbox
+	accepted := DefaultLaneCapacity + 3
+	for i := 0; i < accepted; i++ {
+		producerChan <- NewMessage("a")
+	}
+	assert.Eventually(t, func() bool { return n.Depth() == DefaultLaneCapacity+1 }, time.Second, time.Millisecond)
+	select {
+	case producerChan <- NewMessage("a"):
+		t.Fatal("the input should block once the lane is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	producerChan <- NewMessage("a")
+	assert.Eventually(t, func() bool { return len(client.snapshot()) == accepted+1 }, time.Second, time.Millisecond)
+	cancel()
+	wg.Wait()
+}
+
+func Test_notifier_Ordered_DropHeldBack(t *testing.T) {
+	release := make(chan struct{})
+	client := &recordingClient{delay: func(msg string) time.Duration {
+		<-release
+		return 0
+	}}
+	lanes := []chan *Message{make(chan *Message, 1)}
+	producerChan := make(chan *Message)
+	n := NewOrderedNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, lanes, "", NotifierConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Start(ctx)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+	for _, msg := range []string{"a", "a", "a", "a"} {
+		producerChan <- NewMessage(msg)
+	}
+	// one message is sent, one waits on the lane and the others are held back
+	assert.Eventually(t, func() bool { return n.Depth() == 3 && len(lanes[0]) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.Eventually(t, func() bool { return n.Dropped() == 2 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"a", "a"}, client.snapshot())
+}
+
+func Test_notifier_Priority(t *testing.T) {
+	// the worker is busy with the first message until released
+	release := make(chan struct{})
+	client := &recordingClient{delay: func(msg string) time.Duration {
+		if msg == "low1" {
+			<-release
+		}
+		return 0
+	}}
+	producerChan := make(chan *Message)
+	envelope := &Envelope{PriorityOf: func(body string) Priority {
+		if strings.HasPrefix(body, "high") {
+			return PriorityHigh
+		}
+		return PriorityLow
+	}}
+	n := NewPriorityNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, NewPriorityQueue(50, 100), NotifierConfig{Envelope: envelope})
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Start(ctx)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+
+	want := []string{"low1", "high"}
+	for i := 1; i <= 50; i++ {
+		producerChan <- NewMessage(fmt.Sprintf("low%d", i))
+		if i > 1 {
+			want = append(want, fmt.Sprintf("low%d", i))
+		}
+	}
+	// the high message overtakes the queued bulk messages
+	producerChan <- NewMessage("high")
+	close(release)
+	assert.Eventually(t, func() bool { return len(client.snapshot()) == len(want) }, time.Second, time.Millisecond)
+	assert.Equal(t, want, client.snapshot())
+	cancel()
+	wg.Wait()
+}
+
+func Test_notifier_Priority_FullLane(t *testing.T) {
+	release := make(chan struct{})
+	client := &recordingClient{delay: func(msg string) time.Duration {
+		<-release
+		return 0
+	}}
+	producerChan := make(chan *Message)
+	envelope := &Envelope{PriorityOf: func(body string) Priority { return PriorityLow }}
+	queue := NewPriorityQueue(2, 0)
+	n := NewPriorityNotifier(zap.NewNop(), client, time.Nanosecond, producerChan, queue, NotifierConfig{Envelope: envelope})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Start(ctx)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+
+	// one message is sent, two fill the low lane and one waits for the lane
+	for i := 1; i <= 4; i++ {
+		producerChan <- NewMessage(fmt.Sprintf("low%d", i))
+	}
+	select {
+	case producerChan <- NewMessage("low5"):
+		t.Fatal("the input should block while the low lane is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the other lanes are not full
+	assert.True(t, queue.Push(&Message{Body: "high", Priority: PriorityHigh}))
+
+	close(release)
+	producerChan <- NewMessage("low5")
+	assert.Eventually(t, func() bool { return len(client.snapshot()) == 6 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"low1", "high", "low2", "low3", "low4", "low5"}, client.snapshot())
+	cancel()
+	wg.Wait()
+}
+
+func Test_notifier_Abort(t *testing.T) {
+	client := &recordingClient{err: func(msg string) error { return errors.New("bad request") }}
+	consumerChan := make(chan *Message, 3)
+	var n Notifier
+	n = NewNotifier(zap.NewNop(), client, time.Nanosecond, nil, consumerChan, NotifierConfig{
+		OnFailed: func(msg *Message, err error) { n.Abort() },
+	})
+	for _, msg := range []string{"msg1", "msg2", "msg3"} {
+		consumerChan <- NewMessage(msg)
+	}
+	close(consumerChan)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	n.Process(wg, 1)
+
+	// the messages queued after the failure are dropped instead of sent
+	assert.Equal(t, []string{"msg1"}, client.snapshot())
+	assert.Equal(t, uint64(2), n.Dropped())
+}
+
+// retryingClient retries the message until the run is aborted
+type retryingClient struct {
+	started chan struct{}
+}
+
+func (c *retryingClient) Notify(msg *Message) error {
+	close(c.started)
+	<-msg.Abort
+	return fmt.Errorf("%w after 1 attempts: unexpected status code 429", ErrAborted)
+}
+
+func Test_notifier_Abort_Retrying(t *testing.T) {
+	client := &retryingClient{started: make(chan struct{})}
+	consumerChan := make(chan *Message, 1)
+	n := NewNotifier(zap.NewNop(), client, time.Nanosecond, nil, consumerChan, NotifierConfig{})
+	consumerChan <- NewMessage("msg1")
+	close(consumerChan)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go n.Process(wg, 1)
+
+	// the delivery waiting to retry is interrupted and its message dropped
+	<-client.started
+	n.Abort()
+	wg.Wait()
+	assert.Equal(t, uint64(1), n.Dropped())
+}
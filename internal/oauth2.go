@@ -0,0 +1,148 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTokenExpiryDelta = 30 * time.Second // tokens are refreshed this long before they expire
+)
+
+// tokenResponse is the token endpoint response of RFC 6749 section 5.1
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"` // seconds, the token never expires when zero
+}
+
+// tokenCall is a token request shared by the workers waiting for the token
+type tokenCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// tokenSource fetches the OAuth2 access tokens with the client credentials grant
+// and caches them until shortly before they expire, concurrent callers share a single request
+type tokenSource struct {
+	mu           sync.Mutex
+	httpClient   *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret *Secret
+	scopes       []string
+	clock        Clock
+	token        string     // cached access token, none when empty
+	expiry       time.Time  // refresh time of the cached token, never when zero
+	call         *tokenCall // token request in flight, none when nil
+}
+
+func newTokenSource(tokenURL, clientID string, clientSecret *Secret, scopes []string, clock Clock) *tokenSource {
+	return &tokenSource{
+		httpClient:   &http.Client{Timeout: time.Second * 5}, // default timeout set to 5s
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		clock:        orClock(clock),
+	}
+}
+
+// Token returns the cached token, or fetches a new one once it is about to expire
+func (s *tokenSource) Token() (string, error) {
+	s.mu.Lock()
+	if s.token != "" && (s.expiry.IsZero() || s.clock.Now().Before(s.expiry)) {
+		defer s.mu.Unlock()
+		return s.token, nil
+	}
+	call := s.call
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		s.call = call
+		go s.fetch(call)
+	}
+	s.mu.Unlock()
+	<-call.done
+	return call.token, call.err
+}
+
+// Invalidate drops the cached token when it is still the given one, e.g. once it was rejected
+func (s *tokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// fetch requests a token and hands it to the waiting callers
+func (s *tokenSource) fetch(call *tokenCall) {
+	token, expiresIn, err := s.request()
+	s.mu.Lock()
+	if err == nil {
+		s.token, s.expiry = token, time.Time{}
+		if expiresIn > 0 {
+			delta := DefaultTokenExpiryDelta
+			if expiresIn/2 < delta {
+				delta = expiresIn / 2
+			}
+			s.expiry = s.clock.Now().Add(expiresIn - delta)
+		}
+	}
+	s.call = nil
+	s.mu.Unlock()
+	call.token, call.err = token, err
+	close(call.done)
+}
+
+// request posts the client credentials grant, the client is authenticated with HTTP basic auth
+func (s *tokenSource) request() (string, time.Duration, error) {
+	secret, _ := s.clientSecret.Value() // the last secret is used when its refresh fails
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(secret))
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", 0, fmt.Errorf("oauth2 token: %w", &StatusError{StatusCode: resp.StatusCode})
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(b, &token); err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: invalid response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("oauth2 token: no access token in the response")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("oauth2 token: unsupported token type %q", token.TokenType)
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// tokenServer issues the tokens t1, t2... valid for expiresIn seconds, every request waits for the gate when set
+func tokenServer(t *testing.T, expiresIn int, gate chan struct{}) (*httptest.Server, *int32) {
+	var issued int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "notifier", id)
+		assert.Equal(t, "s3cr3t", secret)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "notify write", r.PostForm.Get("scope"))
+		if gate != nil {
+			<-gate
+		}
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"t%d","token_type":"Bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &issued
+}
+
+func oauth2Auth(tokenURL string) *Auth {
+	return &Auth{Type: AuthOAuth2, TokenURL: tokenURL, ClientID: "notifier", ClientSecret: "s3cr3t", Scopes: []string{"notify", "write"}}
+}
+
+func Test_OAuth2_TokenCache(t *testing.T) {
+	tokens, issued := tokenServer(t, 120, nil)
+	var got []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: srv.URL, Auth: oauth2Auth(tokens.URL), Clock: clock})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(issued), "fetched on first use")
+
+	assert.NoError(t, client.Notify(NewMessage("1")))
+	assert.NoError(t, client.Notify(NewMessage("2")))
+	// refreshed shortly before the expiry
+	clock.Advance(89 * time.Second)
+	assert.NoError(t, client.Notify(NewMessage("3")))
+	clock.Advance(time.Second)
+	assert.NoError(t, client.Notify(NewMessage("4")))
+
+	assert.Equal(t, []string{"Bearer t1", "Bearer t1", "Bearer t1", "Bearer t2"}, got)
+	assert.Equal(t, int32(2), atomic.LoadInt32(issued))
+}
+
+func Test_OAuth2_SingleFlight(t *testing.T) {
+	gate := make(chan struct{})
+	tokens, issued := tokenServer(t, 3600, gate)
+	auth := oauth2Auth(tokens.URL)
+	assert.NoError(t, auth.Resolve(0, nil))
+
+	var wg sync.WaitGroup
+	got := make([]string, 10)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost", nil)
+			assert.NoError(t, auth.Apply(req, "msg"))
+			got[i] = req.Header.Get("Authorization")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond) // the workers wait for the token request
+	close(gate)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(issued))
+	for _, header := range got {
+		assert.Equal(t, "Bearer t1", header)
+	}
+}
+
+func Test_OAuth2_Unauthorized(t *testing.T) {
+	tests := map[string]struct {
+		accepted string // token accepted by the destination
+		wantErr  error
+		requests int32
+		issued   int32
+	}{
+		"Should retry once with a fresh token": {
+			accepted: "Bearer t2",
+			requests: 2,
+			issued:   2,
+		},
+		"Should fail when the fresh token is rejected": {
+			accepted: "none",
+			wantErr:  &StatusError{StatusCode: http.StatusUnauthorized},
+			requests: 2,
+			issued:   2,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tokens, issued := tokenServer(t, 3600, nil)
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if r.Header.Get("Authorization") != testCase.accepted {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: srv.URL, Auth: oauth2Auth(tokens.URL)})
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.wantErr, client.Notify(NewMessage("msg")))
+			assert.Equal(t, testCase.requests, atomic.LoadInt32(&requests))
+			assert.Equal(t, testCase.issued, atomic.LoadInt32(issued))
+		})
+	}
+}
+
+func Test_OAuth2_TokenError(t *testing.T) {
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+	}))
+	defer tokens.Close()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	retry := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: srv.URL, Auth: oauth2Auth(tokens.URL), Retry: &retry})
+	assert.NoError(t, err)
+	err = client.Notify(NewMessage("msg"))
+	assert.EqualError(t, err, "oauth2 token: unexpected status code 400")
+	assert.False(t, IsRetryable(err), "rejected client credentials are not retried")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	_, err = NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: srv.URL, Auth: &Auth{Type: AuthOAuth2, TokenURL: tokens.URL}})
+	assert.EqualError(t, err, "destination test: oauth2 auth without client id or client secret")
+}
@@ -0,0 +1,237 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const redacted = "[REDACTED]" // replacement of the redact stage
+
+// Stage is the interface that groups the Name and Apply methods
+// Apply transforms the message and returns false when the message should be dropped
+type Stage interface {
+	Name() string
+	Apply(msg string) (string, bool)
+}
+
+// StageStats holds the number of messages dropped by a stage
+type StageStats struct {
+	Name    string
+	Dropped uint64
+}
+
+// Pipeline is the interface that groups the Run, Process, Stats and Cancelled methods
+type Pipeline interface {
+	Run(ctx context.Context, in <-chan *Message, out chan<- *Message)
+	Process(msg string) (string, bool)
+	Stats() []StageStats
+	Cancelled() uint64
+}
+
+// pipeline type
+type pipeline struct {
+	logger    *zap.Logger // logger
+	stages    []Stage     // stages applied in order
+	dropped   []uint64    // dropped messages per stage
+	cancelled uint64      // messages dropped on cancellation
+}
+
+// NewPipeline constructor
+func NewPipeline(logger *zap.Logger, stages ...Stage) Pipeline {
+	return &pipeline{
+		logger:  logger,
+		stages:  stages,
+		dropped: make([]uint64, len(stages)),
+	}
+}
+
+// Run applies the stages to the messages received from in and sends the kept messages to out
+// until in is closed or the context is cancelled, out is closed once it returns
+func (p *pipeline) Run(ctx context.Context, in <-chan *Message, out chan<- *Message) {
+	defer close(out)
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				return
+			}
+			if msg.Body, ok = p.Process(msg.Body); !ok {
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				atomic.AddUint64(&p.cancelled, 1+discard(in))
+				return
+			}
+		case <-ctx.Done():
+			atomic.AddUint64(&p.cancelled, discard(in))
+			return
+		}
+	}
+}
+
+// Cancelled returns the number of messages dropped on cancellation
+func (p *pipeline) Cancelled() uint64 {
+	return atomic.LoadUint64(&p.cancelled)
+}
+
+// Process applies the stages in order, it stops at the first stage dropping the message
+func (p *pipeline) Process(msg string) (string, bool) {
+	for i, stage := range p.stages {
+		var ok bool
+		if msg, ok = stage.Apply(msg); !ok {
+			atomic.AddUint64(&p.dropped[i], 1)
+			p.logger.Debug("message dropped", zap.String("stage", stage.Name()))
+			return "", false
+		}
+	}
+	return msg, true
+}
+
+// Stats returns the number of dropped messages per stage
+func (p *pipeline) Stats() []StageStats {
+	stats := make([]StageStats, len(p.stages))
+	for i, stage := range p.stages {
+		stats[i] = StageStats{Name: stage.Name(), Dropped: atomic.LoadUint64(&p.dropped[i])}
+	}
+	return stats
+}
+
+// ParseStage creates the stage from its spec name[:arg], supported specs are
+//
+//	trim                      trims the leading and trailing whitespace
+//	drop-blank                drops the blank lines
+//	skip-comments[:prefix]    drops the lines starting with prefix, defaults to #
+//	include:regex             keeps only the lines matching regex
+//	exclude:regex             drops the lines matching regex
+//	replace:regex=>text       replaces the matches of regex with text, $1 expands the capture groups
+//	redact:regex              replaces the matches of regex with [REDACTED]
+//	project:field1,field2     keeps only the given fields of a JSON message
+//	max-length:n              drops the lines longer than n bytes
+func ParseStage(spec string) (Stage, error) {
+	name, arg := spec, ""
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		name, arg = spec[:idx], spec[idx+1:]
+	}
+	requireArg := func() error {
+		if arg == "" {
+			return fmt.Errorf("stage %s: missing argument", name)
+		}
+		return nil
+	}
+	switch name {
+	case "trim":
+		return funcStage{name: spec, fn: func(msg string) (string, bool) { return strings.TrimSpace(msg), true }}, nil
+	case "drop-blank":
+		return funcStage{name: spec, fn: func(msg string) (string, bool) { return msg, strings.TrimSpace(msg) != "" }}, nil
+	case "skip-comments":
+		prefix := arg
+		if prefix == "" {
+			prefix = "#"
+		}
+		return funcStage{name: spec, fn: func(msg string) (string, bool) {
+			return msg, !strings.HasPrefix(strings.TrimSpace(msg), prefix)
+		}}, nil
+	case "include", "exclude":
+		if err := requireArg(); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", name, err)
+		}
+		include := name == "include"
+		return funcStage{name: spec, fn: func(msg string) (string, bool) { return msg, re.MatchString(msg) == include }}, nil
+	case "replace", "redact":
+		if err := requireArg(); err != nil {
+			return nil, err
+		}
+		pattern, replacement := arg, redacted
+		if name == "replace" {
+			parts := strings.SplitN(arg, "=>", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("stage replace: argument should be regex=>text")
+			}
+			pattern, replacement = parts[0], parts[1]
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", name, err)
+		}
+		return funcStage{name: spec, fn: func(msg string) (string, bool) { return re.ReplaceAllString(msg, replacement), true }}, nil
+	case "project":
+		if err := requireArg(); err != nil {
+			return nil, err
+		}
+		return projectStage{name: spec, fields: strings.Split(arg, ",")}, nil
+	case "max-length":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("stage max-length: argument should be a positive number")
+		}
+		return funcStage{name: spec, fn: func(msg string) (string, bool) { return msg, len(msg) <= n }}, nil
+	}
+	return nil, fmt.Errorf("unknown stage %q", name)
+}
+
+// ParseStages creates the stages from the specs in order
+func ParseStages(specs []string) ([]Stage, error) {
+	stages := make([]Stage, 0, len(specs))
+	for _, spec := range specs {
+		stage, err := ParseStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// funcStage type
+type funcStage struct {
+	name string
+	fn   func(msg string) (string, bool)
+}
+
+func (s funcStage) Name() string                    { return s.name }
+func (s funcStage) Apply(msg string) (string, bool) { return s.fn(msg) }
+
+// projectStage type keeps only the configured fields of JSON messages, plain text messages are kept as is
+type projectStage struct {
+	name   string
+	fields []string
+}
+
+func (s projectStage) Name() string { return s.name }
+
+func (s projectStage) Apply(msg string) (string, bool) {
+	fields := ParseFields(msg)
+	if fields == nil {
+		return msg, true
+	}
+	projected := map[string]interface{}{}
+	for _, name := range s.fields {
+		if v, ok := fields[name]; ok {
+			projected[name] = v
+		}
+	}
+	b, err := json.Marshal(projected)
+	if err != nil {
+		return msg, true
+	}
+	return string(b), true
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_pipeline_Process(t *testing.T) {
+	tests := map[string]struct {
+		specs []string
+		input []string
+		want  []string
+	}{
+		"Should drop blank and comment lines after trimming": {
+			specs: []string{"trim", "drop-blank", "skip-comments"},
+			input: []string{"  hello  ", "", "   ", "# comment", "world"},
+			want:  []string{"hello", "world"},
+		},
+		"Should keep only included and not excluded lines": {
+			specs: []string{"include:ERROR|WARN", "exclude:healthcheck"},
+			input: []string{"ERROR db down", "INFO ok", "WARN healthcheck slow", "WARN disk"},
+			want:  []string{"ERROR db down", "WARN disk"},
+		},
+		"Should redact and replace content": {
+			specs: []string{`redact:\d{4}-\d{4}-\d{4}-\d{4}`, `replace:user=(\w+)=>user=<$1>`},
+			input: []string{"card 1234-5678-9012-3456 used by user=alice"},
+			want:  []string{"card [REDACTED] used by user=<alice>"},
+		},
+		"Should project JSON fields and keep plain text": {
+			specs: []string{"project:level,message"},
+			input: []string{`{"level":"err","message":"boom","password":"secret"}`, "plain"},
+			want:  []string{`{"level":"err","message":"boom"}`, "plain"},
+		},
+		"Should drop messages above max length": {
+			specs: []string{"max-length:5"},
+			input: []string{"short", "too long"},
+			want:  []string{"short"},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			stages, err := ParseStages(testCase.specs)
+			assert.NoError(t, err)
+			p := NewPipeline(zap.NewNop(), stages...)
+			var got []string
+			for _, msg := range testCase.input {
+				if out, ok := p.Process(msg); ok {
+					got = append(got, out)
+				}
+			}
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func Test_ParseStage_Invalid(t *testing.T) {
+	for _, spec := range []string{"unknown", "include", "exclude:(", "replace:abc", "max-length:x", "project"} {
+		_, err := ParseStage(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func Test_pipeline_Run(t *testing.T) {
+	stages, err := ParseStages([]string{"trim", "drop-blank", "skip-comments"})
+	assert.NoError(t, err)
+	p := NewPipeline(zap.NewNop(), stages...)
+	in := make(chan *Message, 5)
+	out := make(chan *Message, 5)
+	for _, msg := range []string{" a ", "", "#b", "c", " "} {
+		in <- NewMessage(msg)
+	}
+	close(in)
+	p.Run(context.Background(), in, out)
+
+	var got []string
+	for msg := range out {
+		got = append(got, msg.Body)
+	}
+	assert.Equal(t, []string{"a", "c"}, got)
+	assert.Equal(t, []StageStats{{Name: "trim"}, {Name: "drop-blank", Dropped: 2}, {Name: "skip-comments", Dropped: 1}}, p.Stats())
+}
+
+func Test_pipeline_Cancelled(t *testing.T) {
+	p := NewPipeline(zap.NewNop())
+	in := make(chan *Message, 3)
+	for _, msg := range []string{"a", "b", "c"} {
+		in <- NewMessage(msg)
+	}
+	close(in)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// nobody receives from out, the messages left on the way are dropped
+	p.Run(ctx, in, make(chan *Message))
+	assert.Equal(t, uint64(3), p.Cancelled())
+}
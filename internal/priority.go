@@ -0,0 +1,137 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"sync"
+)
+
+const DefaultStarvationLimit = 10 // default number of times a waiting lane is skipped before it is served
+
+// PriorityQueue is the queue with a lane per priority
+type PriorityQueue interface {
+	Push(msg *Message) bool
+	Pop() (*Message, bool)
+	Close()
+	Len(p Priority) int
+}
+
+// priorityQueue type
+type priorityQueue struct {
+	mu              sync.Mutex
+	notEmpty        *sync.Cond                 // signalled when a message is pushed or the queue is closed
+	notFull         *sync.Cond                 // signalled when a message is popped or the queue is closed
+	lanes           [priorityLevels][]*Message // FIFO lane per priority
+	skipped         [priorityLevels]int        // number of times a waiting lane was skipped
+	capacity        int                        // max messages per lane, unbounded when zero
+	starvationLimit int                        // skips after which a waiting lane is served
+	closed          bool
+}
+
+// NewPriorityQueue constructor, high priority lanes are served first and a waiting lower lane is served
+// after it was skipped starvationLimit times, the lanes are unbounded when capacity is zero
+func NewPriorityQueue(capacity, starvationLimit int) PriorityQueue {
+	if capacity < 0 {
+		capacity = 0
+	}
+	if starvationLimit < 1 {
+		starvationLimit = DefaultStarvationLimit
+	}
+	q := &priorityQueue{capacity: capacity, starvationLimit: starvationLimit}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds the message to its lane and blocks while a bounded lane is full,
+// it returns false when the queue is closed
+func (q *priorityQueue) Push(msg *Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lane := q.lane(msg.Priority)
+	for !q.closed && q.capacity > 0 && len(q.lanes[lane]) >= q.capacity {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	q.lanes[lane] = append(q.lanes[lane], msg)
+	q.notEmpty.Signal()
+	return true
+}
+
+// Pop blocks until a message is available, it returns false once the queue is closed and empty
+func (q *priorityQueue) Pop() (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if lane := q.next(); lane >= 0 {
+			msg := q.lanes[lane][0]
+			q.lanes[lane][0] = nil
+			q.lanes[lane] = q.lanes[lane][1:]
+			q.notFull.Broadcast()
+			return msg, true
+		}
+		if q.closed {
+			return nil, false
+		}
+		q.notEmpty.Wait()
+	}
+}
+
+// next returns the lane to be served, starving lane wins over the higher priority lanes
+func (q *priorityQueue) next() int {
+	lane := -1
+	for p := 0; p < priorityLevels; p++ {
+		if len(q.lanes[p]) == 0 {
+			continue
+		}
+		if lane < 0 {
+			lane = p
+		} else if q.skipped[p] >= q.starvationLimit {
+			lane = p
+			break
+		}
+	}
+	if lane < 0 {
+		return lane
+	}
+	q.skipped[lane] = 0
+	for p := lane + 1; p < priorityLevels; p++ {
+		if len(q.lanes[p]) > 0 {
+			q.skipped[p]++
+		}
+	}
+	return lane
+}
+
+// Close wakes up the blocked callers, queued messages can still be popped
+func (q *priorityQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// Len returns the number of queued messages of the priority
+func (q *priorityQueue) Len(p Priority) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lanes[q.lane(p)])
+}
+
+// lane returns the lane index of the priority, lanes are ordered from high to low
+func (q *priorityQueue) lane(p Priority) int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	}
+	return 1
+}
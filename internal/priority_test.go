@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_priorityQueue_Pop(t *testing.T) {
+	tests := map[string]struct {
+		starvationLimit int
+		input           []*Message
+		want            []string
+	}{
+		"Should serve high priority lanes first": {
+			starvationLimit: 10,
+			input: []*Message{
+				{Body: "low1", Priority: PriorityLow}, {Body: "normal1"}, {Body: "high1", Priority: PriorityHigh},
+				{Body: "normal2"}, {Body: "high2", Priority: PriorityHigh},
+			},
+			want: []string{"high1", "high2", "normal1", "normal2", "low1"},
+		},
+		"Should serve the starving low lane": {
+			starvationLimit: 2,
+			input: []*Message{
+				{Body: "low1", Priority: PriorityLow}, {Body: "high1", Priority: PriorityHigh}, {Body: "high2", Priority: PriorityHigh},
+				{Body: "high3", Priority: PriorityHigh}, {Body: "high4", Priority: PriorityHigh}, {Body: "high5", Priority: PriorityHigh},
+			},
+			want: []string{"high1", "high2", "low1", "high3", "high4", "high5"},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			q := NewPriorityQueue(10, testCase.starvationLimit)
+			for _, msg := range testCase.input {
+				assert.True(t, q.Push(msg))
+			}
+			q.Close()
+			var got []string
+			for msg, ok := q.Pop(); ok; msg, ok = q.Pop() {
+				got = append(got, msg.Body)
+			}
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func Test_priorityQueue_Push(t *testing.T) {
+	q := NewPriorityQueue(1, 0)
+	assert.True(t, q.Push(&Message{Body: "low1", Priority: PriorityLow}))
+	// a full low lane doesn't block the high lane
+	assert.True(t, q.Push(&Message{Body: "high1", Priority: PriorityHigh}))
+	assert.Equal(t, 1, q.Len(PriorityLow))
+	assert.Equal(t, 1, q.Len(PriorityHigh))
+
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(&Message{Body: "low2", Priority: PriorityLow}) }()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full lane should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	msg, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "high1", msg.Body)
+	msg, _ = q.Pop()
+	assert.Equal(t, "low1", msg.Body)
+	assert.True(t, <-pushed)
+
+	// blocked push returns false once the queue is closed
+	go func() { pushed <- q.Push(&Message{Body: "low3", Priority: PriorityLow}) }()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	assert.False(t, <-pushed)
+}
+
+func Test_priorityQueue_Unbounded(t *testing.T) {
+	q := NewPriorityQueue(0, 0)
+	for i := 0; i < 1000; i++ {
+		assert.True(t, q.Push(&Message{Body: "low", Priority: PriorityLow}))
+	}
+	assert.Equal(t, 1000, q.Len(PriorityLow))
+	q.Close()
+	assert.False(t, q.Push(&Message{Body: "high", Priority: PriorityHigh}))
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is the interface that wraps the Wait method
+// Wait blocks until the next notification is allowed
+type RateLimiter interface {
+	Wait()
+}
+
+// tokenBucket type
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64   // tokens added per second
+	burst  float64   // max tokens
+	tokens float64   // available tokens
+	last   time.Time // last time tokens were added
+	clock  Clock     // refill time source
+}
+
+// NewRateLimiter constructor, allows rate notifications per second with the given burst, real clock when nil
+func NewRateLimiter(rate float64, burst int, clock Clock) RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	clock = orClock(clock)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// Wait takes a token from the bucket and waits for it when the bucket is empty
+func (b *tokenBucket) Wait() {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 { // reserve the token, caller waits until it is refilled
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		<-b.clock.After(wait)
+	}
+}
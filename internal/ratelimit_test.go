@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tokenBucket_Wait(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(2, 2, clock)
+
+	// the burst is taken at once
+	limiter.Wait()
+	limiter.Wait()
+
+	// the next token is refilled after half a second
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		limiter.Wait()
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(400 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("the token should not be refilled yet")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(100 * time.Millisecond)
+	<-done
+
+	// idle time refills the bucket up to the burst
+	clock.Advance(time.Hour)
+	limiter.Wait()
+	limiter.Wait()
+	assert.Equal(t, 0, clock.Waiters())
+}
@@ -0,0 +1,136 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReloadableClient is the router whose client can be swapped while running, e.g. on config reload,
+// messages being sent finish on the client they started with so that nothing in flight is dropped
+type ReloadableClient struct {
+	mu      sync.RWMutex
+	current *clientHolder  // current client
+	closing sync.WaitGroup // replaced clients waiting for their sends to finish before they are closed
+	errMu   sync.Mutex
+	err     error // first error closing a replaced client
+}
+
+// clientHolder keeps the client with its sends in flight
+type clientHolder struct {
+	client   HttpClient
+	inFlight sync.WaitGroup
+}
+
+// NewReloadableClient constructor
+func NewReloadableClient(client HttpClient) *ReloadableClient {
+	return &ReloadableClient{current: &clientHolder{client: client}}
+}
+
+// Swap replaces the client, the replaced client is closed once its sends in flight finish
+// when it implements io.Closer
+func (c *ReloadableClient) Swap(client HttpClient) {
+	c.mu.Lock()
+	old := c.current
+	c.current = &clientHolder{client: client}
+	c.mu.Unlock()
+	c.closing.Add(1)
+	go func() {
+		defer c.closing.Done()
+		old.inFlight.Wait()
+		if err := closeClient(old.client); err != nil {
+			c.errMu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.errMu.Unlock()
+		}
+	}()
+}
+
+// Client returns the current client
+func (c *ReloadableClient) Client() HttpClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.client
+}
+
+// acquire returns the current client holder with a send in flight, released by calling inFlight.Done
+func (c *ReloadableClient) acquire() *clientHolder {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.current.inFlight.Add(1)
+	return c.current
+}
+
+// Close closes the current client once its sends in flight finish and waits for the replaced clients to be closed,
+// it returns the first error closing a client
+func (c *ReloadableClient) Close() error {
+	c.mu.RLock()
+	current := c.current
+	c.mu.RUnlock()
+	current.inFlight.Wait()
+	err := closeClient(current.client)
+	c.closing.Wait()
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+// Notify sends the message with the current client
+func (c *ReloadableClient) Notify(msg *Message) error {
+	holder := c.acquire()
+	defer holder.inFlight.Done()
+	return holder.client.Notify(msg)
+}
+
+// Route returns the route of the current router, the default destination when the client is not a router
+func (c *ReloadableClient) Route(msg string) Route {
+	if router, ok := c.Client().(Router); ok {
+		return router.Route(msg)
+	}
+	return Route{Destinations: []string{DefaultDestination}}
+}
+
+// WatchFiles polls the files every interval and calls changed when the modification time or the size of one changes,
+// missing files are watched until they appear, it runs until the context is cancelled
+func WatchFiles(ctx context.Context, clock Clock, interval time.Duration, paths []string, changed func()) {
+	stat := func() []string {
+		states := make([]string, len(paths))
+		for i, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				states[i] = fmt.Sprintf("%s/%d", info.ModTime(), info.Size())
+			}
+		}
+		return states
+	}
+	last := stat()
+	ticker := orClock(clock).NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			states := stat()
+			for i := range states {
+				if states[i] != last[i] {
+					last = states
+					changed()
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticRouter routes every message to its route
+type staticRouter struct {
+	recordingClient
+	route Route
+}
+
+func (r *staticRouter) Route(msg string) Route { return r.route }
+
+func Test_ReloadableClient(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	old := &recordingClient{delay: func(msg string) time.Duration {
+		close(started)
+		<-release
+		return 0
+	}}
+	client := NewReloadableClient(old)
+	assert.Equal(t, Route{Destinations: []string{DefaultDestination}}, client.Route("msg"))
+
+	// the message in flight finishes on the client it started with
+	done := make(chan error)
+	go func() { done <- client.Notify(&Message{Body: "in flight"}) }()
+	<-started
+	router := &staticRouter{route: Route{Destinations: []string{"ops"}, Priority: PriorityHigh}}
+	client.Swap(router)
+	assert.NoError(t, client.Notify(&Message{Body: "after reload"}))
+	close(release)
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, []string{"in flight"}, old.msgs)
+	assert.Equal(t, []string{"after reload"}, router.msgs)
+	assert.Equal(t, router.route, client.Route("msg"))
+}
+
+// closingClient records when it is closed
+type closingClient struct {
+	recordingClient
+	closed chan struct{}
+}
+
+func (c *closingClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func Test_ReloadableClient_Close(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	old := &closingClient{closed: make(chan struct{})}
+	old.delay = func(msg string) time.Duration {
+		close(started)
+		<-release
+		return 0
+	}
+	client := NewReloadableClient(old)
+	done := make(chan error)
+	go func() { done <- client.Notify(&Message{Body: "in flight"}) }()
+	<-started
+
+	// the replaced client is closed once its send in flight finishes
+	current := &closingClient{closed: make(chan struct{})}
+	client.Swap(current)
+	select {
+	case <-old.closed:
+		t.Fatal("closed with a send in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-done)
+	<-old.closed
+
+	assert.NoError(t, client.Close())
+	<-current.closed
+}
+
+func Test_WatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "notifier.yaml")
+	missing := filepath.Join(dir, "rules.yaml")
+	assert.NoError(t, os.WriteFile(config, []byte("url: http://localhost\n"), 0o644))
+
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	changed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchFiles(ctx, clock, time.Second, []string{config, missing}, func() { changed <- struct{}{} })
+	waitBlocked(clock)
+
+	tick := func() bool {
+		clock.Advance(time.Second)
+		select {
+		case <-changed:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+	assert.False(t, tick(), "unchanged files")
+
+	assert.NoError(t, os.WriteFile(config, []byte("url: http://localhost:8080\n"), 0o644))
+	assert.True(t, tick(), "changed file")
+	assert.False(t, tick(), "change reported once")
+
+	assert.NoError(t, os.WriteFile(missing, []byte("rules: []\n"), 0o644))
+	assert.True(t, tick(), "created file")
+}
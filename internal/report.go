@@ -0,0 +1,180 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcomes of the messages processed by the workers
+const (
+	OutcomeSent    = "sent"
+	OutcomeFailed  = "failed"
+	OutcomeExpired = "expired"
+	OutcomePartial = "partial"
+	OutcomeDropped = "dropped"
+)
+
+// Report is the end of run summary of the deliveries
+type Report struct {
+	Duration     float64                       `json:"duration_seconds"`
+	Lines        uint64                        `json:"lines"`   // lines read from the input
+	Sent         uint64                        `json:"sent"`    // messages delivered
+	Failed       uint64                        `json:"failed"`  // messages failed after the retries
+	Expired      uint64                        `json:"expired"` // messages expired before delivery
+	Partial      uint64                        `json:"partial"` // messages delivered to some of their destinations only
+	Retried      uint64                        `json:"retried"` // retried requests
+	Skipped      uint64                        `json:"skipped"` // lines dropped by the pipeline stages
+	Dropped      uint64                        `json:"dropped"` // messages dropped at shutdown before delivery
+	Throughput   float64                       `json:"throughput_per_second"`
+	Latency      LatencyReport                 `json:"latency_ms"`
+	StatusCodes  map[string]uint64             `json:"status_codes"`
+	Destinations map[string]*DestinationReport `json:"destinations"`
+}
+
+// LatencyReport holds the request latency percentiles in milliseconds
+type LatencyReport struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// DestinationReport holds the deliveries of a destination
+type DestinationReport struct {
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Retried uint64 `json:"retried"`
+}
+
+// Report returns the summary of the deliveries recorded over the run duration,
+// the skipped messages are not known to the metrics and left to the caller
+func (m *Metrics) Report(duration time.Duration) *Report {
+	r := &Report{Duration: duration.Seconds(), StatusCodes: map[string]uint64{}, Destinations: map[string]*DestinationReport{}}
+	if m == nil {
+		return r
+	}
+	outcomes := m.processed.sumBy("outcome")
+	r.Lines = uint64(m.read.total())
+	r.Sent = uint64(outcomes[OutcomeSent])
+	r.Failed = uint64(outcomes[OutcomeFailed])
+	r.Expired = uint64(outcomes[OutcomeExpired])
+	r.Partial = uint64(outcomes[OutcomePartial])
+	r.Retried = uint64(m.retries.total())
+	r.Dropped = uint64(m.dropped.total())
+	if duration > 0 {
+		r.Throughput = float64(r.Sent) / duration.Seconds()
+	}
+	for code, n := range m.responses.sumBy("code") {
+		r.StatusCodes[code] = uint64(n)
+	}
+	destination := func(name string) *DestinationReport {
+		if r.Destinations[name] == nil {
+			r.Destinations[name] = &DestinationReport{}
+		}
+		return r.Destinations[name]
+	}
+	for name, n := range m.delivered.sumBy("destination") {
+		destination(name).Sent = uint64(n)
+	}
+	for name, n := range m.failed.sumBy("destination") {
+		destination(name).Failed = uint64(n)
+	}
+	for name, n := range m.retries.sumBy("destination") {
+		destination(name).Retried = uint64(n)
+	}
+
+	m.mu.Lock()
+	samples := append([]float64(nil), m.samples...)
+	m.mu.Unlock()
+	sort.Float64s(samples)
+	r.Latency = LatencyReport{P50: percentile(samples, 50), P90: percentile(samples, 90), P99: percentile(samples, 99), Max: percentile(samples, 100)}
+	return r
+}
+
+// percentile returns the nearest rank percentile of the sorted latencies in milliseconds
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1] * 1000
+}
+
+// AllDelivered reports whether every message read was delivered or skipped on purpose
+func (r *Report) AllDelivered() bool {
+	return r.Failed == 0 && r.Expired == 0 && r.Partial == 0 && r.Dropped == 0
+}
+
+// WriteText writes the human readable summary
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Summary\n")
+	fmt.Fprintf(&b, "  duration:    %s\n", time.Duration(r.Duration*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(&b, "  lines:       %d\n", r.Lines)
+	fmt.Fprintf(&b, "  sent:        %d\n", r.Sent)
+	fmt.Fprintf(&b, "  failed:      %d\n", r.Failed)
+	fmt.Fprintf(&b, "  expired:     %d\n", r.Expired)
+	fmt.Fprintf(&b, "  partial:     %d\n", r.Partial)
+	fmt.Fprintf(&b, "  retried:     %d\n", r.Retried)
+	fmt.Fprintf(&b, "  skipped:     %d\n", r.Skipped)
+	fmt.Fprintf(&b, "  dropped:     %d\n", r.Dropped)
+	fmt.Fprintf(&b, "  throughput:  %.2f/s\n", r.Throughput)
+	fmt.Fprintf(&b, "  latency:     p50 %s, p90 %s, p99 %s, max %s\n", formatMillis(r.Latency.P50), formatMillis(r.Latency.P90), formatMillis(r.Latency.P99), formatMillis(r.Latency.Max))
+	if len(r.StatusCodes) > 0 {
+		fmt.Fprintf(&b, "Status codes\n")
+		codes := make([]string, 0, len(r.StatusCodes))
+		for code := range r.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(&b, "  %-12s %d\n", code+":", r.StatusCodes[code])
+		}
+	}
+	if len(r.Destinations) > 0 {
+		fmt.Fprintf(&b, "Destinations\n")
+		names := make([]string, 0, len(r.Destinations))
+		for name := range r.Destinations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d := r.Destinations[name]
+			fmt.Fprintf(&b, "  %s: sent %d, failed %d, retried %d\n", name, d.Sent, d.Failed, d.Retried)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteFile writes the report as JSON to the file
+func (r *Report) WriteFile(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func formatMillis(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond).String()
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metrics_Report(t *testing.T) {
+	m := NewMetrics()
+	for i := 0; i < 5; i++ {
+		m.Read()
+	}
+	m.Delivered("ops", PriorityNormal)
+	m.Delivered("chat", PriorityHigh)
+	m.Delivered("chat", PriorityNormal)
+	m.Processed(OutcomeSent)
+	m.Processed(OutcomeSent)
+	m.Failed("ops", &StatusError{StatusCode: 503})
+	m.Processed(OutcomeFailed)
+	m.Processed(OutcomeExpired)
+	m.Processed(OutcomePartial)
+	m.Dropped(2)
+	m.Retried("ops")
+	m.Response("ops", 503)
+	m.Response("ops", 503)
+	m.Response("ops", 200)
+	m.Response("chat", 200)
+	m.Response("chat", 0)
+	for i := 1; i <= 100; i++ {
+		m.ObserveLatency("ops", time.Duration(i)*time.Millisecond)
+	}
+
+	r := m.Report(2 * time.Second)
+	assert.Equal(t, uint64(5), r.Lines)
+	assert.Equal(t, uint64(2), r.Sent)
+	assert.Equal(t, uint64(1), r.Failed)
+	assert.Equal(t, uint64(1), r.Expired)
+	assert.Equal(t, uint64(1), r.Partial)
+	assert.Equal(t, uint64(2), r.Dropped)
+	assert.Equal(t, uint64(1), r.Retried)
+	assert.Equal(t, 1.0, r.Throughput)
+	assert.Equal(t, LatencyReport{P50: 50, P90: 90, P99: 99, Max: 100}, r.Latency)
+	assert.Equal(t, map[string]uint64{"200": 2, "503": 2, "error": 1}, r.StatusCodes)
+	assert.Equal(t, map[string]*DestinationReport{
+		"ops":  {Sent: 1, Failed: 1, Retried: 1},
+		"chat": {Sent: 2},
+	}, r.Destinations)
+	assert.False(t, r.AllDelivered())
+}
+
+func Test_Report_AllDelivered(t *testing.T) {
+	tests := map[string]struct {
+		report Report
+		want   bool
+	}{
+		"Should be delivered when all are sent":       {report: Report{Lines: 2, Sent: 2}, want: true},
+		"Should be delivered when lines are skipped":  {report: Report{Lines: 2, Sent: 1, Skipped: 1}, want: true},
+		"Should not be delivered on failures":         {report: Report{Lines: 2, Sent: 1, Failed: 1}, want: false},
+		"Should not be delivered on expiry":           {report: Report{Lines: 2, Sent: 1, Expired: 1}, want: false},
+		"Should not be delivered on partial delivery": {report: Report{Lines: 2, Sent: 1, Partial: 1}, want: false},
+		"Should not be delivered on shutdown drops":   {report: Report{Lines: 2, Sent: 1, Dropped: 1}, want: false},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.want, testCase.report.AllDelivered())
+		})
+	}
+}
+
+func Test_Report_Write(t *testing.T) {
+	m := NewMetrics()
+	m.Read()
+	m.Delivered("ops", PriorityNormal)
+	m.Processed(OutcomeSent)
+	m.Response("ops", 200)
+	m.ObserveLatency("ops", 25*time.Millisecond)
+	r := m.Report(time.Second)
+	r.Skipped = 3
+
+	var b strings.Builder
+	assert.NoError(t, r.WriteText(&b))
+	for _, want := range []string{"  sent:        1\n", "  skipped:     3\n", "p50 25ms", "  200:         1\n", "  ops: sent 1, failed 0, retried 0\n"} {
+		assert.Contains(t, b.String(), want)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	assert.NoError(t, r.WriteFile(path))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var got Report
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, *r, got)
+}
+
+func Test_Metrics_Report_Nil(t *testing.T) {
+	var m *Metrics
+	r := m.Report(time.Second)
+	assert.Equal(t, uint64(0), r.Sent)
+	assert.True(t, r.AllDelivered())
+}
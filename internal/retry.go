@@ -0,0 +1,87 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+const (
+	DefaultRetryBackoff    = 500 * time.Millisecond // default wait before the first retry
+	DefaultRetryMaxBackoff = 10 * time.Second       // default max wait between retries
+	DefaultRetryMaxWait    = time.Minute            // default max wait asked by the receiver before retrying
+)
+
+// RetryPolicy defines how failed notifications are retried
+type RetryPolicy struct {
+	Attempts   int           `yaml:"attempts"`    // number of retries after the first attempt, no retry when zero (chat types retry 3 times) or negative
+	Backoff    time.Duration `yaml:"backoff"`     // wait before the first retry, doubled for every next retry
+	MaxBackoff time.Duration `yaml:"max_backoff"` // max wait between retries
+	MaxWait    time.Duration `yaml:"max_wait"`    // max wait asked by the receiver with Retry-After, longer waits are cut short
+}
+
+// Delay returns the wait before the given retry, starting at 1
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	backoff, maxBackoff := p.Backoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// Wait returns the wait before the given retry, or the longer wait asked by the receiver capped at MaxWait
+func (p RetryPolicy) Wait(retry int, asked time.Duration) time.Duration {
+	delay, maxWait := p.Delay(retry), p.MaxWait
+	if maxWait <= 0 {
+		maxWait = DefaultRetryMaxWait
+	}
+	if asked > maxWait {
+		asked = maxWait
+	}
+	if asked > delay {
+		return asked
+	}
+	return delay
+}
+
+// StatusError is returned when the receiver responds with a non 2xx status code
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // wait asked by the receiver before retrying, e.g. with Retry-After on 429, none when zero
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// IsRetryable reports whether the failed notification may succeed when retried,
+// network errors, 5xx and 429 responses and transient 4xx SMTP replies are retried
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	// SMTP replies, 4xx are transient and 5xx permanent failures
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code < 500
+	}
+	return err != nil
+}
@@ -0,0 +1,414 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RouteModeFirst = "first" // message is sent to the destinations of the first matching rule
+	RouteModeAll   = "all"   // message is sent to the destinations of every matching rule
+
+	DefaultDestination = "default" // name of the destination created from the --url flag
+)
+
+// RoutesConfig is the rules file
+type RoutesConfig struct {
+	Mode         string        `yaml:"mode,omitempty"`           // first or all, defaults to first
+	Default      []string      `yaml:"default,omitempty"`        // destinations used when no rule matches
+	Destinations []Destination `yaml:"destinations,omitempty"`   // named destinations
+	Rules        []Rule        `yaml:"rules,omitempty"`          // rules evaluated in order
+	Retry        RetryPolicy   `yaml:"retry,omitempty"`          // retry of the destinations without their own retry policy
+	Refresh      time.Duration `yaml:"secret_refresh,omitempty"` // interval after which the secret references are resolved again, never when zero
+	Metrics      *Metrics      `yaml:"-"`                        // delivery metrics of the destinations, disabled when nil
+	DefaultType  string        `yaml:"-"`                        // type of the destination of the default url
+}
+
+// Rule sends the matching messages to one or more destinations,
+// all the configured conditions must match
+type Rule struct {
+	Name         string   `yaml:"name,omitempty"`         // rule name shown in logs and route test
+	Regex        string   `yaml:"regex,omitempty"`        // regex matched against the raw message
+	Field        string   `yaml:"field,omitempty"`        // dotted JSON field path, e.g. labels.team
+	Value        string   `yaml:"value,omitempty"`        // regex matched against the field value, field presence is checked when empty
+	Severity     string   `yaml:"severity,omitempty"`     // least severe syslog severity matched, e.g. warning
+	Destinations []string `yaml:"destinations,omitempty"` // destinations of the matching messages
+	Priority     string   `yaml:"priority,omitempty"`     // delivery priority of the matching messages, high, normal or low
+}
+
+// Route is the outcome of the rule evaluation for a message
+type Route struct {
+	Rules        []string // matching rule names, empty when default route is used
+	Destinations []string // destinations the message is sent to
+	Priority     Priority // priority of the first matching rule with priority, normal by default
+}
+
+// Router is the interface that groups the Notify and Route methods,
+// Notify sends the message to the destinations of the matching rules
+type Router interface {
+	HttpClient
+	Route(msg string) Route
+}
+
+// compiledRule type
+type compiledRule struct {
+	Rule
+	regex    *regexp.Regexp
+	value    *regexp.Regexp
+	severity int
+	priority *Priority
+}
+
+// router type
+type router struct {
+	logger       *zap.Logger           // logger
+	mode         string                // first or all
+	rules        []compiledRule        // rules evaluated in order
+	defaults     []string              // default route
+	destinations map[string]HttpClient // http clients by destination name
+}
+
+// LoadRoutes reads the rules file
+func LoadRoutes(path string) (*RoutesConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+	cfg := new(RoutesConfig)
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// NewRouter constructor, defaultURL is added as the default destination when not empty
+func NewRouter(logger *zap.Logger, cfg *RoutesConfig, defaultURL string) (Router, error) {
+	r := &router{
+		logger:   logger,
+		mode:     cfg.Mode,
+		defaults: cfg.Default,
+	}
+	switch r.mode {
+	case "":
+		r.mode = RouteModeFirst
+	case RouteModeFirst, RouteModeAll:
+	default:
+		return nil, fmt.Errorf("invalid route mode %q, should be %s or %s", cfg.Mode, RouteModeFirst, RouteModeAll)
+	}
+
+	dests := cfg.Destinations
+	if defaultURL != "" {
+		dests = append([]Destination{{Name: DefaultDestination, URL: defaultURL, Type: cfg.DefaultType}}, dests...)
+		if len(r.defaults) == 0 {
+			r.defaults = []string{DefaultDestination}
+		}
+	}
+	var err error
+	if r.destinations, err = newDestinationClients(logger, dests, cfg.Retry, cfg.Refresh, nil, cfg.Metrics); err != nil {
+		return nil, err
+	}
+	if err := r.checkRules(cfg.Rules); err != nil {
+		r.Close() // release the files and connections of the rejected config
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkRules compiles the rules and checks that the routes refer to known destinations
+func (r *router) checkRules(rules []Rule) error {
+	if err := r.checkDestinations("default route", r.defaults); err != nil {
+		return err
+	}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		cr, err := compileRule(rule)
+		if err != nil {
+			return err
+		}
+		if err := r.checkDestinations("rule "+rule.Name, rule.Destinations); err != nil {
+			return err
+		}
+		r.rules = append(r.rules, cr)
+	}
+	return nil
+}
+
+// newDestinationClients creates the http clients by destination name, retry is used by the destinations without their own retry policy
+// refresh, clock and metrics by the destinations without their own
+func newDestinationClients(logger *zap.Logger, dests []Destination, retry RetryPolicy, refresh time.Duration, clock Clock, metrics *Metrics) (map[string]HttpClient, error) {
+	clients := map[string]HttpClient{}
+	for _, dest := range dests {
+		if dest.Name == "" {
+			return nil, fmt.Errorf("destination with url %s has no name", dest.URL)
+		}
+		if _, ok := clients[dest.Name]; ok {
+			return nil, fmt.Errorf("duplicate destination %s", dest.Name)
+		}
+		if dest.Retry == nil {
+			dest.Retry = &retry
+		}
+		if dest.Clock == nil {
+			dest.Clock = clock
+		}
+		if dest.Refresh == 0 {
+			dest.Refresh = refresh
+		}
+		if dest.Metrics == nil {
+			dest.Metrics = metrics
+		}
+		client, err := NewDestinationClient(logger, dest)
+		if err != nil {
+			closeClients(clients)
+			return nil, err
+		}
+		clients[dest.Name] = client
+	}
+	return clients, nil
+}
+
+func (r *router) checkDestinations(owner string, names []string) error {
+	for _, name := range names {
+		if _, ok := r.destinations[name]; !ok {
+			return fmt.Errorf("%s: unknown destination %s", owner, name)
+		}
+	}
+	return nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	cr := compiledRule{Rule: rule, severity: -1}
+	var err error
+	if len(rule.Destinations) == 0 {
+		return cr, fmt.Errorf("rule %s: no destinations", rule.Name)
+	}
+	if rule.Regex != "" {
+		if cr.regex, err = regexp.Compile(rule.Regex); err != nil {
+			return cr, fmt.Errorf("rule %s: invalid regex: %w", rule.Name, err)
+		}
+	}
+	if rule.Value != "" {
+		if rule.Field == "" {
+			return cr, fmt.Errorf("rule %s: value requires field", rule.Name)
+		}
+		if cr.value, err = regexp.Compile(rule.Value); err != nil {
+			return cr, fmt.Errorf("rule %s: invalid value regex: %w", rule.Name, err)
+		}
+	}
+	if rule.Severity != "" {
+		if cr.severity, err = ParseSyslogSeverity(rule.Severity); err != nil {
+			return cr, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	if rule.Priority != "" {
+		priority, err := ParsePriority(rule.Priority)
+		if err != nil {
+			return cr, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		cr.priority = &priority
+	}
+	return cr, nil
+}
+
+// match checks all the configured conditions of the rule
+func (c compiledRule) match(msg string, fields map[string]interface{}) bool {
+	if c.regex != nil && !c.regex.MatchString(msg) {
+		return false
+	}
+	if c.Field != "" {
+		v, ok := LookupField(fields, c.Field)
+		if !ok || (c.value != nil && !c.value.MatchString(v)) {
+			return false
+		}
+	}
+	if c.severity >= 0 {
+		severity, ok := messageSeverity(fields)
+		if !ok || severity > c.severity {
+			return false
+		}
+	}
+	return true
+}
+
+// messageSeverity returns the syslog severity code from severity_code, severity or level field
+func messageSeverity(fields map[string]interface{}) (int, bool) {
+	for _, name := range []string{"severity_code", "severity", "level"} {
+		if v, ok := LookupField(fields, name); ok {
+			if code, err := ParseSyslogSeverity(v); err == nil {
+				return code, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Route evaluates the rules for the message
+func (r *router) Route(msg string) Route {
+	fields := ParseFields(msg)
+	var route Route
+	prioritized := false
+	seen := map[string]bool{}
+	for _, rule := range r.rules {
+		if !rule.match(msg, fields) {
+			continue
+		}
+		route.Rules = append(route.Rules, rule.Name)
+		if rule.priority != nil && !prioritized {
+			route.Priority, prioritized = *rule.priority, true
+		}
+		for _, dest := range rule.Destinations {
+			if !seen[dest] {
+				seen[dest] = true
+				route.Destinations = append(route.Destinations, dest)
+			}
+		}
+		if r.mode == RouteModeFirst {
+			break
+		}
+	}
+	if len(route.Rules) == 0 {
+		route.Destinations = r.defaults
+	}
+	return route
+}
+
+// Notify sends the message to the destinations of the matching rules
+func (r *router) Notify(msg *Message) error {
+	route := r.Route(msg.Body)
+	if len(route.Destinations) == 0 {
+		r.logger.Warn("no route matched, dropping message", zap.String("msg", msg.Body))
+		return nil
+	}
+	r.logger.Debug("routing message", zap.Strings("rules", route.Rules), zap.Strings("destinations", route.Destinations))
+	var errs DestinationErrors
+	for _, dest := range route.Destinations {
+		if err := r.destinations[dest].Notify(msg); err != nil {
+			errs = append(errs, &DestinationError{Destination: dest, Err: err})
+		}
+	}
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) < len(route.Destinations):
+		delivered := make([]string, 0, len(route.Destinations)-len(errs))
+		for _, dest := range route.Destinations {
+			if !errs.failed(dest) {
+				delivered = append(delivered, dest)
+			}
+		}
+		return &PartialDeliveryError{Delivered: delivered, Errors: errs}
+	}
+	return errs
+}
+
+// Start starts the clients of the destinations and returns the first error
+func (r *router) Start() error {
+	for name, client := range r.destinations {
+		if err := StartClient(client); err != nil {
+			return fmt.Errorf("destination %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the clients of the destinations and returns the first error
+func (r *router) Close() error {
+	return closeClients(r.destinations)
+}
+
+// closeClients closes the clients and returns the first error
+func closeClients(clients map[string]HttpClient) error {
+	var first error
+	for _, client := range clients {
+		if err := closeClient(client); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// DestinationError is the failure of a single destination
+type DestinationError struct {
+	Destination string
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("destination %s: %v", e.Destination, e.Err)
+}
+func (e *DestinationError) Unwrap() error { return e.Err }
+
+// DestinationErrors is returned when the message could not be delivered to one or more destinations
+type DestinationErrors []*DestinationError
+
+func (e DestinationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether every destination error matches the target, e.g. the message expired for all the destinations
+func (e DestinationErrors) Is(target error) bool {
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+	return len(e) > 0
+}
+
+// As finds the first destination error that matches the target
+func (e DestinationErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e DestinationErrors) failed(dest string) bool {
+	for _, err := range e {
+		if err.Destination == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrPartialDelivery is matched by the error of a message delivered to some of its destinations only
+var ErrPartialDelivery = errors.New("partially delivered")
+
+// PartialDeliveryError is returned when the message was delivered to some of its destinations only,
+// it never matches the errors of the failed destinations, e.g. it is not expired
+type PartialDeliveryError struct {
+	Delivered []string          // destinations the message was delivered to
+	Errors    DestinationErrors // failures of the other destinations
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("delivered to %s only: %v", strings.Join(e.Delivered, ", "), e.Errors)
+}
+
+func (e *PartialDeliveryError) Is(target error) bool { return target == ErrPartialDelivery }
+
+// As finds the first destination error that matches the target
+func (e *PartialDeliveryError) As(target interface{}) bool { return e.Errors.As(target) }
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_router_Route(t *testing.T) {
+	dests := []Destination{
+		{Name: "ops", URL: "http://localhost/ops"},
+		{Name: "pager", URL: "http://localhost/pager"},
+		{Name: "audit", URL: "http://localhost/audit"},
+	}
+	rules := []Rule{
+		{Name: "critical", Severity: "crit", Destinations: []string{"pager", "ops"}, Priority: "high"},
+		{Name: "team-db", Field: "labels.team", Value: "^db$", Destinations: []string{"ops"}},
+		{Name: "login", Regex: "(?i)login", Destinations: []string{"audit"}, Priority: "low"},
+	}
+	tests := map[string]struct {
+		mode    string
+		msg     string
+		want    Route
+		wantErr bool
+	}{
+		"Should match the first rule on severity": {
+			msg:  `{"severity":"alert","labels":{"team":"db"}}`,
+			want: Route{Rules: []string{"critical"}, Destinations: []string{"pager", "ops"}, Priority: PriorityHigh},
+		},
+		"Should match all the rules in all mode": {
+			mode: RouteModeAll,
+			msg:  `{"severity_code":0,"labels":{"team":"db"},"message":"login failed"}`,
+			want: Route{Rules: []string{"critical", "team-db", "login"}, Destinations: []string{"pager", "ops", "audit"}, Priority: PriorityHigh},
+		},
+		"Should match the json field rule": {
+			msg:  `{"level":"info","labels":{"team":"db"}}`,
+			want: Route{Rules: []string{"team-db"}, Destinations: []string{"ops"}},
+		},
+		"Should match the regex rule on plain text": {
+			msg:  "User LOGIN from 10.0.0.1",
+			want: Route{Rules: []string{"login"}, Destinations: []string{"audit"}, Priority: PriorityLow},
+		},
+		"Should use the default route when no rule matches": {
+			msg:  "hello world",
+			want: Route{Destinations: []string{DefaultDestination}},
+		},
+		"Should fail when mode is invalid": {
+			mode:    "some",
+			wantErr: true,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			r, err := NewRouter(zap.NewNop(), &RoutesConfig{Mode: testCase.mode, Destinations: dests, Rules: rules}, "http://localhost/default")
+			if testCase.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, r.Route(testCase.msg))
+		})
+	}
+}
+
+func Test_NewRouter_Invalid(t *testing.T) {
+	tests := map[string]*RoutesConfig{
+		"Should fail when rule refers unknown destination": {
+			Rules: []Rule{{Name: "r", Regex: "x", Destinations: []string{"missing"}}},
+		},
+		"Should fail when regex is invalid": {
+			Destinations: []Destination{{Name: "ops", URL: "http://localhost"}},
+			Rules:        []Rule{{Name: "r", Regex: "(", Destinations: []string{"ops"}}},
+		},
+		"Should fail when destination url is invalid": {
+			Destinations: []Destination{{Name: "ops", URL: "localhost"}},
+		},
+		"Should fail when template is invalid": {
+			Destinations: []Destination{{Name: "ops", URL: "http://localhost", Template: "{{.Message"}},
+		},
+		"Should fail when default route refers unknown destination": {
+			Default: []string{"missing"},
+		},
+	}
+	for testName, cfg := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := NewRouter(zap.NewNop(), cfg, "")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_router_Notify(t *testing.T) {
+	type request struct {
+		path, body, token string
+	}
+	received := make(chan request, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- request{path: r.URL.Path, body: string(b), token: r.Header.Get("X-Token")}
+	}))
+	defer srv.Close()
+
+	rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.NoError(t, os.WriteFile(rulesFile, []byte(`
+mode: first
+destinations:
+  - name: chat
+    url: `+srv.URL+`/chat
+    headers:
+      X-Token: secret
+    template: '{"text": {{json .Message}}, "host": "{{field . "hostname"}}"}'
+    rate: 100
+rules:
+  - name: errors
+    field: severity
+    value: err
+    destinations: [chat]
+`), 0o600))
+	cfg, err := LoadRoutes(rulesFile)
+	assert.NoError(t, err)
+	r, err := NewRouter(zap.NewNop(), cfg, srv.URL+"/default")
+	assert.NoError(t, err)
+
+	r.Notify(NewMessage(`{"severity":"err","hostname":"box"}`))
+	assert.Equal(t, request{path: "/chat", body: `{"text": "{\"severity\":\"err\",\"hostname\":\"box\"}", "host": "box"}`, token: "secret"}, <-received)
+
+	r.Notify(NewMessage("plain message"))
+	assert.Equal(t, request{path: "/default", body: "plain message"}, <-received)
+}
+
+func Test_router_PartialDelivery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pager" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	r, err := NewRouter(zap.NewNop(), &RoutesConfig{
+		Mode:         RouteModeAll,
+		Destinations: []Destination{{Name: "ops", URL: srv.URL + "/ops"}, {Name: "pager", URL: srv.URL + "/pager"}},
+		Rules:        []Rule{{Name: "all", Regex: ".", Destinations: []string{"ops", "pager"}}},
+	}, "")
+	assert.NoError(t, err)
+
+	err = r.Notify(NewMessage("disk full"))
+	var partial *PartialDeliveryError
+	if assert.ErrorAs(t, err, &partial) {
+		assert.Equal(t, []string{"ops"}, partial.Delivered)
+	}
+	assert.ErrorIs(t, err, ErrPartialDelivery)
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+}
+
+func Test_DestinationErrors_Is(t *testing.T) {
+	expired := &DestinationError{Destination: "ops", Err: ErrExpired}
+	failed := &DestinationError{Destination: "pager", Err: &StatusError{StatusCode: http.StatusBadGateway}}
+
+	assert.ErrorIs(t, DestinationErrors{expired}, ErrExpired)
+	assert.NotErrorIs(t, DestinationErrors{expired, failed}, ErrExpired, "expired for some of the destinations only")
+	partial := &PartialDeliveryError{Delivered: []string{"audit"}, Errors: DestinationErrors{expired}}
+	assert.NotErrorIs(t, partial, ErrExpired, "delivered to some of the destinations")
+	assert.Equal(t, "delivered to audit only: destination ops: message expired", partial.Error())
+}
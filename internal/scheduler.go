@@ -0,0 +1,355 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultDelayField     = "delay"      // default JSON field carrying the delay of the message
+	DefaultDeliverAtField = "deliver_at" // default JSON field carrying the delivery time of the message
+)
+
+// ScheduleConfig holds the delayed delivery options
+type ScheduleConfig struct {
+	Delay          time.Duration // delay of every message, the message fields take precedence
+	DelayField     string        // dotted JSON field carrying the delay in seconds or as duration
+	DeliverAtField string        // dotted JSON field carrying the delivery time as RFC 3339 or unix seconds
+	Store          string        // file to persist the pending messages across runs, in memory only when empty
+}
+
+// Scheduler is the interface that groups the Run, Pending, Dropped and Close methods
+type Scheduler interface {
+	Run(ctx context.Context, in <-chan *Message, out chan<- *Message)
+	Pending() int
+	Dropped() uint64
+	Close() error
+}
+
+// scheduled is a message held until it is due
+type scheduled struct {
+	Body string    `json:"body"`
+	Due  time.Time `json:"due"`
+	seq  uint64    // arrival order of the messages due at the same time
+	msg  *Message  // envelope of the message, a new one is made for the messages restored from the store
+}
+
+// message returns the envelope of the scheduled message
+func (s *scheduled) message() *Message {
+	if s.msg == nil {
+		return NewMessage(s.Body)
+	}
+	return s.msg
+}
+
+// scheduleHeap orders the messages by due time
+type scheduleHeap []*scheduled
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].Due.Equal(h[j].Due) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].Due.Before(h[j].Due)
+}
+func (h scheduleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x interface{}) { *h = append(*h, x.(*scheduled)) }
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// scheduler type
+type scheduler struct {
+	mu      sync.Mutex
+	logger  *zap.Logger    // logger
+	cfg     ScheduleConfig // options
+	pending scheduleHeap   // messages not yet due
+	seq     uint64         // arrival counter
+	dropped uint64         // messages dropped on cancellation, the pending ones are kept
+	clock   Clock          // current time and timers
+	writeMu sync.Mutex     // orders the writes of the store
+	changed chan struct{}  // signals the writer that the pending messages changed
+}
+
+// NewScheduler constructor, the pending messages are loaded from the store when configured
+func NewScheduler(logger *zap.Logger, cfg ScheduleConfig, clock Clock) (Scheduler, error) {
+	s := &scheduler{
+		logger:  logger,
+		cfg:     cfg,
+		clock:   clock,
+		changed: make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run holds the messages received from in until they are due and sends them to out,
+// messages without delay are passed through, returns once in is closed and nothing is pending, the due messages
+// are sent and the others kept for the next run when persisted, or once cancelled, out is closed once it returns
+func (s *scheduler) Run(ctx context.Context, in <-chan *Message, out chan<- *Message) {
+	defer close(out)
+	if s.cfg.Store != "" {
+		done := make(chan struct{})
+		defer close(done)
+		go s.write(done)
+	}
+	for {
+		var timer Timer
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			timer = s.clock.NewTimer(s.pending[0].Due.Sub(s.clock.Now()))
+		}
+		s.mu.Unlock()
+		if in == nil && (timer == nil || s.cfg.Store != "") {
+			if timer != nil {
+				timer.Stop()
+				s.release(ctx, out)
+			}
+			return
+		}
+		var (
+			wake <-chan time.Time
+			ok   bool
+		)
+		if timer != nil {
+			wake = timer.C()
+		}
+		in, ok = s.step(ctx, in, out, wake)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !ok {
+			if in != nil {
+				atomic.AddUint64(&s.dropped, discard(in))
+			}
+			return
+		}
+	}
+}
+
+// step waits for the next message or the next due time, the returned input is nil once it is closed
+func (s *scheduler) step(ctx context.Context, in <-chan *Message, out chan<- *Message, wake <-chan time.Time) (<-chan *Message, bool) {
+	select {
+	case msg, ok := <-in:
+		if !ok {
+			return nil, true
+		}
+		now := s.clock.Now()
+		due := s.due(msg.Body, now)
+		if !due.After(now) {
+			if !s.send(ctx, out, msg) {
+				atomic.AddUint64(&s.dropped, 1)
+				return in, false
+			}
+			return in, true
+		}
+		// the time to live counts from the due time
+		if !msg.Deadline.IsZero() {
+			msg.Deadline = msg.Deadline.Add(due.Sub(now))
+		}
+		s.mu.Lock()
+		s.push(&scheduled{Body: msg.Body, Due: due, msg: msg})
+		s.mu.Unlock()
+		s.writeThrough()
+		s.logger.Debug("message scheduled", zap.Time("due", due))
+		return in, true
+	case <-wake:
+		return in, s.release(ctx, out)
+	case <-ctx.Done():
+		return in, false
+	}
+}
+
+// release sends the messages which are due, the message is kept pending when cancelled
+func (s *scheduler) release(ctx context.Context, out chan<- *Message) bool {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 || s.pending[0].Due.After(s.clock.Now()) {
+			s.mu.Unlock()
+			return true
+		}
+		item := heap.Pop(&s.pending).(*scheduled)
+		s.mu.Unlock()
+		if !s.send(ctx, out, item.message()) {
+			s.mu.Lock()
+			heap.Push(&s.pending, item)
+			s.mu.Unlock()
+			return false
+		}
+		// the store keeps the message until it is passed on
+		s.writeThrough()
+	}
+}
+
+func (s *scheduler) send(ctx context.Context, out chan<- *Message, msg *Message) bool {
+	select {
+	case out <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *scheduler) push(item *scheduled) {
+	s.seq++
+	item.seq = s.seq
+	heap.Push(&s.pending, item)
+}
+
+// due returns the delivery time of the message, the delivery time field takes precedence over the delay
+func (s *scheduler) due(msg string, now time.Time) time.Time {
+	if s.cfg.DeliverAtField != "" {
+		if v, ok := Field(msg, s.cfg.DeliverAtField); ok {
+			at, err := ParseDeliverAt(v)
+			if err == nil {
+				return at
+			}
+			s.logger.Warn("invalid message delivery time", zap.Error(err))
+		}
+	}
+	if s.cfg.DelayField != "" {
+		if v, ok := Field(msg, s.cfg.DelayField); ok {
+			// same format as the time to live
+			delay, err := ParseTTL(v)
+			if err == nil {
+				return now.Add(delay)
+			}
+			s.logger.Warn("invalid message delay", zap.Error(err))
+		}
+	}
+	return now.Add(s.cfg.Delay)
+}
+
+// ParseDeliverAt parses the delivery time given as RFC 3339 timestamp or as unix seconds
+func ParseDeliverAt(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	at, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid delivery time %q, should be RFC 3339 or unix seconds", s)
+	}
+	return at, nil
+}
+
+// Dropped returns the number of messages dropped on cancellation, the pending messages are not included
+func (s *scheduler) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Pending returns the number of messages not yet due
+func (s *scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Close persists the pending messages to the store, they are dropped when no store is configured
+func (s *scheduler) Close() error {
+	pending := s.Pending()
+	if s.cfg.Store == "" {
+		if pending > 0 {
+			s.logger.Warn("dropping scheduled messages", zap.Int("pending", pending))
+		}
+		return nil
+	}
+	if err := s.persist(); err != nil {
+		return err
+	}
+	s.logger.Info("scheduled messages persisted", zap.Int("pending", pending))
+	return nil
+}
+
+// writeThrough signals the writer to persist the pending messages, so that they survive a crash,
+// the changes made while the store is written are batched into the next write
+func (s *scheduler) writeThrough() {
+	if s.cfg.Store == "" {
+		return
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// write persists the pending messages on every change until done is closed
+func (s *scheduler) write(done <-chan struct{}) {
+	for {
+		select {
+		case <-s.changed:
+			if err := s.persist(); err != nil {
+				s.logger.Error("failed to persist scheduled messages", zap.Error(err))
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// persist writes a snapshot of the pending messages to the store, the file is written without holding the lock
+func (s *scheduler) persist() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	items := make([]*scheduled, len(s.pending))
+	copy(items, s.pending)
+	s.mu.Unlock()
+	sort.Sort(scheduleHeap(items))
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	// write to temp file and rename, so that the store is never partially written
+	tmp := s.cfg.Store + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to persist scheduled messages: %w", err)
+	}
+	return os.Rename(tmp, s.cfg.Store)
+}
+
+// load restores the persisted pending messages
+func (s *scheduler) load() error {
+	if s.cfg.Store == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.cfg.Store)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read schedule store: %w", err)
+	}
+	var items []*scheduled
+	if err := json.Unmarshal(b, &items); err != nil {
+		return fmt.Errorf("failed to parse schedule store %s: %w", s.cfg.Store, err)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Due.Before(items[j].Due) })
+	for _, item := range items {
+		s.push(item)
+	}
+	s.logger.Debug("scheduled messages restored", zap.Int("pending", len(s.pending)))
+	return nil
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// waitScheduled waits until the scheduler holds the pending messages and waits for the first one to be due
+func waitScheduled(s Scheduler, clock *FakeClock, pending int) {
+	for s.Pending() != pending || (pending > 0 && clock.Waiters() == 0) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_scheduler_Run(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		want    []string
+	}
+	tests := map[string]struct {
+		cfg   ScheduleConfig
+		input []string
+		steps []step
+	}{
+		"Should pass through the messages without delay": {
+			cfg:   ScheduleConfig{DelayField: DefaultDelayField, DeliverAtField: DefaultDeliverAtField},
+			input: []string{"msg1", `{"id":2}`, "msg3"},
+			steps: []step{{want: []string{"msg1", `{"id":2}`, "msg3"}}},
+		},
+		"Should deliver the messages in the order they are due": {
+			cfg: ScheduleConfig{DelayField: DefaultDelayField, DeliverAtField: DefaultDeliverAtField},
+			input: []string{
+				`{"id":1,"delay":"60s"}`, `{"id":2,"deliver_at":"2022-06-01T10:00:40Z"}`, `{"id":3,"delay":20}`, `{"id":4}`,
+			},
+			steps: []step{
+				{want: []string{`{"id":4}`}},
+				{advance: 20 * time.Second, want: []string{`{"id":3,"delay":20}`}},
+				{advance: 20 * time.Second, want: []string{`{"id":2,"deliver_at":"2022-06-01T10:00:40Z"}`}},
+				{advance: 20 * time.Second, want: []string{`{"id":1,"delay":"60s"}`}},
+			},
+		},
+		"Should delay every message with the global delay": {
+			cfg:   ScheduleConfig{Delay: 20 * time.Second, DelayField: DefaultDelayField},
+			input: []string{`{"id":1,"delay":"40s"}`, "msg2", `{"id":3,"delay":"0s"}`, "msg4"},
+			steps: []step{
+				{want: []string{`{"id":3,"delay":"0s"}`}},
+				{advance: 30 * time.Second, want: []string{"msg2", "msg4"}},
+				{advance: 10 * time.Second, want: []string{`{"id":1,"delay":"40s"}`}},
+			},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+			s, err := NewScheduler(zap.NewNop(), testCase.cfg, clock)
+			assert.NoError(t, err)
+			in := make(chan *Message, len(testCase.input))
+			out := make(chan *Message, len(testCase.input))
+			for _, msg := range testCase.input {
+				in <- NewMessage(msg)
+			}
+			close(in)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// returns once every scheduled message is sent
+				s.Run(context.Background(), in, out)
+			}()
+			pending := len(testCase.input)
+			for _, step := range testCase.steps {
+				pending -= len(step.want)
+				clock.Advance(step.advance)
+				var got []string
+				for range step.want {
+					got = append(got, (<-out).Body)
+				}
+				assert.Equal(t, step.want, got)
+				waitScheduled(s, clock, pending)
+			}
+			<-done
+			assert.Equal(t, 0, s.Pending())
+		})
+	}
+}
+
+func Test_scheduler_Store(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	cfg := ScheduleConfig{DelayField: DefaultDelayField, Store: filepath.Join(t.TempDir(), "schedule.json")}
+	s, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	in := make(chan *Message, 3)
+	out := make(chan *Message, 3)
+	in <- NewMessage(`{"id":1,"delay":"1h"}`)
+	in <- NewMessage(`{"id":2,"delay":"5m"}`)
+	in <- NewMessage(`{"id":3}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, in, out)
+	}()
+	assert.Equal(t, `{"id":3}`, (<-out).Body)
+	waitScheduled(s, clock, 2)
+	cancel()
+	close(in)
+	<-done
+	assert.NoError(t, s.Close())
+
+	// the pending messages survive the restart, the overdue message is sent at once
+	clock.Advance(10 * time.Minute)
+	restored, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, restored.Pending())
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	out = make(chan *Message, 2)
+	go restored.Run(ctx, make(chan *Message), out)
+	assert.Equal(t, `{"id":2,"delay":"5m"}`, (<-out).Body)
+	waitScheduled(restored, clock, 1)
+	clock.Advance(50 * time.Minute)
+	assert.Equal(t, `{"id":1,"delay":"1h"}`, (<-out).Body)
+}
+
+func Test_ParseDeliverAt(t *testing.T) {
+	at, err := ParseDeliverAt("2022-06-01T10:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC), at.UTC())
+
+	at, err = ParseDeliverAt("1654077600")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC), at.UTC())
+
+	_, err = ParseDeliverAt("tomorrow")
+	assert.Error(t, err)
+}
+
+func Test_scheduler_Deadline(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	s, err := NewScheduler(zap.NewNop(), ScheduleConfig{DelayField: DefaultDelayField}, clock)
+	assert.NoError(t, err)
+	in := make(chan *Message, 1)
+	out := make(chan *Message, 1)
+	in <- &Message{Body: `{"delay":"1h"}`, Enqueued: now, Deadline: now.Add(time.Minute)}
+	close(in)
+	go s.Run(context.Background(), in, out)
+	waitScheduled(s, clock, 1)
+	clock.Advance(time.Hour)
+
+	// the time to live counts from the due time, the read time is kept
+	msg := <-out
+	assert.Equal(t, now, msg.Enqueued)
+	assert.Equal(t, now.Add(time.Hour+time.Minute), msg.Deadline)
+	assert.False(t, msg.Expired(clock.Now()))
+}
+
+func Test_scheduler_WriteThrough(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	cfg := ScheduleConfig{DelayField: DefaultDelayField, Store: filepath.Join(t.TempDir(), "schedule.json")}
+	s, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	in := make(chan *Message, 2)
+	out := make(chan *Message, 2)
+	in <- NewMessage(`{"id":1,"delay":"1h"}`)
+	in <- NewMessage(`{"id":2,"delay":"5m"}`)
+	go s.Run(context.Background(), in, out)
+	waitScheduled(s, clock, 2)
+
+	// persisted without closing, as if the process was killed
+	assert.Eventually(t, func() bool {
+		restored, err := NewScheduler(zap.NewNop(), cfg, clock)
+		return err == nil && restored.Pending() == 2
+	}, time.Second, time.Millisecond)
+
+	// released messages are removed from the store
+	clock.Advance(5 * time.Minute)
+	assert.Equal(t, `{"id":2,"delay":"5m"}`, (<-out).Body)
+	waitScheduled(s, clock, 1)
+	assert.Eventually(t, func() bool {
+		restored, err := NewScheduler(zap.NewNop(), cfg, clock)
+		return err == nil && restored.Pending() == 1
+	}, time.Second, time.Millisecond)
+}
+
+func Test_scheduler_PassThrough(t *testing.T) {
+	cfg := ScheduleConfig{DelayField: DefaultDelayField, Store: filepath.Join(t.TempDir(), "schedule.json")}
+	// real clock, the message without delay is due at once however late it is checked
+	s, err := NewScheduler(zap.NewNop(), cfg, NewClock())
+	assert.NoError(t, err)
+	in := make(chan *Message, 1)
+	out := make(chan *Message, 1)
+	in <- NewMessage(`{"id":1}`)
+	close(in)
+	s.Run(context.Background(), in, out)
+
+	// passed through without being scheduled nor persisted
+	assert.Equal(t, `{"id":1}`, (<-out).Body)
+	assert.NoFileExists(t, cfg.Store)
+}
+
+func Test_scheduler_Store_Completed(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	cfg := ScheduleConfig{DelayField: DefaultDelayField, Store: filepath.Join(t.TempDir(), "schedule.json")}
+	s, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	in := make(chan *Message, 2)
+	out := make(chan *Message, 2)
+	in <- NewMessage(`{"id":1,"delay":"1h"}`)
+	in <- NewMessage(`{"id":2}`)
+	close(in)
+
+	// returns once the input is completed, the pending message is kept for the next run
+	s.Run(context.Background(), in, out)
+	assert.Equal(t, `{"id":2}`, (<-out).Body)
+	assert.Equal(t, 1, s.Pending())
+	assert.Equal(t, uint64(0), s.Dropped())
+}
+
+func Test_scheduler_Store_Due(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	cfg := ScheduleConfig{DelayField: DefaultDelayField, Store: filepath.Join(t.TempDir(), "schedule.json")}
+	s, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	in := make(chan *Message, 2)
+	in <- NewMessage(`{"id":1,"delay":"1h"}`)
+	in <- NewMessage(`{"id":2,"delay":"5m"}`)
+	close(in)
+	s.Run(context.Background(), in, make(chan *Message, 2))
+	assert.NoError(t, s.Close())
+
+	// the messages due by the next run are sent before it returns, the others are kept
+	clock.Advance(10 * time.Minute)
+	restored, err := NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	in = make(chan *Message)
+	close(in)
+	out := make(chan *Message, 2)
+	restored.Run(context.Background(), in, out)
+	assert.Equal(t, `{"id":2,"delay":"5m"}`, (<-out).Body)
+	assert.Equal(t, 1, restored.Pending())
+	assert.NoError(t, restored.Close())
+	restored, err = NewScheduler(zap.NewNop(), cfg, clock)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored.Pending())
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSecretTimeout = 10 * time.Second // max run time of the exec secret command
+)
+
+// ErrStaleSecret is returned along with the last value of the secret when its refresh failed
+var ErrStaleSecret = errors.New("stale secret")
+
+// SecretProvider resolves the secret reference without its scheme, e.g. the variable name of env:NAME
+type SecretProvider func(ref string) (string, error)
+
+// secretProviders are the secret providers by scheme
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"env":  envSecret,
+		"file": fileSecret,
+		"exec": execSecret,
+	}
+)
+
+// RegisterSecretProvider adds or replaces the provider of the scheme
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[scheme] = provider
+}
+
+// secretProvider returns the provider and the reference of a scheme:reference value, nil for a plain value
+func secretProvider(value string) (SecretProvider, string) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return nil, ""
+	}
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+	return secretProviders[value[:i]], value[i+1:]
+}
+
+// IsSecretRef reports whether the value is a secret reference of a registered scheme, e.g. env:TOKEN
+func IsSecretRef(value string) bool {
+	provider, _ := secretProvider(value)
+	return provider != nil
+}
+
+// ResolveSecret returns the secret of the reference, a plain value is returned as it is,
+// the errors never contain the secret
+func ResolveSecret(value string) (string, error) {
+	provider, ref := secretProvider(value)
+	if provider == nil {
+		return value, nil
+	}
+	secret, err := provider(ref)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", value, err)
+	}
+	return secret, nil
+}
+
+func envSecret(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.New("environment variable not set")
+	}
+	return secret, nil
+}
+
+// fileSecret reads the file, the trailing newline is dropped
+func fileSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// execSecret runs the command, split on spaces without a shell, and returns its output without the trailing newline
+func execSecret(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSecretTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		// the stderr of the command is not included as it may echo the secret
+		return "", fmt.Errorf("command failed: %w", err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Secret is the value of a secret reference resolved once created and again in the background on every refresh
+// interval, e.g. for rotating tokens written to a file, the last value is kept when the refresh fails
+type Secret struct {
+	mu    sync.Mutex
+	ref   string        // secret reference or plain value
+	value string        // last resolved value
+	err   error         // error of the last refresh, until it is returned
+	stop  chan struct{} // stops the refresh, nil when never refreshed
+	once  sync.Once
+}
+
+// NewSecret resolves the secret reference and refreshes it every refresh interval until closed,
+// plain values are never refreshed
+func NewSecret(ref string, refresh time.Duration, clock Clock) (*Secret, error) {
+	value, err := ResolveSecret(ref)
+	if err != nil {
+		return nil, err
+	}
+	s := &Secret{ref: ref, value: value}
+	if IsSecretRef(ref) && refresh > 0 {
+		s.stop = make(chan struct{})
+		go s.refresh(orClock(clock).NewTicker(refresh))
+	}
+	return s, nil
+}
+
+// refresh resolves the secret again on every tick, so that a slow provider never holds back the callers of Value
+func (s *Secret) refresh(ticker Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			value, err := ResolveSecret(s.ref)
+			s.mu.Lock()
+			if err != nil {
+				s.err = fmt.Errorf("%w: %v", ErrStaleSecret, err)
+			} else {
+				s.value, s.err = value, nil
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Value returns the last resolved secret, the error of a failed refresh wraps ErrStaleSecret
+// and is returned once along with the last value
+func (s *Secret) Value() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.err
+	s.err = nil
+	return s.value, err
+}
+
+// Close stops the refresh of the secret
+func (s *Secret) Close() error {
+	if s.stop != nil {
+		s.once.Do(func() { close(s.stop) })
+	}
+	return nil
+}
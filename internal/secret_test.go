@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	t.Setenv("NOTIFIER_TEST_TOKEN", "from-env")
+
+	tests := map[string]struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		"Should return the plain value": {
+			value: "plain",
+			want:  "plain",
+		},
+		"Should keep the value of an unknown scheme": {
+			value: "https://example.com/hook",
+			want:  "https://example.com/hook",
+		},
+		"Should resolve the environment variable": {
+			value: "env:NOTIFIER_TEST_TOKEN",
+			want:  "from-env",
+		},
+		"Should read the file without the trailing newline": {
+			value: "file:" + file,
+			want:  "from-file",
+		},
+		"Should run the command": {
+			value: "exec:echo from-exec",
+			want:  "from-exec",
+		},
+		"Should fail on a missing environment variable": {
+			value:   "env:NOTIFIER_TEST_MISSING",
+			wantErr: "secret env:NOTIFIER_TEST_MISSING: environment variable not set",
+		},
+		"Should fail on a missing file": {
+			value:   "file:" + filepath.Join(dir, "missing"),
+			wantErr: "no such file or directory",
+		},
+		"Should fail on a failed command": {
+			value:   "exec:false",
+			wantErr: "secret exec:false: command failed: exit status 1",
+		},
+		"Should fail on an empty command": {
+			value:   "exec: ",
+			wantErr: "secret exec: : empty command",
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ResolveSecret(testCase.value)
+			if testCase.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), testCase.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func Test_RegisterSecretProvider(t *testing.T) {
+	assert.False(t, IsSecretRef("vault:notifier/token"))
+	RegisterSecretProvider("vault", func(ref string) (string, error) { return "secret of " + ref, nil })
+	defer func() {
+		secretProvidersMu.Lock()
+		delete(secretProviders, "vault")
+		secretProvidersMu.Unlock()
+	}()
+	assert.True(t, IsSecretRef("vault:notifier/token"))
+	got, err := ResolveSecret("vault:notifier/token")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret of notifier/token", got)
+}
+
+func Test_Secret_Refresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(file, []byte("first"), 0o600))
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	secret, err := NewSecret("file:"+file, time.Minute, clock)
+	assert.NoError(t, err)
+	defer secret.Close()
+
+	value := func() string {
+		v, err := secret.Value()
+		assert.NoError(t, err)
+		return v
+	}
+	assert.NoError(t, os.WriteFile(file, []byte("rotated"), 0o600))
+	assert.Equal(t, "first", value(), "cached until the refresh interval")
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return value() == "rotated" }, time.Second, time.Millisecond)
+
+	// the last value is kept when the refresh fails, the error is returned once
+	assert.NoError(t, os.Remove(file))
+	clock.Advance(time.Minute)
+	var v string
+	assert.Eventually(t, func() bool {
+		v, err = secret.Value()
+		return err != nil
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, err, ErrStaleSecret)
+	assert.Equal(t, "rotated", v)
+	assert.Equal(t, "rotated", value())
+
+	_, err = NewSecret("file:"+file, time.Minute, clock)
+	assert.Error(t, err, "resolved on creation")
+}
+
+func Test_Secret_SlowRefresh(t *testing.T) {
+	release := make(chan struct{})
+	calls := 0
+	RegisterSecretProvider("slow", func(ref string) (string, error) {
+		calls++
+		if calls > 1 {
+			<-release
+			return "rotated", nil
+		}
+		return "first", nil
+	})
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	secret, err := NewSecret("slow:token", time.Minute, clock)
+	assert.NoError(t, err)
+	defer secret.Close()
+
+	// the refresh runs in the background, the cached value is returned meanwhile
+	clock.Advance(time.Minute)
+	v, err := secret.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", v)
+	close(release)
+	assert.Eventually(t, func() bool {
+		v, _ := secret.Value()
+		return v == "rotated"
+	}, time.Second, time.Millisecond)
+}
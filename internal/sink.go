@@ -0,0 +1,216 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sink schemes of the destination urls
+const (
+	SchemeHTTP   = "http"   // POST to the url
+	SchemeHTTPS  = "https"  // POST to the url over TLS
+	SchemeFile   = "file"   // JSON lines appended to the file, file:///var/log/notifier.jsonl
+	SchemeStdout = "stdout" // JSON lines written to stdout for dry runs, stdout://
+	SchemeExec   = "exec"   // command run with the message on stdin, exec:///usr/local/bin/page?arg=--team&arg=ops
+
+	execTimeout = 30 * time.Second // max run time of the command of an exec sink
+)
+
+// Sink is the interface that wraps the Send method
+// Send delivers the rendered body once and returns the status code of the attempt, zero when there is none,
+// the retries, rate limit and metrics of the destination are handled by the caller.
+// The sinks holding files or connections also implement io.Closer to release them,
+// the sinks serving subscribers implement Start, called before the first send
+type Sink interface {
+	Send(body string, span *Span) (int, error)
+}
+
+// SinkFactory creates the sink of the destination, u is its url with the secret reference resolved
+type SinkFactory func(logger *zap.Logger, dest Destination, u *url.URL) (Sink, error)
+
+// sinkFactories are the sink factories by url scheme
+var (
+	sinkFactoriesMu sync.RWMutex
+	sinkFactories   = map[string]SinkFactory{
+		SchemeHTTP:   newHTTPSink,
+		SchemeHTTPS:  newHTTPSink,
+		SchemeFile:   newFileSink,
+		SchemeStdout: newStdoutSink,
+		SchemeExec:   newExecSink,
+		SchemeWS:     newWSSink,
+		SchemeWSS:    newWSSink,
+		SchemeSSE:    newSSESink,
+	}
+)
+
+// RegisterSink adds or replaces the sink factory of the url scheme
+func RegisterSink(scheme string, factory SinkFactory) {
+	sinkFactoriesMu.Lock()
+	defer sinkFactoriesMu.Unlock()
+	sinkFactories[scheme] = factory
+}
+
+// sinkFactory returns the factory of the url scheme, nil when there is none
+func sinkFactory(scheme string) SinkFactory {
+	sinkFactoriesMu.RLock()
+	defer sinkFactoriesMu.RUnlock()
+	return sinkFactories[scheme]
+}
+
+// sinkSchemes returns the registered schemes in order
+func sinkSchemes() []string {
+	sinkFactoriesMu.RLock()
+	defer sinkFactoriesMu.RUnlock()
+	schemes := make([]string, 0, len(sinkFactories))
+	for scheme := range sinkFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsSinkURL reports whether the value is a scheme://... url of a registered sink, such a url is never
+// a secret reference, e.g. file:///var/log/notifier.jsonl is a file sink while file:/run/secrets/url is a secret
+func IsSinkURL(value string) bool {
+	i := strings.Index(value, "://")
+	return i > 0 && sinkFactory(value[:i]) != nil
+}
+
+// sinkRecord is a line written by the file and stdout sinks
+type sinkRecord struct {
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"`
+	TraceID     string    `json:"trace_id,omitempty"`
+	Message     string    `json:"message"`
+}
+
+// jsonlSink writes the bodies as JSON lines
+type jsonlSink struct {
+	mu    sync.Mutex
+	name  string // destination name
+	clock Clock  // record time source
+	enc   *json.Encoder
+	w     io.Writer // output, closed with the sink when it is an io.Closer
+}
+
+func newJSONLSink(dest Destination, w io.Writer) *jsonlSink {
+	return &jsonlSink{name: dest.Name, clock: orClock(dest.Clock), enc: json.NewEncoder(w), w: w}
+}
+
+// Send writes the record of the body
+func (s *jsonlSink) Send(body string, span *Span) (int, error) {
+	record := sinkRecord{Time: s.clock.Now(), Destination: s.name, Message: body}
+	if id := span.TraceID(); id.IsValid() {
+		record.TraceID = id.String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return 0, s.enc.Encode(record)
+}
+
+// Close closes the file of the file sinks, stdout is kept open
+func (s *jsonlSink) Close() error {
+	if s.w == stdout {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return closeClient(s.w)
+}
+
+// newFileSink appends to the file of the url path, rotated once over max_size MB keeping max_backups files,
+// e.g. file:///var/log/notifier.jsonl?max_size=10&max_backups=3
+func newFileSink(_ *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+	path := u.Path
+	if u.Host != "" && u.Host != "localhost" {
+		path = u.Host + u.Path // relative path, e.g. file://notifier.jsonl
+	}
+	if path == "" {
+		return nil, errors.New("file url without path")
+	}
+	maxSize, maxBackups := DefaultLogMaxSize, DefaultLogMaxBackups
+	for key, n := range map[string]*int{"max_size": &maxSize, "max_backups": &maxBackups} {
+		if v := u.Query().Get(key); v != "" {
+			var err error
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+		}
+	}
+	f, err := NewRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return newJSONLSink(dest, f), nil
+}
+
+// stdout is the output of the stdout sinks
+var stdout io.Writer = os.Stdout
+
+func newStdoutSink(_ *zap.Logger, dest Destination, _ *url.URL) (Sink, error) {
+	return newJSONLSink(dest, stdout), nil
+}
+
+// execSink runs the command with the body on stdin
+type execSink struct {
+	name string   // destination name
+	path string   // command
+	args []string // command arguments
+}
+
+// newExecSink runs the command of the url path with the arg query values as arguments
+func newExecSink(_ *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+	path := u.Host + u.Path // exec://page is looked up in the PATH, exec:///usr/local/bin/page is absolute
+	if path == "" {
+		return nil, errors.New("exec url without command")
+	}
+	return &execSink{name: dest.Name, path: path, args: u.Query()["arg"]}, nil
+}
+
+// Send runs the command, a non zero exit code fails the attempt, the destination and the traceparent
+// of the attempt are passed in the NOTIFIER_DESTINATION and TRACEPARENT environment variables
+func (s *execSink) Send(body string, span *Span) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.path, s.args...)
+	cmd.Stdin = strings.NewReader(body)
+	cmd.Env = append(os.Environ(), "NOTIFIER_DESTINATION="+s.name)
+	if span != nil {
+		cmd.Env = append(cmd.Env, "TRACEPARENT="+span.Traceparent())
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		span.SetAttr("exec.exit_code", strconv.Itoa(exitErr.ExitCode()))
+		if line := strings.SplitN(strings.TrimSpace(stderr.String()), "\n", 2)[0]; line != "" {
+			return 0, fmt.Errorf("command %s: %w: %s", s.path, err, line)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("command %s: %w", s.path, err)
+	}
+	span.SetAttr("exec.exit_code", "0")
+	return 0, nil
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_FileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifier.jsonl")
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	metrics := NewMetrics()
+	client, err := NewDestinationClient(zap.NewNop(), Destination{
+		Name:     "archive",
+		URL:      "file://" + path + "?max_size=1&max_backups=1",
+		Template: `{{field . "msg"}}`,
+		Clock:    clock,
+		Metrics:  metrics,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.Notify(NewMessage(`{"msg":"disk full"}`)))
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"time":"2022-06-01T10:00:00Z","destination":"archive","message":"disk full"}`+"\n", string(b))
+	assert.Equal(t, float64(1), metrics.delivered.total())
+	assert.Equal(t, float64(0), metrics.responses.total(), "no status code")
+
+	// rotated once over 1 MB
+	big := strings.Repeat("a", 600*1024)
+	assert.NoError(t, client.Notify(NewMessage(`{"msg":"`+big+`"}`)))
+	assert.NoError(t, client.Notify(NewMessage(`{"msg":"`+big+`"}`)))
+	backup, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(backup, []byte("\n")))
+	b, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(b, []byte("\n")))
+
+	// the file is released once closed
+	assert.NoError(t, client.(io.Closer).Close())
+	assert.Error(t, client.Notify(NewMessage(`{"msg":"after close"}`)))
+}
+
+func Test_StdoutSink(t *testing.T) {
+	out := new(bytes.Buffer)
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "dry-run", URL: "stdout://", Type: TypeSlack, Clock: clock})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Notify(NewMessage("disk full")))
+	assert.Equal(t, `{"time":"2022-06-01T10:00:00Z","destination":"dry-run","message":"{\"text\":\"disk full\"}"}`+"\n", out.String())
+}
+
+func Test_ExecSink(t *testing.T) {
+	tests := map[string]struct {
+		script   string
+		wantErr  string
+		wantRuns int
+	}{
+		"Should pass the message on stdin": {
+			script:   `echo "$NOTIFIER_DESTINATION: $(cat)" >> "$0"`,
+			wantRuns: 1,
+		},
+		"Should retry a failed command": {
+			script:   `echo "$NOTIFIER_DESTINATION: $(cat)" >> "$0"; echo boom >&2; exit 3`,
+			wantErr:  "command sh: exit status 3: boom",
+			wantRuns: 3,
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			query := url.Values{"arg": {"-c", testCase.script, out}}
+			retry := RetryPolicy{Attempts: 2, Backoff: time.Millisecond}
+			client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "page", URL: "exec://sh?" + query.Encode(), Retry: &retry})
+			assert.NoError(t, err)
+
+			err = client.Notify(NewMessage("disk full"))
+			if testCase.wantErr != "" {
+				assert.EqualError(t, err, testCase.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			b, err := os.ReadFile(out)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Repeat("page: disk full\n", testCase.wantRuns), string(b))
+		})
+	}
+}
+
+// memorySink records the bodies
+type memorySink struct {
+	bodies []string
+	err    error
+}
+
+func (s *memorySink) Send(body string, span *Span) (int, error) {
+	s.bodies = append(s.bodies, body)
+	return 0, s.err
+}
+
+func Test_RegisterSink(t *testing.T) {
+	sink := &memorySink{}
+	RegisterSink("memory", func(logger *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+		assert.Equal(t, "queue", u.Host)
+		return sink, nil
+	})
+	defer func() {
+		sinkFactoriesMu.Lock()
+		delete(sinkFactories, "memory")
+		sinkFactoriesMu.Unlock()
+	}()
+
+	retry := RetryPolicy{Attempts: 1, Backoff: time.Millisecond}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: "memory://queue", MaxLength: 4, Retry: &retry})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Notify(NewMessage("disk full")))
+	assert.Equal(t, []string{"disk", "full"}, sink.bodies)
+
+	// the retries are shared by the sinks
+	sink.bodies, sink.err = nil, errors.New("unavailable")
+	assert.EqualError(t, client.Notify(NewMessage("cpu")), "unavailable")
+	assert.Equal(t, []string{"cpu", "cpu"}, sink.bodies)
+}
+
+func Test_SinkURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "url")
+	assert.NoError(t, os.WriteFile(path, []byte("stdout://\n"), 0o600))
+
+	assert.True(t, IsSinkURL("file://"+path))
+	assert.False(t, IsSinkURL("file:"+path), "secret reference")
+	assert.False(t, IsSinkURL("ftp://localhost"))
+
+	// the url read from the secret file
+	_, err := NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: "file:" + path})
+	assert.NoError(t, err)
+
+	_, err = NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: "ftp://localhost"})
+	assert.EqualError(t, err, `destination test: invalid url scheme "ftp", should be exec, file, http, https, sse, stdout, ws, wss`)
+	_, err = NewDestinationClient(zap.NewNop(), Destination{Name: "test", URL: "exec://"})
+	assert.EqualError(t, err, "destination test: exec url without command")
+}
@@ -0,0 +1,285 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SchemeSSE = "sse" // Server-Sent Events served to the subscribers, sse://:8080/events
+
+	sseHeartbeat = 15 * time.Second // comment sent to idle subscribers so that the proxies keep the stream open
+	sseBuffer    = 64               // events buffered per subscriber, a slower subscriber misses the next ones
+)
+
+// sseServers are the SSE servers by listen address, shared by the sinks so that a reload keeps the subscribers
+var (
+	sseServersMu sync.Mutex
+	sseServers   = map[string]*sseServer{}
+)
+
+// sseServer serves the event streams of its paths once started, until its last sink is closed
+type sseServer struct {
+	logger *zap.Logger
+	addr   string         // listen address
+	ln     net.Listener   // listener once started, guarded by sseServersMu
+	srv    *http.Server   // server once started, guarded by sseServersMu
+	refs   int            // sinks of the server, guarded by sseServersMu
+	mux    *http.ServeMux // routes the paths served once to their current hub
+	mu     sync.Mutex     // guards hubs and routed
+	hubs   map[string]*sseHub
+	routed map[string]bool // paths handled by the mux
+}
+
+// sseServerOf returns the server of the address with a new reference, created without listening when there is none yet
+func sseServerOf(logger *zap.Logger, addr string) *sseServer {
+	sseServersMu.Lock()
+	defer sseServersMu.Unlock()
+	server, ok := sseServers[addr]
+	if !ok {
+		server = &sseServer{logger: logger, addr: addr, mux: http.NewServeMux(), hubs: map[string]*sseHub{}, routed: map[string]bool{}}
+		if _, port, _ := net.SplitHostPort(addr); port != "0" {
+			sseServers[addr] = server
+		}
+	}
+	server.refs++
+	return server
+}
+
+// start listens on the address unless the server is already listening
+func (s *sseServer) start() error {
+	sseServersMu.Lock()
+	defer sseServersMu.Unlock()
+	if s.ln != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.srv = &http.Server{Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+	sseServers[ln.Addr().String()] = s // e.g. the port chosen for :0
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("sse server stopped", zap.String("addr", s.addr), zap.Error(err))
+		}
+	}(s.srv)
+	s.logger.Info("serving server-sent events", zap.String("addr", ln.Addr().String()))
+	return nil
+}
+
+// release drops a reference to the server, the last one shuts it down
+func (s *sseServer) release() error {
+	sseServersMu.Lock()
+	defer sseServersMu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	for addr, server := range sseServers {
+		if server == s {
+			delete(sseServers, addr)
+		}
+	}
+	if s.srv == nil {
+		return nil
+	}
+	s.logger.Info("stopped serving server-sent events", zap.String("addr", s.ln.Addr().String()))
+	return s.srv.Close()
+}
+
+// hub returns the hub of the path with a new reference, serving it when there is none yet
+func (s *sseServer) hub(path string, clock Clock) *sseHub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hub, ok := s.hubs[path]
+	if !ok {
+		hub = &sseHub{logger: s.logger, clock: clock, path: path, done: make(chan struct{}), subscribers: map[chan []byte]struct{}{}}
+		s.hubs[path] = hub
+		// the mux can't drop a path, it is routed to the hub of the moment
+		if !s.routed[path] {
+			s.routed[path] = true
+			s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				s.mu.Lock()
+				hub := s.hubs[path]
+				s.mu.Unlock()
+				if hub == nil {
+					http.NotFound(w, r)
+					return
+				}
+				hub.ServeHTTP(w, r)
+			})
+		}
+	}
+	hub.refs++
+	return hub
+}
+
+// releaseHub drops a reference to the hub, the last one stops serving its path and disconnects its subscribers
+func (s *sseServer) releaseHub(hub *sseHub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hub.refs--; hub.refs > 0 {
+		return
+	}
+	delete(s.hubs, hub.path)
+	close(hub.done)
+}
+
+// sseHub broadcasts the events of a path to its subscribers
+type sseHub struct {
+	logger      *zap.Logger
+	clock       Clock         // heartbeat time source
+	path        string        // served path
+	refs        int           // sinks of the hub, guarded by the mutex of the server
+	done        chan struct{} // closed once the last sink of the hub is closed
+	mu          sync.Mutex
+	origin      string // allowed cross-origin subscribers, e.g. https://dash.example.com or *, none when empty
+	id          uint64 // id of the last event
+	subscribers map[chan []byte]struct{}
+}
+
+// ServeHTTP streams the events to the subscriber until it disconnects
+func (h *sseHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events := make(chan []byte, sseBuffer)
+	h.mu.Lock()
+	h.subscribers[events] = struct{}{}
+	origin := h.origin
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.subscribers, events)
+		h.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if origin != "" && (origin == "*" || origin == r.Header.Get("Origin")) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := h.clock.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-events:
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C():
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// publish sends the event to the subscribers and returns their number, a subscriber with a full buffer misses it
+func (h *sseHub) publish(event string, body string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.id++
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "id: %d\n", h.id)
+	if event != "" {
+		fmt.Fprintf(b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(body, "\n") {
+		fmt.Fprintf(b, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	b.WriteString("\n")
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- b.Bytes():
+		default:
+			h.logger.Warn("sse subscriber too slow, event dropped", zap.Uint64("id", h.id))
+		}
+	}
+	return len(h.subscribers)
+}
+
+// count returns the number of subscribers
+func (h *sseHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// sseSink publishes every body as an event of its hub, the delivery never waits for the subscribers
+type sseSink struct {
+	server *sseServer
+	hub    *sseHub
+	event  string // event type, message when empty
+	once   sync.Once
+}
+
+// newSSESink serves the events on the host and path of the url once started, the event and origin of the url query
+// set the event type and the allowed cross-origin subscribers
+func newSSESink(logger *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+	if u.Host == "" {
+		return nil, errors.New("sse url without listen address")
+	}
+	server := sseServerOf(logger, u.Host)
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	hub := server.hub(path, orClock(dest.Clock))
+	hub.mu.Lock()
+	hub.origin = u.Query().Get("origin")
+	hub.mu.Unlock()
+	return &sseSink{server: server, hub: hub, event: u.Query().Get("event")}, nil
+}
+
+// Start listens on the address of the sink, the server is shared by the sinks of the address
+func (s *sseSink) Start() error {
+	return s.server.start()
+}
+
+// Close stops serving the path once its last sink is closed, and the server once the last sink of the address is
+func (s *sseSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.server.releaseHub(s.hub)
+		err = s.server.release()
+	})
+	return err
+}
+
+// Send publishes the body, the lines of the body are the data lines of the event
+func (s *sseSink) Send(body string, span *Span) (int, error) {
+	span.SetAttr("sse.subscribers", strconv.Itoa(s.hub.publish(s.event, body)))
+	return 0, nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// readEvent reads the lines of the next event of the stream
+func readEvent(r *bufio.Reader) (string, error) {
+	var event strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == "\n" {
+			return event.String(), nil
+		}
+		event.WriteString(line)
+	}
+}
+
+func Test_SSESink(t *testing.T) {
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "browser", URL: "sse://127.0.0.1:0/events?event=notification&origin=*"})
+	assert.NoError(t, err)
+	assert.NoError(t, StartClient(client))
+	sink := client.(*sinkClient).sink.(*sseSink)
+	addr := sink.server.ln.Addr().String()
+
+	// delivered without subscribers
+	assert.NoError(t, client.Notify(NewMessage("dropped")))
+
+	resp, err := http.Get("http://" + addr + "/events")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Eventually(t, func() bool { return sink.hub.count() == 1 }, time.Second, time.Millisecond)
+
+	r := bufio.NewReader(resp.Body)
+	assert.NoError(t, client.Notify(NewMessage("disk full\non db-1")))
+	event, err := readEvent(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "id: 2\nevent: notification\ndata: disk full\ndata: on db-1\n", event)
+
+	// a reloaded destination keeps the server and its subscribers
+	reloaded, err := NewDestinationClient(zap.NewNop(), Destination{Name: "browser", URL: "sse://" + addr + "/events"})
+	assert.NoError(t, err)
+	assert.NoError(t, StartClient(reloaded))
+	assert.NoError(t, client.(io.Closer).Close())
+	assert.NoError(t, reloaded.Notify(NewMessage("cpu high")))
+	event, err = readEvent(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "id: 3\ndata: cpu high\n", event)
+
+	// the last close disconnects the subscribers and releases the port
+	assert.NoError(t, reloaded.(io.Closer).Close())
+	_, err = readEvent(r)
+	assert.Error(t, err)
+	ln, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	ln.Close()
+}
+
+func Test_SSESink_NotStarted(t *testing.T) {
+	addr := freeAddr(t, "tcp")
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "browser", URL: "sse://" + addr + "/events"})
+	assert.NoError(t, err)
+
+	// validating a config creates the sink without listening
+	ln, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	ln.Close()
+	assert.NoError(t, client.(io.Closer).Close())
+	sseServersMu.Lock()
+	defer sseServersMu.Unlock()
+	assert.NotContains(t, sseServers, addr)
+}
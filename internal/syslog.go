@@ -0,0 +1,429 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxSyslogUDPSize = 64 * 1024 // max size of a udp datagram
+
+var (
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	errInvalidSyslog = errors.New("invalid syslog message")
+)
+
+// SyslogMessage is the parsed RFC 3164 or RFC 5424 message,
+// it is passed on as JSON line so that the fields are available for templating and routing
+type SyslogMessage struct {
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	SeverityCode   int                          `json:"severity_code"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+}
+
+// ParseSyslogSeverity returns the severity code for the given name (e.g. warning) or code (e.g. 4)
+func ParseSyslogSeverity(s string) (int, error) {
+	if code, err := strconv.Atoi(s); err == nil && code >= 0 && code < len(syslogSeverities) {
+		return code, nil
+	}
+	for code, name := range syslogSeverities {
+		if strings.EqualFold(name, s) {
+			return code, nil
+		}
+	}
+	switch strings.ToLower(s) { // common aliases
+	case "emergency", "panic":
+		return 0, nil
+	case "critical":
+		return 2, nil
+	case "error":
+		return 3, nil
+	case "warn":
+		return 4, nil
+	}
+	return 0, fmt.Errorf("unknown syslog severity %q", s)
+}
+
+// ParseSyslog parses RFC 5424 message and falls back to RFC 3164
+func ParseSyslog(raw string) (*SyslogMessage, error) {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+	if !strings.HasPrefix(raw, "<") {
+		return nil, fmt.Errorf("%w: missing priority", errInvalidSyslog)
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("%w: malformed priority", errInvalidSyslog)
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, fmt.Errorf("%w: malformed priority", errInvalidSyslog)
+	}
+	msg := &SyslogMessage{
+		Facility:     syslogFacilities[pri/8],
+		Severity:     syslogSeverities[pri%8],
+		SeverityCode: pri % 8,
+	}
+	rest := raw[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return msg, parseRFC5424(msg, rest[2:])
+	}
+	parseRFC3164(msg, rest)
+	return msg, nil
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(msg *SyslogMessage, rest string) error {
+	header := make([]string, 5)
+	for i := range header {
+		idx := strings.IndexByte(rest, ' ')
+		if idx < 0 {
+			if i < 4 {
+				return fmt.Errorf("%w: truncated header", errInvalidSyslog)
+			}
+			idx = len(rest)
+		}
+		if v := rest[:idx]; v != "-" {
+			header[i] = v
+		}
+		rest = strings.TrimPrefix(rest[idx:], " ")
+	}
+	msg.Timestamp, msg.Hostname, msg.AppName, msg.ProcID, msg.MsgID = header[0], header[1], header[2], header[3], header[4]
+
+	switch {
+	case strings.HasPrefix(rest, "-"):
+		rest = rest[1:]
+	case strings.HasPrefix(rest, "["):
+		sd, n, err := parseStructuredData(rest)
+		if err != nil {
+			return err
+		}
+		msg.StructuredData = sd
+		rest = rest[n:]
+	case rest != "":
+		return fmt.Errorf("%w: malformed structured data", errInvalidSyslog)
+	}
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return nil
+}
+
+// parseStructuredData parses [id key="value" ...][id2 ...] and returns the number of bytes consumed
+func parseStructuredData(s string) (map[string]map[string]string, int, error) {
+	sd := map[string]map[string]string{}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+		start := i
+		for i < len(s) && s[i] != ' ' && s[i] != ']' {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("%w: unterminated structured data", errInvalidSyslog)
+		}
+		params := map[string]string{}
+		sd[s[start:i]] = params
+		for i < len(s) && s[i] == ' ' {
+			i++
+			eq := strings.IndexByte(s[i:], '=')
+			if eq < 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+				return nil, 0, fmt.Errorf("%w: malformed structured data param", errInvalidSyslog)
+			}
+			name := s[i : i+eq]
+			i += eq + 2
+			var value strings.Builder
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, 0, fmt.Errorf("%w: unterminated structured data value", errInvalidSyslog)
+			}
+			params[name] = value.String()
+			i++ // closing quote
+		}
+		if i >= len(s) || s[i] != ']' {
+			return nil, 0, fmt.Errorf("%w: unterminated structured data", errInvalidSyslog)
+		}
+		i++
+	}
+	return sd, i, nil
+}
+
+// parseRFC3164 parses the best effort BSD format TIMESTAMP HOSTNAME TAG[PID]: MSG
+func parseRFC3164(msg *SyslogMessage, rest string) {
+	if len(rest) >= len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			msg.Timestamp = rest[:len(time.Stamp)]
+			rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+			if idx := strings.IndexByte(rest, ' '); idx > 0 {
+				msg.Hostname, rest = rest[:idx], rest[idx+1:]
+			}
+		}
+	}
+	// tag is terminated by colon, pid is optionally enclosed in brackets
+	if idx := strings.IndexByte(rest, ':'); idx > 0 && idx <= 48 && !strings.ContainsAny(rest[:idx], " ") {
+		tag := rest[:idx]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			msg.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		msg.AppName = tag
+		rest = strings.TrimPrefix(rest[idx+1:], " ")
+	}
+	msg.Message = rest
+}
+
+// SyslogConfig holds the syslog receiver options
+type SyslogConfig struct {
+	ListenerConfig     // limits for the tcp connections
+	MaxSeverity    int // messages less severe than this severity code are dropped
+}
+
+// syslogListener type
+type syslogListener struct {
+	logger       *zap.Logger  // logger
+	network      string       // udp or tcp
+	address      string       // address to listen on
+	cfg          SyslogConfig // receiver options
+	producerChan chan string  // channel to send the parsed messages
+}
+
+// NewSyslogListener constructor, rawAddr is of the form udp://host:port or tcp://host:port
+func NewSyslogListener(logger *zap.Logger, rawAddr string, cfg SyslogConfig, producerChan chan string) (Listener, error) {
+	u, err := url.Parse(rawAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", rawAddr, err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("invalid syslog address %q: unsupported scheme %q", rawAddr, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog address %q: empty address", rawAddr)
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultListenMaxConns
+	}
+	if cfg.MaxLineSize <= 0 {
+		cfg.MaxLineSize = DefaultListenMaxLineSize
+	}
+	return &syslogListener{
+		logger:       logger.With(zap.String("syslog", rawAddr)),
+		network:      u.Scheme,
+		address:      u.Host,
+		cfg:          cfg,
+		producerChan: producerChan,
+	}, nil
+}
+
+// Serve receives syslog messages until the context is cancelled
+func (s *syslogListener) Serve(ctx context.Context) error {
+	if s.network == "udp" {
+		return s.serveUDP(ctx)
+	}
+	return s.serveTCP(ctx)
+}
+
+func (s *syslogListener) serveUDP(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp://%s: %w", s.address, err)
+	}
+	s.logger.Info("listening for syslog messages", zap.String("addr", conn.LocalAddr().String()))
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, maxSyslogUDPSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !s.handle(ctx, string(buf[:n])) {
+			return nil
+		}
+	}
+}
+
+func (s *syslogListener) serveTCP(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on tcp://%s: %w", s.address, err)
+	}
+	s.logger.Info("listening for syslog messages", zap.String("addr", ln.Addr().String()))
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	conns := make(chan struct{}, s.cfg.MaxConns)
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case conns <- struct{}{}:
+		default:
+			s.logger.Warn("connection limit reached, rejecting connection", zap.Int("maxConns", s.cfg.MaxConns))
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-conns }()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// handleConn reads the frames of a tcp connection, both octet counting and
+// newline delimited framing are supported (RFC 6587)
+func (s *syslogListener) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// close the connection on cancellation to unblock the reader
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r := bufio.NewReaderSize(conn, 4096)
+	for {
+		frame, err := s.readFrame(r)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				s.logger.Warn("closing syslog connection", zap.Error(err))
+			}
+			return
+		}
+		if !s.handle(ctx, frame) {
+			return
+		}
+	}
+}
+
+func (s *syslogListener) readFrame(r *bufio.Reader) (string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '1' && first[0] <= '9' { // octet counting, MSG-LEN SP SYSLOG-MSG
+		n, err := s.readFrameLen(r)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > s.cfg.MaxLineSize {
+			return "", fmt.Errorf("line exceeded max line size of %d", s.cfg.MaxLineSize)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// readFrameLen reads the octet count and the space after it, reading at most the digits of the max line size
+func (s *syslogListener) readFrameLen(r *bufio.Reader) (int, error) {
+	maxDigits := len(strconv.Itoa(s.cfg.MaxLineSize))
+	var digits []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == ' ' {
+			break
+		}
+		digits = append(digits, c)
+		if c < '0' || c > '9' || len(digits) > maxDigits {
+			return 0, fmt.Errorf("invalid frame length %q", digits)
+		}
+	}
+	n, err := strconv.Atoi(string(digits))
+	if err != nil || n > s.cfg.MaxLineSize {
+		return 0, fmt.Errorf("invalid frame length %q", digits)
+	}
+	return n, nil
+}
+
+// handle parses and filters the message and sends it to the producer channel,
+// it returns false when the context is cancelled
+func (s *syslogListener) handle(ctx context.Context, raw string) bool {
+	if strings.TrimSpace(raw) == "" {
+		return true
+	}
+	msg, err := ParseSyslog(raw)
+	if err != nil {
+		s.logger.Warn("dropping invalid syslog message", zap.Error(err))
+		return true
+	}
+	if msg.SeverityCode > s.cfg.MaxSeverity {
+		s.logger.Debug("dropping syslog message below severity threshold", zap.String("severity", msg.Severity))
+		return true
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Error("failed to marshal syslog message", zap.Error(err))
+		return true
+	}
+	select {
+	case s.producerChan <- string(b):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
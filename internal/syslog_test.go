@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_ParseSyslog(t *testing.T) {
+	tests := map[string]struct {
+		raw     string
+		want    *SyslogMessage
+		wantErr bool
+	}{
+		"Should parse RFC 5424 message with structured data": {
+			raw: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication"][meta seq="1"] ` + "\ufeff" + `An application event`,
+			want: &SyslogMessage{
+				Facility:     "local4",
+				Severity:     "notice",
+				SeverityCode: 5,
+				Timestamp:    "2003-10-11T22:14:15.003Z",
+				Hostname:     "mymachine.example.com",
+				AppName:      "evntslog",
+				MsgID:        "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": `App"lication`},
+					"meta":              {"seq": "1"},
+				},
+				Message: "An application event",
+			},
+		},
+		"Should parse RFC 5424 message without structured data and message": {
+			raw: "<34>1 2003-10-11T22:14:15.003Z host su 77 - -",
+			want: &SyslogMessage{
+				Facility:     "auth",
+				Severity:     "crit",
+				SeverityCode: 2,
+				Timestamp:    "2003-10-11T22:14:15.003Z",
+				Hostname:     "host",
+				AppName:      "su",
+				ProcID:       "77",
+			},
+		},
+		"Should parse RFC 3164 message": {
+			raw: "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8",
+			want: &SyslogMessage{
+				Facility:     "auth",
+				Severity:     "crit",
+				SeverityCode: 2,
+				Timestamp:    "Oct 11 22:14:15",
+				Hostname:     "mymachine",
+				AppName:      "su",
+				ProcID:       "123",
+				Message:      "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		"Should parse RFC 3164 message without header": {
+			raw: "<13>hello world",
+			want: &SyslogMessage{
+				Facility:     "user",
+				Severity:     "notice",
+				SeverityCode: 5,
+				Message:      "hello world",
+			},
+		},
+		"Should fail when priority is missing": {
+			raw:     "hello world",
+			wantErr: true,
+		},
+		"Should fail when priority is out of range": {
+			raw:     "<999>hello world",
+			wantErr: true,
+		},
+		"Should fail when structured data is unterminated": {
+			raw:     `<165>1 - - - - - [id key="value"`,
+			wantErr: true,
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got, err := ParseSyslog(testCase.raw)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func Test_ParseSyslogSeverity(t *testing.T) {
+	for input, want := range map[string]int{"warning": 4, "WARN": 4, "err": 3, "error": 3, "7": 7, "emerg": 0} {
+		got, err := ParseSyslogSeverity(input)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, input)
+	}
+	_, err := ParseSyslogSeverity("verbose")
+	assert.Error(t, err)
+}
+
+func Test_syslogListener_Serve(t *testing.T) {
+	tests := map[string]struct {
+		network  string
+		severity int
+		frames   []string
+		want     []string
+	}{
+		"Should receive messages over udp and drop the ones below severity threshold": {
+			network:  "udp",
+			severity: 4,
+			frames:   []string{"<11>app: disk failed", "<14>app: all good", "<12>app: disk almost full"},
+			want:     []string{"disk failed", "disk almost full"},
+		},
+		"Should receive newline and octet counted frames over tcp": {
+			network:  "tcp",
+			severity: 7,
+			frames:   []string{"<14>app: first\n", octetFrame("<14>1 - host app - - - second framed")},
+			want:     []string{"first", "second framed"},
+		},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			address := freeAddr(t, testCase.network)
+			producerChan := make(chan string)
+			s, err := NewSyslogListener(zap.NewNop(), fmt.Sprintf("%s://%s", testCase.network, address),
+				SyslogConfig{MaxSeverity: testCase.severity}, producerChan)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.Serve(ctx)
+			if testCase.network == "udp" {
+				waitUDPBound(t, address)
+			}
+
+			conn := dialRetry(t, testCase.network, address)
+			defer conn.Close()
+			go func() {
+				for _, frame := range testCase.frames {
+					conn.Write([]byte(frame))
+				}
+			}()
+
+			for _, want := range testCase.want {
+				select {
+				case line := <-producerChan:
+					var msg SyslogMessage
+					assert.NoError(t, json.Unmarshal([]byte(line), &msg))
+					assert.Equal(t, want, msg.Message)
+					assert.Equal(t, "app", msg.AppName)
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for %q", want)
+				}
+			}
+		})
+	}
+}
+
+func Test_syslogListener_ClosedConns(t *testing.T) {
+	address := freeAddr(t, "tcp")
+	s, err := NewSyslogListener(zap.NewNop(), "tcp://"+address, SyslogConfig{MaxSeverity: 7}, make(chan string))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+	dialRetry(t, "tcp", address).Close()
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	// the goroutines of the closed connections end with them
+	for i := 0; i < 20; i++ {
+		dialRetry(t, "tcp", address).Close()
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func Test_syslogListener_readFrame(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		"Should read an octet counted frame":                 {input: octetFrame("<14>app: framed"), want: "<14>app: framed"},
+		"Should read a newline delimited frame":              {input: "<14>app: line\n", want: "<14>app: line"},
+		"Should reject a frame length over max line size":    {input: "70000 <14>app: too long", wantErr: true},
+		"Should reject a frame length of non digits":         {input: "12a <14>app: framed", wantErr: true},
+		"Should reject a frame length never ending in space": {input: strings.Repeat("1", 1<<20), wantErr: true},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			s := &syslogListener{cfg: SyslogConfig{ListenerConfig: ListenerConfig{MaxLineSize: 64 * 1024}}}
+			r := bufio.NewReaderSize(strings.NewReader(testCase.input), 4096)
+			got, err := s.readFrame(r)
+			if testCase.wantErr {
+				// rejected before the end of the input is reached
+				assert.Error(t, err)
+				assert.NotEqual(t, io.EOF, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+// freeAddr returns a free local address for the given network
+func freeAddr(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func octetFrame(msg string) string {
+	return fmt.Sprintf("%d %s", len(msg), msg)
+}
+
+// waitUDPBound waits until the udp address is bound by the receiver
+func waitUDPBound(t *testing.T, address string) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("udp receiver did not bind %s", address)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// TemplateData is the data available to the body template
+type TemplateData struct {
+	Message string                 // raw message
+	Fields  map[string]interface{} // fields of the JSON message, nil for plain text messages
+}
+
+// Template renders the notification body from the message
+type Template struct {
+	tmpl *template.Template
+}
+
+// templateFuncs are the helper functions available to the body template
+var templateFuncs = template.FuncMap{
+	// json encodes the value, e.g. {"text": {{json .Message}}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// field returns the dotted field path of the data fields, e.g. {{field . "labels.team"}}
+	"field": func(data TemplateData, path string) string {
+		v, _ := LookupField(data.Fields, path)
+		return v
+	},
+}
+
+// NewTemplate constructor, parses the text/template body
+func NewTemplate(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", name, err)
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Render executes the template for the message
+func (t *Template) Render(msg string) (string, error) {
+	return t.Execute(TemplateData{Message: msg, Fields: ParseFields(msg)})
+}
+
+// Execute executes the template with the given data
+func (t *Template) Execute(data interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.tmpl.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", t.tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,481 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTraceField   = "traceparent" // default JSON field carrying the trace context of the message
+	TraceparentHeader   = "traceparent" // W3C trace context header
+	defaultServiceName  = "go-notifier" // service name of the exported spans
+	otlpTracesPath      = "/v1/traces"  // OTLP/HTTP traces path appended to endpoints without path
+	otlpBatchSize       = 512           // max spans per OTLP export request
+	otlpFlushInterval   = time.Second   // max delay of the ended spans before export
+	otlpSpanQueueLength = 4 * otlpBatchSize
+)
+
+// Span names of the message journey
+const (
+	SpanMessage = "message" // whole journey of the message, from read to the final outcome
+	SpanRead    = "read"    // read and passed through the stages until queued for the workers
+	SpanQueued  = "queued"  // wait in the queues until a worker picks the message
+	SpanAttempt = "attempt" // delivery attempt to a destination
+)
+
+// Span statuses
+const (
+	SpanStatusOK    = "ok"
+	SpanStatusError = "error"
+)
+
+// TraceID is the W3C trace id
+type TraceID [16]byte
+
+// SpanID is the W3C parent id
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the trace id is not all zeros as required by the W3C trace context
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid reports whether the span id is not all zeros as required by the W3C trace context
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanExporter is the interface that wraps the Export and Close methods,
+// Export receives every ended span and Close flushes the pending spans
+type SpanExporter interface {
+	Export(span *SpanData)
+	Close() error
+}
+
+// SpanData is the exported view of an ended span
+type SpanData struct {
+	TraceID       string            `json:"trace_id"`
+	SpanID        string            `json:"span_id"`
+	ParentSpanID  string            `json:"parent_span_id,omitempty"`
+	Name          string            `json:"name"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Status        string            `json:"status"`
+	StatusMessage string            `json:"status_message,omitempty"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+}
+
+// Tracer creates the spans of the messages and hands the ended ones to the exporter,
+// every method is a no-op on a nil Tracer so that tracing is optional
+type Tracer struct {
+	exporter SpanExporter
+	clock    Clock
+}
+
+// NewTracer constructor, the clock is the span time source, real clock when nil
+func NewTracer(exporter SpanExporter, clock Clock) *Tracer {
+	return &Tracer{exporter: exporter, clock: orClock(clock)}
+}
+
+// Start starts a root span, the trace of the parent context is continued when valid
+func (t *Tracer) Start(name string, parent TraceContext) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: t.clock.Now(), parentID: parent.SpanID, traceID: parent.TraceID}
+	if !s.traceID.IsValid() {
+		rand.Read(s.traceID[:])
+		s.parentID = SpanID{}
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Close flushes the pending spans of the exporter
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Close()
+}
+
+// TraceContext is the trace and the parent span a new span continues
+type TraceContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// ParseTraceContext parses a W3C traceparent (00-<trace id>-<parent id>-<flags>) or a bare 32 hex digits trace id
+func ParseTraceContext(s string) (TraceContext, error) {
+	var tc TraceContext
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 32 {
+		if _, err := hex.Decode(tc.TraceID[:], []byte(s)); err != nil || !tc.TraceID.IsValid() {
+			return TraceContext{}, fmt.Errorf("invalid trace id %q", s)
+		}
+		return tc, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil || !tc.TraceID.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid traceparent trace id %q", parts[1])
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil || !tc.SpanID.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid traceparent parent id %q", parts[2])
+	}
+	return tc, nil
+}
+
+// Span is a timed operation of a message journey, every method is a no-op on a nil Span
+type Span struct {
+	tracer   *Tracer
+	name     string
+	traceID  TraceID
+	spanID   SpanID
+	parentID SpanID
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	ended bool
+}
+
+// Child starts a span of the same trace with this span as parent
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.ChildAt(name, s.tracer.clock.Now())
+}
+
+// ChildAt starts a child span at the given start time, e.g. for the time a message waited in the queue
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{tracer: s.tracer, name: name, start: start, traceID: s.traceID, parentID: s.spanID}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+// SetAttr sets the attribute of the span
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]string{}
+	}
+	s.attrs[key] = value
+}
+
+// Traceparent returns the W3C traceparent header value with this span as parent, empty on a nil Span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+}
+
+// Start returns the start time of the span
+func (s *Span) Start() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return s.start
+}
+
+// TraceID returns the trace id of the span
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.traceID
+}
+
+// End ends the span with error status when err is not nil and exports it, only the first call counts
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := &SpanData{
+		TraceID: s.traceID.String(),
+		SpanID:  s.spanID.String(),
+		Name:    s.name,
+		Start:   s.start,
+		End:     s.tracer.clock.Now(),
+		Status:  SpanStatusOK,
+	}
+	if s.parentID.IsValid() {
+		data.ParentSpanID = s.parentID.String()
+	}
+	if err != nil {
+		data.Status = SpanStatusError
+		data.StatusMessage = err.Error()
+	}
+	if len(s.attrs) > 0 {
+		data.Attributes = make(map[string]string, len(s.attrs))
+		for k, v := range s.attrs {
+			data.Attributes[k] = v
+		}
+	}
+	s.mu.Unlock()
+	s.tracer.exporter.Export(data)
+}
+
+// NewSpanExporter creates the exporter of the target, stdout writes the spans as JSON lines
+// and an http(s) url is the OTLP/HTTP endpoint of a collector
+func NewSpanExporter(logger *zap.Logger, target string, stdout io.Writer) (SpanExporter, error) {
+	if target == "stdout" {
+		return NewStdoutExporter(stdout), nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid trace exporter %q, should be stdout or an OTLP http(s) endpoint", target)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	return NewOTLPExporter(logger, u.String()), nil
+}
+
+// stdoutExporter writes the spans as JSON lines
+type stdoutExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewStdoutExporter constructor
+func NewStdoutExporter(w io.Writer) SpanExporter {
+	return &stdoutExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *stdoutExporter) Export(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(span)
+}
+
+func (e *stdoutExporter) Close() error { return nil }
+
+// otlpExporter sends the spans in batches to an OTLP/HTTP endpoint in the JSON encoding
+type otlpExporter struct {
+	logger   *zap.Logger
+	client   *http.Client
+	endpoint string
+	spans    chan *SpanData
+	done     chan struct{}
+	closing  sync.Once
+	mu       sync.Mutex
+	dropped  uint64 // spans dropped on a full queue
+	closeErr error  // error of the last export
+}
+
+// NewOTLPExporter constructor, the spans are exported every second or once a batch is full,
+// spans are dropped when the collector can't keep up so that tracing never blocks the delivery
+func NewOTLPExporter(logger *zap.Logger, endpoint string) SpanExporter {
+	e := &otlpExporter{
+		logger:   logger,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		endpoint: endpoint,
+		spans:    make(chan *SpanData, otlpSpanQueueLength),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) Export(span *SpanData) {
+	select {
+	case e.spans <- span:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Close exports the pending spans
+func (e *otlpExporter) Close() error {
+	e.closing.Do(func() { close(e.spans) })
+	<-e.done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dropped > 0 {
+		e.logger.Warn("dropped spans, the trace collector can't keep up", zap.Uint64("dropped", e.dropped))
+	}
+	return e.closeErr
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []*SpanData
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				e.flush(batch)
+				return
+			}
+			if batch = append(batch, span); len(batch) >= otlpBatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) flush(batch []*SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	err := e.post(batch)
+	if err != nil {
+		e.logger.Error("failed to export spans", zap.Int("spans", len(batch)), zap.Error(err))
+	}
+	e.mu.Lock()
+	e.closeErr = err
+	e.mu.Unlock()
+}
+
+func (e *otlpExporter) post(batch []*SpanData) error {
+	b, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// otlp JSON encoding of the ExportTraceServiceRequest
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlp span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+func otlpRequest(batch []*SpanData) otlpTraces {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.Name == SpanAttempt {
+			span.Kind = otlpKindClient
+		}
+		if s.Status == SpanStatusError {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.StatusMessage}
+		}
+		for _, key := range sortedAttrKeys(s.Attributes) {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: s.Attributes[key]}})
+		}
+		spans[i] = span
+	}
+	resource := otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: defaultServiceName}}}}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName}, Spans: spans}},
+	}}}
+}
+
+func sortedAttrKeys(attrs map[string]string) []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// spanRecorder is the span exporter recording the ended spans
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (r *spanRecorder) Export(span *SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *spanRecorder) Close() error { return nil }
+
+func Test_ParseTraceContext(t *testing.T) {
+	tests := map[string]struct {
+		value   string
+		want    string
+		parent  string
+		wantErr bool
+	}{
+		"Should parse the traceparent":       {value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: "4bf92f3577b34da6a3ce929d0e0e4736", parent: "00f067aa0ba902b7"},
+		"Should parse a bare trace id":       {value: "4BF92F3577B34DA6A3CE929D0E0E4736", want: "4bf92f3577b34da6a3ce929d0e0e4736", parent: "0000000000000000"},
+		"Should reject the all zero ids":     {value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		"Should reject the invalid version":  {value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		"Should reject the non hex trace id": {value: "zz-4bf92f3577b34da6a3ce929d0e0e4736", wantErr: true},
+	}
+	for testName, testCase := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tc, err := ParseTraceContext(testCase.value)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.want, tc.TraceID.String())
+			assert.Equal(t, testCase.parent, tc.SpanID.String())
+		})
+	}
+}
+
+func Test_Tracer_Delivery(t *testing.T) {
+	var headers []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get(TraceparentHeader))
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	recorder := &spanRecorder{}
+	envelope := &Envelope{Tracer: NewTracer(recorder, nil), TraceField: DefaultTraceField}
+	retry := RetryPolicy{Attempts: 1, Backoff: time.Millisecond}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{Name: "ops", URL: srv.URL, Retry: &retry})
+	assert.NoError(t, err)
+	consumerChan := make(chan *Message, 1)
+	n := NewNotifier(zap.NewNop(), client, time.Nanosecond, nil, consumerChan, NotifierConfig{})
+	msg := envelope.Wrap(`{"text":"disk full","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+	envelope.Queue(msg)
+	consumerChan <- msg
+	close(consumerChan)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	n.Process(wg, 1)
+
+	spans := recorder.spans
+	if !assert.Len(t, spans, 5) {
+		return
+	}
+	read, queued, first, second, message := spans[0], spans[1], spans[2], spans[3], spans[4]
+	assert.Equal(t, []string{SpanRead, SpanQueued, SpanAttempt, SpanAttempt, SpanMessage}, []string{read.Name, queued.Name, first.Name, second.Name, message.Name})
+	for _, span := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID, "the trace of the input is continued")
+	}
+	assert.Equal(t, "00f067aa0ba902b7", message.ParentSpanID)
+	assert.Equal(t, map[string]string{"outcome": OutcomeSent, "priority": "normal"}, message.Attributes)
+	assert.Equal(t, message.SpanID, read.ParentSpanID)
+	assert.Equal(t, message.Start, read.Start, "the message span starts when the line is read")
+	assert.False(t, queued.Start.Before(read.Start), "the queue wait starts once the message is queued")
+	assert.Equal(t, message.SpanID, queued.ParentSpanID)
+	assert.Equal(t, message.SpanID, first.ParentSpanID)
+	assert.Equal(t, SpanStatusError, first.Status)
+	assert.Equal(t, map[string]string{"destination": "ops", "attempt": "1", "http.status_code": "503"}, first.Attributes)
+	assert.Equal(t, SpanStatusOK, second.Status)
+	assert.Equal(t, "2", second.Attributes["attempt"])
+	// every attempt is the parent of the receiver span
+	assert.Equal(t, []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-" + first.SpanID + "-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-" + second.SpanID + "-01",
+	}, headers)
+}
+
+func Test_Tracer_NewTrace(t *testing.T) {
+	recorder := &spanRecorder{}
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	tracer := NewTracer(recorder, clock)
+	envelope := &Envelope{Tracer: tracer, TraceField: DefaultTraceField}
+	msg := envelope.Wrap(`{"traceparent":"invalid"}`)
+	clock.Advance(time.Second)
+	msg.Span.End(nil)
+	msg.Span.End(nil)
+
+	assert.Len(t, recorder.spans, 1, "span is exported once")
+	span := recorder.spans[0]
+	assert.Len(t, span.TraceID, 32)
+	assert.NotEqual(t, "00000000000000000000000000000000", span.TraceID)
+	assert.Empty(t, span.ParentSpanID)
+	assert.Equal(t, time.Second, span.End.Sub(span.Start))
+
+	// nil tracer and spans record nothing
+	var nilTracer *Tracer
+	assert.NotPanics(t, func() {
+		span := nilTracer.Start(SpanMessage, TraceContext{})
+		span.Child(SpanAttempt).End(nil)
+		span.SetAttr("k", "v")
+		assert.Empty(t, span.Traceparent())
+		assert.NoError(t, nilTracer.Close())
+	})
+}
+
+func Test_OTLPExporter(t *testing.T) {
+	// collector stand-in
+	var (
+		mu       sync.Mutex
+		requests []otlpTraces
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, otlpTracesPath, r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var req otlpTraces
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	exporter, err := NewSpanExporter(zap.NewNop(), srv.URL, nil)
+	assert.NoError(t, err)
+	tracer := NewTracer(exporter, nil)
+	msg := tracer.Start(SpanMessage, TraceContext{})
+	attempt := msg.Child(SpanAttempt)
+	attempt.SetAttr("destination", "ops")
+	attempt.End(&StatusError{StatusCode: 502})
+	msg.End(nil)
+	assert.NoError(t, tracer.Close())
+
+	if !assert.Len(t, requests, 1) {
+		return
+	}
+	resourceSpans := requests[0].ResourceSpans[0]
+	assert.Equal(t, []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "go-notifier"}}}, resourceSpans.Resource.Attributes)
+	spans := resourceSpans.ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, SpanAttempt, spans[0].Name)
+	assert.Equal(t, otlpKindClient, spans[0].Kind)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "unexpected status code 502"}, spans[0].Status)
+	assert.Equal(t, []otlpAttribute{{Key: "destination", Value: otlpValue{StringValue: "ops"}}}, spans[0].Attributes)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, msg.TraceID().String(), spans[1].TraceID)
+	assert.Equal(t, otlpStatus{Code: otlpStatusOK}, spans[1].Status)
+}
+
+func Test_NewSpanExporter_Invalid(t *testing.T) {
+	for _, target := range []string{"stderr", "ftp://collector", "localhost:4318"} {
+		_, err := NewSpanExporter(zap.NewNop(), target, nil)
+		assert.Error(t, err, target)
+	}
+}
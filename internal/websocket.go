@@ -0,0 +1,369 @@
+/*
+Copyright © 2022
+Author Bhakiyaraj Kalimuthu
+Email bhakiya.kalimuthu@gmail.com
+*/
+
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SchemeWS  = "ws"  // WebSocket, ws://host:port/path?ack_timeout=5s
+	SchemeWSS = "wss" // WebSocket over TLS
+
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // appended to the key of the handshake, RFC 6455
+	wsTimeout    = 5 * time.Second                        // max time of the handshake and of a frame write
+	wsMaxPayload = 1 << 20                                // max payload of a received frame
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// errWSClosed is the error of the sends once the sink is closed
+var errWSClosed = errors.New("websocket: sink closed")
+
+// wsSink sends every body as a text frame over a persistent WebSocket connection, the connection is
+// dialed on the first send and again once lost, the dials are spaced by the backoff of the destination retry policy
+type wsSink struct {
+	logger    *zap.Logger     // logger
+	clock     Clock           // ack timeout and reconnect backoff time source
+	url       *url.URL        // url of the handshake
+	headers   *requestHeaders // additional headers and authentication of the handshake
+	tlsConfig *tls.Config     // TLS of wss urls
+	ack       time.Duration   // wait for a frame acknowledging every sent frame, no ack when zero
+	reconnect RetryPolicy     // backoff between the failed dials
+	mu        sync.Mutex      // serializes the sends, a frame and its ack at a time
+	conn      *wsConn         // open connection, dialed on the next send when nil
+	closed    bool            // set once closed, the sends fail
+	failures  int             // consecutive failed dials
+	dialAt    time.Time       // no dial before
+}
+
+// newWSSink creates the WebSocket sink, ack_timeout of the url query enables the acks
+func newWSSink(logger *zap.Logger, dest Destination, u *url.URL) (Sink, error) {
+	sink := &wsSink{
+		logger:    logger,
+		clock:     orClock(dest.Clock),
+		url:       u,
+		tlsConfig: &tls.Config{ServerName: u.Hostname()},
+	}
+	if dest.Retry != nil {
+		sink.reconnect = *dest.Retry
+	}
+	if v := u.Query().Get("ack_timeout"); v != "" {
+		ack, err := time.ParseDuration(v)
+		if err != nil || ack <= 0 {
+			return nil, fmt.Errorf("invalid ack_timeout %q", v)
+		}
+		sink.ack = ack
+	}
+	var err error
+	if sink.headers, err = newRequestHeaders(logger, dest, sink.clock); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// Send writes the text frame and waits for the ack when enabled, the status code is the one of a rejected handshake,
+// a missing ack drops the connection as the receiver state is unknown
+func (s *wsSink) Send(body string, span *Span) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errWSClosed
+	}
+	c, code, err := s.connect()
+	if err != nil {
+		return code, err
+	}
+	// a frame received since the last ack doesn't acknowledge this one
+	select {
+	case <-c.acks:
+	default:
+	}
+	if err := c.write(wsText, []byte(body)); err != nil {
+		s.drop(err)
+		return 0, fmt.Errorf("websocket: %w", err)
+	}
+	if s.ack <= 0 {
+		return 0, nil
+	}
+	select {
+	case <-c.acks:
+		return 0, nil
+	case <-c.done:
+		s.conn = nil
+		return 0, fmt.Errorf("websocket: connection lost waiting for the ack: %w", c.err)
+	case <-s.clock.After(s.ack):
+		err := fmt.Errorf("websocket: no ack within %s", s.ack)
+		s.drop(err)
+		return 0, err
+	}
+}
+
+// connect returns the open connection or dials a new one once the reconnect backoff is over
+func (s *wsSink) connect() (*wsConn, int, error) {
+	if s.conn != nil {
+		select {
+		case <-s.conn.done:
+			s.logger.Warn("websocket connection lost, reconnecting", zap.Error(s.conn.err))
+			s.conn = nil
+		default:
+			return s.conn, 0, nil
+		}
+	}
+	if wait := s.dialAt.Sub(s.clock.Now()); wait > 0 {
+		<-s.clock.After(wait)
+	}
+	c, code, err := s.dial()
+	if err != nil {
+		s.failures++
+		s.dialAt = s.clock.Now().Add(s.reconnect.Delay(s.failures))
+		return nil, code, err
+	}
+	s.failures = 0
+	s.conn = c
+	s.logger.Info("websocket connected")
+	return c, 0, nil
+}
+
+// Close closes the connection, its reader stops once the connection is closed
+func (s *wsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.write(wsClose, nil) // closing handshake, the server answer isn't awaited
+	}
+	s.drop(errWSClosed)
+	return s.headers.Close()
+}
+
+// drop closes the connection, the next send dials a new one
+func (s *wsSink) drop(err error) {
+	if s.conn != nil {
+		s.conn.close(err)
+		s.conn = nil
+	}
+}
+
+// dial opens the connection and makes the opening handshake, a rejected handshake is returned as StatusError
+func (s *wsSink) dial() (*wsConn, int, error) {
+	addr := s.url.Host
+	if s.url.Port() == "" {
+		port := "80"
+		if s.url.Scheme == SchemeWSS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(s.url.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: wsTimeout}
+	var conn net.Conn
+	var err error
+	if s.url.Scheme == SchemeWSS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("websocket: %w", err)
+	}
+	r, code, err := s.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, code, err
+	}
+	c := &wsConn{conn: conn, acks: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.read(r)
+	return c, 0, nil
+}
+
+// handshake upgrades the connection and returns its reader, which may have buffered the first frames
+func (s *wsSink) handshake(conn net.Conn) (*bufio.Reader, int, error) {
+	u := *s.url
+	u.Scheme = "http"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := s.headers.apply(req, ""); err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(wsTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		return nil, 0, fmt.Errorf("websocket: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("websocket: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, resp.StatusCode, &StatusError{StatusCode: resp.StatusCode}
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, resp.StatusCode, errors.New("websocket: invalid Sec-WebSocket-Accept")
+	}
+	return r, resp.StatusCode, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept of the Sec-WebSocket-Key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn is an open WebSocket connection, its reader answers the pings and the close and signals the data frames as acks
+type wsConn struct {
+	conn net.Conn
+	wmu  sync.Mutex    // guards the writes
+	acks chan struct{} // signaled on every data frame received
+	once sync.Once
+	done chan struct{} // closed once the connection is lost
+	err  error         // cause of the loss, set before done is closed
+}
+
+// write writes a masked frame as sent by a client
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsTimeout))
+	return writeFrame(c.conn, opcode, payload, true)
+}
+
+func (c *wsConn) read(r *bufio.Reader) {
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		switch opcode {
+		case wsPing:
+			c.write(wsPong, payload)
+		case wsClose:
+			c.write(wsClose, payload)
+			c.close(errors.New("closed by the server"))
+			return
+		case wsText, wsBinary, wsContinuation:
+			select {
+			case c.acks <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// close closes the connection, only the first cause is kept
+func (c *wsConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writeFrame writes a final frame, masked with a random key when mask is set
+func writeFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if mask {
+		header[1] |= 0x80
+		key := make([]byte, 4)
+		rand.Read(key)
+		header = append(header, key...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ key[i%4]
+		}
+		payload = masked
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readFrame reads a frame and returns its opcode and its unmasked payload
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	opcode, n := header[0]&0x0f, uint64(header[1]&0x7f)
+	switch n {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b)
+	}
+	if n > wsMaxPayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes over the max of %d", n, wsMaxPayload)
+	}
+	var key []byte
+	if header[1]&0x80 != 0 {
+		key = make([]byte, 4)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if key != nil {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// wsServer records the text frames sent to it, acking them with an ok frame when ack is set
+type wsServer struct {
+	*httptest.Server
+	ack        int32 // acks the frames when set
+	reject     int32 // handshakes rejected with 503 before accepting
+	handshakes int32
+	mu         sync.Mutex
+	frames     []string
+	closeAfter int // frames after which the server closes the connection, never when zero
+}
+
+func newWSServer(t *testing.T) *wsServer {
+	s := &wsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&s.handshakes, 1) <= atomic.LoadInt32(&s.reject) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+		assert.Equal(t, "13", r.Header.Get("Sec-WebSocket-Version"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+		rw.Flush()
+		for n := 1; ; n++ {
+			opcode, payload, err := readFrame(rw)
+			if err != nil || opcode == wsClose {
+				return
+			}
+			s.mu.Lock()
+			s.frames = append(s.frames, string(payload))
+			s.mu.Unlock()
+			if atomic.LoadInt32(&s.ack) == 1 {
+				writeFrame(conn, wsText, []byte("ok"), false)
+			}
+			if n == s.closeAfter {
+				writeFrame(conn, wsClose, []byte{0x03, 0xe8}, false)
+				readFrame(rw) // close reply
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *wsServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.frames...)
+}
+
+func (s *wsServer) url(query string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/stream" + query
+}
+
+func Test_WSSink(t *testing.T) {
+	tests := map[string]struct {
+		ack   bool
+		query string
+	}{
+		"Should send the frames over one connection": {},
+		"Should wait for the acks":                   {ack: true, query: "?ack_timeout=5s"},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newWSServer(t)
+			if testCase.ack {
+				srv.ack = 1
+			}
+			client, err := NewDestinationClient(zap.NewNop(), Destination{
+				Name:    "dashboard",
+				URL:     srv.url(testCase.query),
+				Headers: map[string]string{"Authorization": "Bearer token"},
+			})
+			assert.NoError(t, err)
+			for _, msg := range []string{"disk full", "cpu high", strings.Repeat("a", 70000)} {
+				assert.NoError(t, client.Notify(NewMessage(msg)))
+			}
+			// without acks the frames may still be on their way
+			assert.Eventually(t, func() bool { return len(srv.received()) == 3 }, time.Second, time.Millisecond)
+			assert.Equal(t, []string{"disk full", "cpu high", strings.Repeat("a", 70000)}, srv.received())
+			assert.Equal(t, int32(1), atomic.LoadInt32(&srv.handshakes))
+		})
+	}
+}
+
+func Test_WSSink_MissingAck(t *testing.T) {
+	srv := newWSServer(t)
+	client, err := NewDestinationClient(zap.NewNop(), Destination{
+		Name:    "dashboard",
+		URL:     srv.url("?ack_timeout=20ms"),
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	assert.NoError(t, err)
+	assert.EqualError(t, client.Notify(NewMessage("disk full")), "websocket: no ack within 20ms")
+
+	// the connection is dropped
+	atomic.StoreInt32(&srv.ack, 1)
+	assert.NoError(t, client.Notify(NewMessage("cpu high")))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.handshakes))
+}
+
+func Test_WSSink_Reconnect(t *testing.T) {
+	srv := newWSServer(t)
+	srv.closeAfter = 1
+	srv.reject = 1
+	clock := NewFakeClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	retry := RetryPolicy{Backoff: time.Second}
+	client, err := NewDestinationClient(zap.NewNop(), Destination{
+		Name:    "dashboard",
+		URL:     srv.url(""),
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Retry:   &retry,
+		Clock:   clock,
+	})
+	assert.NoError(t, err)
+	sink := client.(*sinkClient).sink.(*wsSink)
+
+	// rejected handshake
+	err = client.Notify(NewMessage("disk full"))
+	assert.Equal(t, &StatusError{StatusCode: http.StatusServiceUnavailable}, err)
+
+	// dialed again once the backoff is over
+	done := make(chan error)
+	go func() { done <- client.Notify(NewMessage("cpu high")) }()
+	waitBlocked(clock)
+	clock.Advance(time.Second)
+	assert.NoError(t, <-done)
+
+	// closed by the server after the first frame
+	assert.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		select {
+		case <-sink.conn.done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, client.Notify(NewMessage("mem low")))
+	assert.Eventually(t, func() bool { return len(srv.received()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"cpu high", "mem low"}, srv.received())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&srv.handshakes))
+}
+
+func Test_WSSink_Close(t *testing.T) {
+	srv := newWSServer(t)
+	client, err := NewDestinationClient(zap.NewNop(), Destination{
+		Name:    "dashboard",
+		URL:     srv.url(""),
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Notify(NewMessage("disk full")))
+	conn := client.(*sinkClient).sink.(*wsSink).conn
+
+	// the connection is closed, which stops its reader, and the later sends fail without dialing
+	assert.NoError(t, client.(io.Closer).Close())
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	assert.ErrorIs(t, client.Notify(NewMessage("cpu high")), errWSClosed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.handshakes))
+}
+
+func Test_Frame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 65535, 65536} {
+		for _, mask := range []bool{false, true} {
+			payload := strings.Repeat("x", n)
+			b := new(strings.Builder)
+			assert.NoError(t, writeFrame(b, wsBinary, []byte(payload), mask))
+			opcode, got, err := readFrame(bufio.NewReader(strings.NewReader(b.String())))
+			assert.NoError(t, err)
+			assert.Equal(t, byte(wsBinary), opcode)
+			assert.Equal(t, payload, string(got))
+		}
+	}
+}